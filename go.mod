@@ -1,3 +1,12 @@
 module api-rate-limit-server
 
 go 1.22.3
+
+require (
+	github.com/andybalholm/brotli v1.2.5
+	github.com/klauspost/compress v1.18.0
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/net v0.34.0
+)
+
+require golang.org/x/text v0.21.0 // indirect
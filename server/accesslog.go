@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+func validAccessLogFormat(format string) bool {
+	return format == "" || format == "common" || format == "combined" || format == "json"
+}
+
+// accessRecord is one line of the json access log format, which -replay
+// reads back.
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// accessLogged writes the access log line for each request or tunnel next
+// handles. It wraps the whole forwarding and tunnel chains, so requests the
+// limits in front of the handlers turn away, with 429 or 503, are logged too.
+func (p *Proxy) accessLogged(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		w := &accessLogWriter{responseRecorder: responseRecorder{ResponseWriter: res}, req: withoutUserinfo(req)}
+		next(w, req)
+		p.logAccess(w.req, w.status, w.bytes, start)
+	}
+}
+
+// accessLogWriter records the response an access log line reports. req is
+// the request the line describes, which handlers that rewrite the target
+// replace with accessLogAs.
+type accessLogWriter struct {
+	responseRecorder
+	req *http.Request
+}
+
+// Hijack passes through to the wrapped writer, for CONNECT tunnels.
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+// accessLogAs makes the access log line for res describe req, the request
+// as the handler rewrote it, when res comes from accessLogged.
+func accessLogAs(res http.ResponseWriter, req *http.Request) {
+	if w, ok := res.(*accessLogWriter); ok {
+		w.req = req
+	}
+}
+
+// accessLogBytes sets the size the access log line for res reports, for a
+// tunnel whose bytes don't pass through res.
+func accessLogBytes(res http.ResponseWriter, n int64) {
+	if w, ok := res.(*accessLogWriter); ok {
+		w.bytes = n
+	}
+}
+
+// withoutUserinfo returns req, or a copy of it without the credentials in
+// its target, which are never logged.
+func withoutUserinfo(req *http.Request) *http.Request {
+	if req.URL.User == nil {
+		return req
+	}
+	logged := *req
+	u := *req.URL
+	u.User = nil
+	logged.URL = &u
+	logged.RequestURI = u.String()
+	return &logged
+}
+
+// logAccess writes one NCSA Common or Combined Log Format line, or a JSON
+// accessRecord, for req.
+func (p *Proxy) logAccess(req *http.Request, status int, bytes int64, start time.Time) {
+	if p.cfg.AccessLogFormat == "" || !p.accessLogSampled(status, time.Since(start)) {
+		return
+	}
+	if p.cfg.AccessLogFormat == "json" {
+		line, _ := json.Marshal(accessRecord{
+			Time:       start,
+			Client:     p.clientIP(req),
+			Method:     req.Method,
+			URL:        req.RequestURI,
+			Proto:      req.Proto,
+			Status:     status,
+			Bytes:      bytes,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    req.Referer(),
+			UserAgent:  req.UserAgent(),
+		})
+		p.logEvent("%s", line)
+		return
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] %s %d %s",
+		p.clientIP(req), start.Format(clfTimeFormat),
+		quoteLogField(req.Method+" "+req.RequestURI+" "+req.Proto), status, size)
+	if p.cfg.AccessLogFormat == "combined" {
+		line += " " + quoteLogField(req.Referer()) + " " + quoteLogField(req.UserAgent())
+	}
+	p.logEvent("%s", line)
+}
+
+// accessLogSampled decides whether a request gets an access log line. Errors
+// and slow requests always do; other requests are kept at -access-log-sample.
+func (p *Proxy) accessLogSampled(status int, elapsed time.Duration) bool {
+	if status >= 400 || (p.cfg.SlowThreshold > 0 && elapsed > p.cfg.SlowThreshold) {
+		return true
+	}
+	return p.cfg.AccessLogSample >= 1 || rand.Float64() < p.cfg.AccessLogSample
+}
+
+// quoteLogField double-quotes s for an access log line, escaping embedded
+// quotes and backslashes, and renders an empty value as "-".
+func quoteLogField(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
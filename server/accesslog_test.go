@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accessRecords parses the json access log lines in logs.
+func accessRecords(t *testing.T, logs *logBuffer) []accessRecord {
+	t.Helper()
+	var records []accessRecord
+	for _, line := range logs.lines(`"duration_ms"`) {
+		var r accessRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("access log line %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAccessLogIncludesRejectedRequests(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs, AccessLogFormat: "json", AccessLogSample: 1, RateLimit: 1})
+
+	get(p, target)
+	get(p, target)
+	p.maintenance.Store(true)
+	get(p, target)
+
+	records := accessRecords(t, logs)
+	if len(records) != 3 {
+		t.Fatalf("logged %d requests, want 3:\n%s", len(records), logs)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		if records[i].Status != want {
+			t.Errorf("line %d: status %d, want %d", i, records[i].Status, want)
+		}
+		if records[i].URL != target {
+			t.Errorf("line %d: URL %q, want %q", i, records[i].URL, target)
+		}
+	}
+	if records[0].Bytes != int64(len("hello")) {
+		t.Errorf("line 0: %d bytes, want %d", records[0].Bytes, len("hello"))
+	}
+}
+
+func TestAccessLogOmitsUserinfo(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	u := newTestUpstream(t, upstream.ServeHTTP)
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs, AccessLogFormat: "common", AccessLogSample: 1, RateLimit: 1})
+
+	target := "http://user:secret@" + u.Host + "/page"
+	if rec := get(p, target); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if rec := get(p, target); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", rec.Code)
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("credentials logged:\n%s", logs)
+	}
+	if n := len(logs.lines(`"GET http://` + u.Host + `/page HTTP/1.1"`)); n != 2 {
+		t.Errorf("logged %d lines for the request, want 2:\n%s", n, logs)
+	}
+}
+
+func TestAccessLogCountsTunnelBytes(t *testing.T) {
+	dest := newEchoServer(t)
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs, AccessLogFormat: "json", AccessLogSample: 1})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	conn := openTunnel(t, srv.Listener.Addr().String(), dest)
+	conn.Write([]byte("ping"))
+	io.ReadFull(conn, make([]byte, 4))
+	// The echo server keeps its side open, so close the tunnel as an admin.
+	for _, tun := range listTunnels(t, p) {
+		serve(p, adminRequest(http.MethodDelete, fmt.Sprintf("/admin/tunnels/%d", tun.ID)))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(accessRecords(t, logs)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	records := accessRecords(t, logs)
+	if len(records) != 1 {
+		t.Fatalf("logged %d lines, want 1:\n%s", len(records), logs)
+	}
+	if r := records[0]; r.Method != http.MethodConnect || r.Status != http.StatusOK || r.Bytes != 4 {
+		t.Errorf("logged %+v, want CONNECT 200 with 4 bytes", r)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs, AccessLogFormat: "json", AccessLogSample: 0, RateLimit: 2})
+
+	for i := 0; i < 4; i++ {
+		get(p, target)
+	}
+	// With sampling at 0 only the two rate-limited requests are kept.
+	records := accessRecords(t, logs)
+	if len(records) != 2 {
+		t.Fatalf("logged %d lines, want 2:\n%s", len(records), logs)
+	}
+	for _, r := range records {
+		if r.Status != http.StatusTooManyRequests {
+			t.Errorf("logged status %d, want only 429s", r.Status)
+		}
+	}
+
+	p = newTestProxy(t, Config{AccessLogSample: 0, SlowThreshold: time.Second})
+	if !p.accessLogSampled(http.StatusOK, 2*time.Second) {
+		t.Error("slow request not logged at sample 0")
+	}
+	if p.accessLogSampled(http.StatusOK, time.Millisecond) {
+		t.Error("fast 200 logged at sample 0")
+	}
+	p = newTestProxy(t, Config{AccessLogSample: 0.5})
+	kept := 0
+	for i := 0; i < 2000; i++ {
+		if p.accessLogSampled(http.StatusOK, 0) {
+			kept++
+		}
+	}
+	if kept < 800 || kept > 1200 {
+		t.Errorf("kept %d of 2000 at sample 0.5", kept)
+	}
+}
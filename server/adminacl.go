@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// adminOnly serves next only to admin clients: loopback addresses and the
+// -admin-allow networks, judged by the client IP after -trusted-proxies.
+// Anyone else who can reach the proxy gets 403, so proxy clients can't
+// change how the proxy runs or see what other clients are doing.
+func (p *Proxy) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !p.isAdminClient(req) {
+			http.Error(res, "Forbidden", http.StatusForbidden)
+			p.logEvent("Refused %s %s from %s: not an admin client", req.Method, req.URL.Path, p.clientIP(req))
+			p.metrics.IncCounter("proxy_admin_refused_total", nil)
+			return
+		}
+		next(res, req)
+	}
+}
+
+func (p *Proxy) isAdminClient(req *http.Request) bool {
+	ip := net.ParseIP(p.clientIP(req))
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, n := range p.cfg.AdminAllow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync/atomic"
+)
+
+// sketchDepth is the number of counter rows in a frequencySketch; a key's
+// estimate is the smallest of its counters, one per row.
+const sketchDepth = 4
+
+// sketchMaxCount is where counters saturate, as in TinyLFU's 4-bit counters.
+const sketchMaxCount = 15
+
+// frequencySketch is a count-min sketch of how often keys have been looked
+// up recently, used for TinyLFU cache admission. Every counter is halved
+// after ten lookups per counter in a row have been counted, so old
+// popularity fades. Counters are updated atomically without a lock; a
+// halving that races with increments loses a few counts, which only makes
+// the estimates slightly less exact.
+type frequencySketch struct {
+	seed      maphash.Seed
+	mask      uint32
+	rows      [sketchDepth][]atomic.Uint32
+	samples   atomic.Int64
+	resetAt   int64
+	resetting atomic.Bool
+}
+
+// newFrequencySketch sizes a sketch for a cache of about entries entries;
+// zero, for a cache bounded only by bytes, gets a default size.
+func newFrequencySketch(entries int) *frequencySketch {
+	width := 1024
+	if entries == 0 {
+		width = 1 << 16
+	}
+	for width < entries {
+		width <<= 1
+	}
+	s := &frequencySketch{seed: maphash.MakeSeed(), mask: uint32(width - 1), resetAt: int64(10 * width)}
+	for i := range s.rows {
+		s.rows[i] = make([]atomic.Uint32, width)
+	}
+	return s
+}
+
+// index returns key's counter in row i, by double hashing one 64-bit hash.
+func (s *frequencySketch) index(h uint64, i int) uint32 {
+	return (uint32(h) + uint32(i)*uint32(h>>32)) & s.mask
+}
+
+// increment counts one lookup of key.
+func (s *frequencySketch) increment(key string) {
+	h := maphash.String(s.seed, key)
+	for i := range s.rows {
+		c := &s.rows[i][s.index(h, i)]
+		for {
+			n := c.Load()
+			if n >= sketchMaxCount || c.CompareAndSwap(n, n+1) {
+				break
+			}
+		}
+	}
+	if s.samples.Add(1) >= s.resetAt && s.resetting.CompareAndSwap(false, true) {
+		s.halve()
+		s.samples.Store(0)
+		s.resetting.Store(false)
+	}
+}
+
+func (s *frequencySketch) halve() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			c := &s.rows[i][j]
+			c.Store(c.Load() / 2)
+		}
+	}
+}
+
+// estimate returns about how many times key has been looked up recently.
+func (s *frequencySketch) estimate(key string) uint32 {
+	h := maphash.String(s.seed, key)
+	least := uint32(sketchMaxCount)
+	for i := range s.rows {
+		if n := s.rows[i][s.index(h, i)].Load(); n < least {
+			least = n
+		}
+	}
+	return least
+}
+
+func validCacheAdmission(policy string) bool {
+	return policy == "" || policy == "all" || policy == "tinylfu"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	s := newFrequencySketch(100)
+	for i := 0; i < 5; i++ {
+		s.increment("popular")
+	}
+	s.increment("rare")
+	if n := s.estimate("popular"); n != 5 {
+		t.Errorf("estimate(popular) = %d, want 5", n)
+	}
+	if n := s.estimate("rare"); n != 1 {
+		t.Errorf("estimate(rare) = %d, want 1", n)
+	}
+	if n := s.estimate("unseen"); n > 1 {
+		t.Errorf("estimate(unseen) = %d, want about 0", n)
+	}
+
+	// Counters saturate, and fade once enough lookups have been counted.
+	for i := 0; i < 100; i++ {
+		s.increment("popular")
+	}
+	if n := s.estimate("popular"); n != sketchMaxCount {
+		t.Errorf("estimate(popular) = %d, want it saturated at %d", n, sketchMaxCount)
+	}
+	// Count fillers until the sketch halves and its sample count restarts.
+	for i := 0; s.samples.Load() != 0 && i < int(s.resetAt); i++ {
+		s.increment(fmt.Sprint("filler", i))
+	}
+	if n := s.estimate("popular"); n > sketchMaxCount/2+1 {
+		t.Errorf("estimate(popular) = %d after halving, want at most %d", n, sketchMaxCount/2+1)
+	}
+}
+
+// zipfHitRatio replays a Zipfian run of lookups against a cache of 100
+// entries, storing each miss, and returns the share of lookups that hit
+// after the first half warms the cache up.
+func zipfHitRatio(admission bool) float64 {
+	c := newLRUCache(0, 100)
+	if admission {
+		c.admission = newFrequencySketch(100)
+	}
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 10000)
+	const lookups = 200000
+	hits := 0
+	for i := 0; i < lookups; i++ {
+		key := fmt.Sprint("k", zipf.Uint64())
+		if _, ok := c.get(key); ok {
+			if i >= lookups/2 {
+				hits++
+			}
+			continue
+		}
+		c.add(testEntry(key, key))
+	}
+	return float64(hits) / (lookups / 2)
+}
+
+func TestTinyLFUBeatsLRUOnZipfianLoad(t *testing.T) {
+	lru, tinyLFU := zipfHitRatio(false), zipfHitRatio(true)
+	t.Logf("hit ratio: LRU %.3f, TinyLFU %.3f", lru, tinyLFU)
+	if tinyLFU <= lru {
+		t.Errorf("TinyLFU hit ratio %.3f, want it above LRU's %.3f", tinyLFU, lru)
+	}
+}
+
+func TestCacheAdmissionConfig(t *testing.T) {
+	if p := newTestProxy(t, Config{CacheAdmission: "tinylfu", CacheMaxEntries: 10}); p.cache.admission == nil {
+		t.Error("-cache-admission tinylfu didn't set up a sketch")
+	}
+	if p := newTestProxy(t, Config{CacheAdmission: "all"}); p.cache.admission != nil {
+		t.Error("-cache-admission all set up a sketch")
+	}
+	if _, err := NewProxy(Config{CacheAdmission: "lfu"}); err == nil {
+		t.Error("NewProxy accepted an unknown admission policy")
+	}
+}
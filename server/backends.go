@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendRetryAfter is how long a backend that failed a request is skipped
+// before it is tried again.
+const backendRetryAfter = 10 * time.Second
+
+type backend struct {
+	url    *url.URL
+	weight int
+
+	// Guarded by backendPool.mu.
+	current   int
+	downUntil time.Time
+	// unhealthy is set by the active health checker after
+	// -health-check-failures failed probes in a row, and cleared after
+	// -health-check-successes; passes and fails count those runs.
+	unhealthy bool
+	passes    int
+	fails     int
+}
+
+// backendPool spreads origin-form requests across backends using smooth
+// weighted round-robin, or the hash ring with -sticky-sessions, skipping
+// backends that are marked down.
+type backendPool struct {
+	mu       sync.Mutex
+	backends []*backend
+	ring     []ringPoint
+}
+
+// parseBackends parses a comma-separated list of backend URLs, each with an
+// optional =weight suffix, such as "http://a=3,http://b=1".
+func parseBackends(s string) ([]*backend, error) {
+	var backends []*backend
+	for _, item := range splitList(s) {
+		weight := 1
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			w, err := strconv.Atoi(item[i+1:])
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight in backend %q", item)
+			}
+			item, weight = item[:i], w
+		}
+		u, err := url.Parse(item)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid backend URL %q", item)
+		}
+		backends = append(backends, &backend{url: u, weight: weight})
+	}
+	return backends, nil
+}
+
+// next returns the backend for the next request, or nil if every backend is
+// down.
+func (p *backendPool) next() *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var best *backend
+	total := 0
+	for _, b := range p.backends {
+		if b.unhealthy || now.Before(b.downUntil) {
+			continue
+		}
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// lookup returns the backend whose host or URL is name, or nil if none is.
+// It serves X-Upstream pinning, so a backend marked down is still returned.
+func (p *backendPool) lookup(name string) *backend {
+	for _, b := range p.backends {
+		if strings.EqualFold(b.url.Host, name) || strings.EqualFold(b.url.String(), name) {
+			return b
+		}
+	}
+	return nil
+}
+
+// markDown takes b out of rotation for backendRetryAfter.
+func (p *backendPool) markDown(b *backend) {
+	p.mu.Lock()
+	b.downUntil = time.Now().Add(backendRetryAfter)
+	p.mu.Unlock()
+}
+
+// recordProbe counts a health check result for b and reports whether that
+// flipped it between healthy and unhealthy.
+func (p *backendPool) recordProbe(b *backend, ok bool, failures, successes int) (changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		b.passes++
+		b.fails = 0
+		if b.unhealthy && b.passes >= successes {
+			b.unhealthy = false
+			return true
+		}
+		return false
+	}
+	b.fails++
+	b.passes = 0
+	if !b.unhealthy && b.fails >= failures {
+		b.unhealthy = true
+		return true
+	}
+	return false
+}
+
+type backendStatus struct {
+	URL     string `json:"url"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	// Down is set while the backend is skipped after failing a request.
+	Down bool `json:"down"`
+}
+
+// status reports each backend's state for /stats.
+func (p *backendPool) status() []backendStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	statuses := make([]backendStatus, 0, len(p.backends))
+	for _, b := range p.backends {
+		statuses = append(statuses, backendStatus{
+			URL:     b.url.String(),
+			Weight:  b.weight,
+			Healthy: !b.unhealthy,
+			Down:    now.Before(b.downUntil),
+		})
+	}
+	return statuses
+}
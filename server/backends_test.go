@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newNamedBackends starts one upstream per name, each answering with its
+// name, and returns their URLs with the given weights for parseBackends.
+func newNamedBackends(t *testing.T, weights map[string]int) string {
+	t.Helper()
+	list := ""
+	for name, weight := range weights {
+		name := name
+		u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+			res.Write([]byte(name))
+		})
+		if list != "" {
+			list += ","
+		}
+		list += fmt.Sprintf("%s=%d", u, weight)
+	}
+	return list
+}
+
+// originGet returns an origin-form GET, as a client of a reverse proxy
+// sends, that always goes upstream.
+func originGet(path string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = "app.example.com"
+	req.Header.Set("Cache-Control", "no-cache")
+	return req
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	backends, err := parseBackends(newNamedBackends(t, map[string]int{"a": 3, "b": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{Backends: backends})
+
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		rec := serve(p, originGet("/"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, rec.Code)
+		}
+		counts[rec.Body.String()]++
+	}
+	if counts["a"] != 300 || counts["b"] != 100 {
+		t.Errorf("requests per backend %v, want a:300 b:100", counts)
+	}
+}
+
+func TestParseBackendsRejectsBadEntries(t *testing.T) {
+	for _, s := range []string{"ftp://a", "http://a=0", "http://a=x", "not a url"} {
+		if _, err := parseBackends(s); err == nil {
+			t.Errorf("parseBackends(%q) succeeded", s)
+		}
+	}
+}
+
+func TestXUpstreamPinsBackend(t *testing.T) {
+	var hosts []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+			res.Write([]byte(name + " " + req.Header.Get("X-Upstream")))
+		})
+		hosts = append(hosts, u.Host)
+	}
+	backends, err := parseBackends("http://" + hosts[0] + ",http://" + hosts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{Backends: backends, XUpstreamHeader: true})
+
+	for i := 0; i < 4; i++ {
+		req := originGet("/page")
+		req.Header.Set("X-Upstream", hosts[1])
+		rec := serve(p, req)
+		if got := rec.Body.String(); got != "b " {
+			t.Fatalf("pinned request %d: answered %q, want backend b with X-Upstream stripped", i, got)
+		}
+	}
+	if n := p.cache.len(); n != 0 {
+		t.Errorf("pinned responses cached: %d entries", n)
+	}
+
+	// An unknown backend is ignored, falling back to normal selection.
+	req := originGet("/page")
+	req.Header.Set("X-Upstream", "10.0.0.9:80")
+	if rec := serve(p, req); rec.Code != http.StatusOK {
+		t.Errorf("unknown X-Upstream: status %d, want 200", rec.Code)
+	}
+
+	strict := newTestProxy(t, Config{Backends: backends, XUpstreamHeader: true, XUpstreamStrict: true})
+	req = originGet("/page")
+	req.Header.Set("X-Upstream", "10.0.0.9:80")
+	if rec := serve(strict, req); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown X-Upstream in strict mode: status %d, want 400", rec.Code)
+	}
+
+	// Without -x-upstream the header is just forwarded.
+	off := newTestProxy(t, Config{Backends: backends})
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		req := originGet("/page")
+		req.Header.Set("X-Upstream", hosts[1])
+		seen[strings.Fields(serve(off, req).Body.String())[0]] = true
+	}
+	if !seen["a"] {
+		t.Error("X-Upstream pinned a backend with the feature off")
+	}
+}
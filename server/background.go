@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// backgroundLoop is the Start and Stop plumbing shared by the proxy's
+// periodic jobs, such as the cache sweeper and the health checker. Each job
+// embeds one, for its Stop method, and starts it with the work it repeats.
+type backgroundLoop struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start runs run in a goroutine, with a context that ends when ctx is
+// cancelled or Stop is called.
+func (l *backgroundLoop) start(ctx context.Context, run func(ctx context.Context)) {
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		run(ctx)
+	}()
+}
+
+// Stop ends the loop and waits for it to exit. It does nothing if the loop
+// was never started.
+func (l *backgroundLoop) Stop() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+}
+
+// runEvery calls fn once per interval, with the first call one interval
+// from now, until ctx ends.
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
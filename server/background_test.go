@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackgroundLoopRunsUntilStopped(t *testing.T) {
+	var l backgroundLoop
+	l.Stop() // never started
+
+	var calls atomic.Int32
+	l.start(context.Background(), func(ctx context.Context) {
+		runEvery(ctx, time.Millisecond, func() { calls.Add(1) })
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for calls.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	l.Stop()
+	stopped := calls.Load()
+	if stopped < 3 {
+		t.Fatalf("fn ran %d times, want at least 3", stopped)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := calls.Load(); n != stopped {
+		t.Errorf("fn ran %d more times after Stop", n-stopped)
+	}
+}
+
+func TestBackgroundLoopEndsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var l backgroundLoop
+	l.start(ctx, func(ctx context.Context) {
+		runEvery(ctx, time.Hour, func() {})
+	})
+	cancel()
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop still running after its context ended")
+	}
+}
+
+func TestCacheSweeperDropsExpiredEntries(t *testing.T) {
+	upstream := &countingHandler{body: "hello", header: http.Header{"Cache-Control": {"max-age=1"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{})
+	get(p, target)
+	if n := p.cache.len(); n != 1 {
+		t.Fatalf("cache holds %d entries, want 1", n)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	newCacheSweeper(p, time.Hour).sweep()
+	if n := p.cache.len(); n != 0 {
+		t.Errorf("cache holds %d entries after sweeping, want 0", n)
+	}
+}
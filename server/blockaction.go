@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+)
+
+func validBlockAction(action string) bool {
+	return action == "" || action == "deny" || action == "redirect" || action == "blackhole"
+}
+
+// writeBlocked answers a request for a host blocked by -block-categories or
+// -schedule-rules as -block-action says: 403, a redirect to
+// -block-redirect-url, or an empty 204.
+func (p *Proxy) writeBlocked(res http.ResponseWriter, req *http.Request) {
+	switch p.cfg.BlockAction {
+	case "redirect":
+		res.Header().Set("Cache-Control", "no-store")
+		http.Redirect(res, req, p.cfg.BlockRedirectURL, http.StatusFound)
+	case "blackhole":
+		res.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(res, "Forbidden", http.StatusForbidden)
+	}
+}
+
+// writeTunnelBlocked answers a CONNECT to a blocked host. Clients don't
+// follow redirects for CONNECT and take any 2xx as an open tunnel, so
+// "redirect" is answered with 403 and "blackhole" closes the connection
+// without a response.
+func (p *Proxy) writeTunnelBlocked(res http.ResponseWriter) {
+	if p.cfg.BlockAction == "blackhole" {
+		if hijacker, ok := res.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+	http.Error(res, "Forbidden", http.StatusForbidden)
+}
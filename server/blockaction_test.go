@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockedProxy blocks localhost by category and 127.0.0.1 by schedule,
+// answering both with action.
+func blockedProxy(t *testing.T, action string) *Proxy {
+	t.Helper()
+	rules, err := parseScheduleRules("block:127.0.0.1=00:00-00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestProxy(t, Config{
+		CategoryLists:    writeCategoryLists(t, map[string]string{"ads": "localhost\n"}),
+		BlockCategories:  []string{"ads"},
+		ScheduleRules:    rules,
+		BlockAction:      action,
+		BlockRedirectURL: "https://blocked.example/info",
+	})
+}
+
+func TestBlockActions(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	u := newTestUpstream(t, upstream.ServeHTTP)
+	_, port, _ := net.SplitHostPort(u.Host)
+	targets := map[string]string{
+		"category": "http://localhost:" + port + "/",
+		"schedule": "http://127.0.0.1:" + port + "/",
+	}
+
+	for _, action := range []string{"", "deny", "redirect", "blackhole"} {
+		p := blockedProxy(t, action)
+		for block, target := range targets {
+			rec := get(p, target)
+			switch action {
+			case "", "deny":
+				if rec.Code != http.StatusForbidden {
+					t.Errorf("%q, %s block: status %d, want 403", action, block, rec.Code)
+				}
+			case "redirect":
+				if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://blocked.example/info" {
+					t.Errorf("redirect, %s block: status %d, Location %q", block, rec.Code, rec.Header().Get("Location"))
+				}
+				if rec.Header().Get("Cache-Control") != "no-store" {
+					t.Errorf("redirect, %s block: Cache-Control %q, want no-store", block, rec.Header().Get("Cache-Control"))
+				}
+			case "blackhole":
+				if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+					t.Errorf("blackhole, %s block: status %d with %d bytes, want an empty 204", block, rec.Code, rec.Body.Len())
+				}
+			}
+		}
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("upstream got %d requests, want 0", n)
+	}
+	if _, err := NewProxy(Config{BlockAction: "redirect"}); err == nil {
+		t.Error("NewProxy accepted redirect without a URL")
+	}
+	if _, err := NewProxy(Config{BlockAction: "drop"}); err == nil {
+		t.Error("NewProxy accepted an unknown block action")
+	}
+}
+
+func TestBlockActionsForTunnels(t *testing.T) {
+	for _, action := range []string{"deny", "redirect"} {
+		req := connectRequest("localhost:443")
+		if rec := serve(blockedProxy(t, action), req); rec.Code != http.StatusForbidden {
+			t.Errorf("%s, CONNECT: status %d, want 403", action, rec.Code)
+		}
+	}
+
+	// A blackholed CONNECT gets no response at all.
+	srv := httptest.NewServer(blockedProxy(t, "blackhole"))
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT localhost:443 HTTP/1.1\r\nHost: localhost:443\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadByte(); err != io.EOF {
+		t.Errorf("blackhole, CONNECT: read %v, want the connection closed", err)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"hash/maphash"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type cacheEntry struct {
+	key string
+	// identity is what key was hashed from; see Proxy.cacheIdentity.
+	identity string
+	status   int
+	header   http.Header
+	body     []byte
+	// bodyHash is the SHA-256 of body, set by lruCache when the entry is
+	// added so the body can be shared with other entries holding the same
+	// bytes.
+	bodyHash [sha256.Size]byte
+	// bodyPath, when set, is the file under -cache-disk-dir holding the
+	// body, which is then diskSize bytes long and body is nil.
+	bodyPath string
+	diskSize int64
+	// stored is when the response had an age of zero: when it was cached,
+	// less any Age the upstream already reported.
+	stored  time.Time
+	expires time.Time // zero means the entry never expires
+	// staleUntil is when the entry stops being served stale while it is
+	// revalidated; equal to expires when there is no stale window.
+	staleUntil time.Time
+	// revalidating is set while a background refresh is in flight.
+	revalidating atomic.Bool
+	// lastUsed is the cache's clock when the entry was last added or
+	// looked up; its shard's lock guards it.
+	lastUsed uint64
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// age returns how old the cached response is at now, as sent in Age.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	if age := now.Sub(e.stored); age > 0 {
+		return age
+	}
+	return 0
+}
+
+// hitHeader returns the header to send with a cache hit: the stored header
+// plus an Age computed at now.
+func (e *cacheEntry) hitHeader(now time.Time) http.Header {
+	header := e.header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	return header
+}
+
+// unusable reports whether the entry is past both its freshness lifetime
+// and any stale window.
+func (e *cacheEntry) unusable(now time.Time) bool {
+	return !e.staleUntil.IsZero() && now.After(e.staleUntil)
+}
+
+// size approximates the memory held by the entry: its body plus header names
+// and values.
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.body)) + e.headerSize()
+}
+
+// bodySize returns the length of the body, wherever it is stored.
+func (e *cacheEntry) bodySize() int64 {
+	if e.bodyPath != "" {
+		return e.diskSize
+	}
+	return int64(len(e.body))
+}
+
+func (e *cacheEntry) headerSize() int64 {
+	var n int64
+	for name, values := range e.header {
+		for _, value := range values {
+			n += int64(len(name) + len(value))
+		}
+	}
+	return n
+}
+
+// sharedBody is a response body stored once for every entry whose body has
+// the same hash, either in memory or, when path is set, on disk.
+type sharedBody struct {
+	data []byte
+	path string
+	refs int
+}
+
+// cacheShards is how many independently locked stripes the cache is split
+// into, so requests for different keys rarely wait on each other.
+const cacheShards = 16
+
+// lruCache is a least-recently-used cache bounded by total entry size and by
+// entry count. A zero limit disables that bound. Entries are spread over
+// shards by key, each with its own lock and recency list; the limits apply to
+// the totals, and once they are exceeded the least recently used entry of
+// the whole cache is evicted: every use stamps an entry from one shared
+// clock, and eviction takes the shard tail with the oldest stamp. Bodies are stored by content hash, so URLs
+// serving identical bytes share one copy, counted once toward maxBytes and
+// freed when the last entry using it goes. Bodies kept on disk don't count
+// toward maxBytes, only their headers do. It is safe for concurrent use.
+type lruCache struct {
+	maxBytes   int64
+	maxEntries int
+
+	seed   maphash.Seed
+	shards [cacheShards]cacheShard
+	bodies bodyStore
+
+	count       atomic.Int64
+	headerBytes atomic.Int64
+	// clock orders uses across shards for lastUsed.
+	clock atomic.Uint64
+	// admission, when set, counts lookups so a new entry that would force
+	// an eviction is only stored if its key has been looked up more often
+	// than the entry it would evict (TinyLFU).
+	admission *frequencySketch
+}
+
+type cacheShard struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// bodyStore holds the bodies shared by entries across all shards. Its lock
+// is only ever taken while holding a shard's.
+type bodyStore struct {
+	mu     sync.Mutex
+	bodies map[[sha256.Size]byte]*sharedBody
+	bytes  atomic.Int64
+}
+
+func newLRUCache(maxBytes int64, maxEntries int) *lruCache {
+	c := &lruCache{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		seed:       maphash.MakeSeed(),
+	}
+	for i := range c.shards {
+		c.shards[i].ll = list.New()
+		c.shards[i].items = make(map[string]*list.Element)
+	}
+	c.bodies.bodies = make(map[[sha256.Size]byte]*sharedBody)
+	return c
+}
+
+func (c *lruCache) shard(key string) *cacheShard {
+	return &c.shards[maphash.String(c.seed, key)%cacheShards]
+}
+
+// get returns the entry for key, which may be stale, dropping it instead if
+// it is past its stale window.
+func (c *lruCache) get(key string) (*cacheEntry, bool) {
+	if c.admission != nil {
+		c.admission.increment(key)
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.unusable(time.Now()) {
+		c.removeElement(s, el)
+		return nil, false
+	}
+	s.ll.MoveToFront(el)
+	e.lastUsed = c.clock.Add(1)
+	return e, true
+}
+
+// add stores e, replacing any entry with the same key, then evicts until both
+// limits hold. An entry larger than maxBytes on its own is not stored, nor
+// one refused by admission.
+func (c *lruCache) add(e *cacheEntry) {
+	if c.maxBytes > 0 && e.size() > c.maxBytes {
+		c.remove(e.key)
+		return
+	}
+	s := c.shard(e.key)
+	s.mu.Lock()
+	_, replacing := s.items[e.key]
+	s.mu.Unlock()
+	if !replacing && !c.admit(e) {
+		if e.bodyPath != "" {
+			os.Remove(e.bodyPath)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	c.retain(e)
+	e.lastUsed = c.clock.Add(1)
+	if el, ok := s.items[e.key]; ok {
+		c.release(el.Value.(*cacheEntry))
+		el.Value = e
+		s.ll.MoveToFront(el)
+	} else {
+		s.items[e.key] = s.ll.PushFront(e)
+		c.count.Add(1)
+	}
+	s.mu.Unlock()
+
+	c.evict()
+}
+
+// admit reports whether a new entry e may be stored. Without admission, or
+// with room to spare, it always may; otherwise its key must have been
+// looked up more often than the entry eviction would take next. Only the
+// victim's shard is locked, so the victim may change before e is stored.
+func (c *lruCache) admit(e *cacheEntry) bool {
+	if c.admission == nil {
+		return true
+	}
+	n := c.count.Load() + 1
+	if (c.maxEntries == 0 || n <= int64(c.maxEntries)) &&
+		(c.maxBytes == 0 || c.size()+e.size() <= c.maxBytes) {
+		return true
+	}
+	victim, _, _ := c.oldest()
+	return victim == nil || c.admission.estimate(e.key) > c.admission.estimate(victim.key)
+}
+
+// oldest returns the least recently used entry, its shard and its lastUsed
+// stamp, or a nil entry if the cache is empty. Only one shard is locked at a
+// time, so by the time it returns the entry may have been used or removed.
+func (c *lruCache) oldest() (*cacheEntry, *cacheShard, uint64) {
+	var victim *cacheEntry
+	var victimShard *cacheShard
+	var stamp uint64
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		if el := s.ll.Back(); el != nil {
+			if e := el.Value.(*cacheEntry); victim == nil || e.lastUsed < stamp {
+				victim, victimShard, stamp = e, s, e.lastUsed
+			}
+		}
+		s.mu.Unlock()
+	}
+	return victim, victimShard, stamp
+}
+
+// evict removes entries until both limits hold.
+func (c *lruCache) evict() {
+	c.evictWhile(c.overLimit)
+}
+
+// shrink evicts entries until the cache holds at most size bytes and
+// returns how many it removed.
+func (c *lruCache) shrink(size int64) int {
+	return c.evictWhile(func() bool { return c.count.Load() > 0 && c.size() > size })
+}
+
+// evictWhile removes the least recently used entry while more is true, and
+// returns how many it removed. Only one shard is locked at a time; a victim
+// used or removed before its shard is locked again is passed over and the
+// oldest entry looked for afresh.
+func (c *lruCache) evictWhile(more func() bool) int {
+	removed := 0
+	for more() {
+		victim, s, stamp := c.oldest()
+		if victim == nil {
+			break
+		}
+		s.mu.Lock()
+		if el := s.ll.Back(); el != nil && el.Value == victim && victim.lastUsed == stamp {
+			c.removeElement(s, el)
+			removed++
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+func (c *lruCache) remove(key string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		c.removeElement(s, el)
+	}
+}
+
+// removeElement drops el from s, whose lock the caller holds.
+func (c *lruCache) removeElement(s *cacheShard, el *list.Element) {
+	e := s.ll.Remove(el).(*cacheEntry)
+	delete(s.items, e.key)
+	c.count.Add(-1)
+	c.release(e)
+}
+
+// retain points e's body at the shared copy of the same bytes, storing it
+// if this is the first entry to hold them, and counts e toward the cache's
+// size. A disk-backed entry arrives with its hash set; if the body is
+// already stored its own file is a duplicate and is removed.
+func (c *lruCache) retain(e *cacheEntry) {
+	if e.bodyPath == "" {
+		e.bodyHash = sha256.Sum256(e.body)
+	}
+	store := &c.bodies
+	store.mu.Lock()
+	if b, ok := store.bodies[e.bodyHash]; ok {
+		b.refs++
+		if e.bodyPath != "" && e.bodyPath != b.path {
+			os.Remove(e.bodyPath)
+		}
+		e.body, e.bodyPath = b.data, b.path
+	} else {
+		store.bodies[e.bodyHash] = &sharedBody{data: e.body, path: e.bodyPath, refs: 1}
+		store.bytes.Add(int64(len(e.body)))
+	}
+	store.mu.Unlock()
+	c.headerBytes.Add(e.headerSize())
+}
+
+// release undoes retain, freeing the shared body, and deleting its file,
+// once no entry uses it. A reader that already opened the file keeps
+// reading it.
+func (c *lruCache) release(e *cacheEntry) {
+	c.headerBytes.Add(-e.headerSize())
+	store := &c.bodies
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	b := store.bodies[e.bodyHash]
+	if b.refs--; b.refs == 0 {
+		delete(store.bodies, e.bodyHash)
+		store.bytes.Add(-int64(len(b.data)))
+		if b.path != "" {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// unusableKeys returns the keys of entries past their stale window at now.
+func (c *lruCache) unusableKeys(now time.Time) []string {
+	var keys []string
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for key, el := range s.items {
+			if el.Value.(*cacheEntry).unusable(now) {
+				keys = append(keys, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return keys
+}
+
+// removeUnusable drops the entry for key if it is still past its stale
+// window at now, and reports whether it did. The entry may have been
+// refreshed since its key was collected.
+func (c *lruCache) removeUnusable(key string, now time.Time) bool {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok || !el.Value.(*cacheEntry).unusable(now) {
+		return false
+	}
+	c.removeElement(s, el)
+	return true
+}
+
+// entries returns every entry from least to most recently used, so adding
+// them back in order restores the same recency.
+func (c *lruCache) entries() []*cacheEntry {
+	type used struct {
+		entry *cacheEntry
+		stamp uint64
+	}
+	var all []used
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for el := s.ll.Back(); el != nil; el = el.Prev() {
+			e := el.Value.(*cacheEntry)
+			all = append(all, used{e, e.lastUsed})
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].stamp < all[j].stamp })
+	entries := make([]*cacheEntry, len(all))
+	for i, u := range all {
+		entries[i] = u.entry
+	}
+	return entries
+}
+
+func (c *lruCache) overLimit() bool {
+	n := c.count.Load()
+	if n == 0 {
+		return false
+	}
+	return (c.maxEntries > 0 && n > int64(c.maxEntries)) ||
+		(c.maxBytes > 0 && c.size() > c.maxBytes)
+}
+
+func (c *lruCache) len() int {
+	return int(c.count.Load())
+}
+
+// bodyCount returns the number of distinct bodies stored.
+func (c *lruCache) bodyCount() int {
+	c.bodies.mu.Lock()
+	defer c.bodies.mu.Unlock()
+	return len(c.bodies.bodies)
+}
+
+func (c *lruCache) size() int64 {
+	return c.headerBytes.Load() + c.bodies.bytes.Load()
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testEntry(key, body string) *cacheEntry {
+	return &cacheEntry{key: key, identity: key, status: http.StatusOK, header: http.Header{}, body: []byte(body)}
+}
+
+func TestCacheEntryLimit(t *testing.T) {
+	c := newLRUCache(1<<30, 3)
+	for i := 0; i < 10; i++ {
+		c.add(testEntry(fmt.Sprintf("k%d", i), fmt.Sprintf("body %d", i)))
+		if n := c.len(); n > 3 {
+			t.Fatalf("after %d adds: %d entries, want at most 3", i+1, n)
+		}
+	}
+	if n := c.len(); n != 3 {
+		t.Errorf("%d entries, want 3", n)
+	}
+}
+
+func TestCacheByteLimit(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	entrySize := testEntry("k0", body).size()
+	c := newLRUCache(3*entrySize+entrySize/2, 0)
+	for i := 0; i < 10; i++ {
+		// Distinct bodies, so none are shared.
+		c.add(testEntry(fmt.Sprintf("k%d", i), fmt.Sprintf("%s%d", body[1:], i)))
+		if c.size() > c.maxBytes {
+			t.Fatalf("after %d adds: %d bytes, over the %d limit", i+1, c.size(), c.maxBytes)
+		}
+	}
+	if n := c.len(); n != 3 {
+		t.Errorf("%d entries, want 3", n)
+	}
+
+	// An entry larger than the whole cache is never stored.
+	c.add(testEntry("huge", strings.Repeat("y", int(c.maxBytes)+1)))
+	if _, ok := c.get("huge"); ok {
+		t.Error("entry over -cache-max-bytes was stored")
+	}
+}
+
+// TestCacheEvictsLeastRecentlyUsed checks eviction follows recency across
+// shards: a just-added entry and one looked up on every add are never the
+// ones evicted, and what's left is the most recently used.
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache(1<<30, 3)
+	c.add(testEntry("hot", "hot"))
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k%d", i)
+		c.add(testEntry(key, key))
+		if _, ok := c.get(key); !ok {
+			t.Fatalf("add %d: %s evicted as soon as it was added", i, key)
+		}
+		if _, ok := c.get("hot"); !ok {
+			t.Fatalf("add %d: entry looked up on every add was evicted", i)
+		}
+	}
+
+	var keys []string
+	for _, e := range c.entries() {
+		keys = append(keys, e.key)
+	}
+	if got, want := strings.Join(keys, ","), "k198,k199,hot"; got != want {
+		t.Errorf("entries from least to most recent %s, want %s", got, want)
+	}
+
+	// shrink also takes the least recently used first.
+	c.get("k198")
+	c.shrink(c.size() - 1)
+	if _, ok := c.get("k199"); ok {
+		t.Error("shrink kept k199, the least recently used entry")
+	}
+	if c.len() != 2 {
+		t.Errorf("shrink left %d entries, want 2", c.len())
+	}
+}
+
+// TestCacheLimitsAreIndependent checks either limit alone triggers
+// eviction while the other has room.
+func TestCacheLimitsAreIndependent(t *testing.T) {
+	byCount := newLRUCache(1<<30, 2)
+	byBytes := newLRUCache(2*testEntry("k0", "ab").size(), 1000)
+	for i := 0; i < 5; i++ {
+		byCount.add(testEntry(fmt.Sprintf("k%d", i), fmt.Sprintf("a%d", i)))
+		byBytes.add(testEntry(fmt.Sprintf("k%d", i), fmt.Sprintf("a%d", i)))
+	}
+	if n := byCount.len(); n != 2 {
+		t.Errorf("entry limit 2 with bytes to spare: %d entries", n)
+	}
+	if n := byBytes.len(); n != 2 {
+		t.Errorf("byte limit for 2 with entries to spare: %d entries", n)
+	}
+}
+
+func TestAgeHeaderOnHits(t *testing.T) {
+	upstream := &countingHandler{body: "hello", header: http.Header{"Cache-Control": {"max-age=60"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{XCacheHeader: true})
+
+	if got := get(p, target).Header().Get("Age"); got != "" {
+		t.Errorf("miss: Age %q, want none", got)
+	}
+	// Pretend the entry was cached 7 seconds ago.
+	for _, e := range p.cache.entries() {
+		e.stored = e.stored.Add(-7 * time.Second)
+	}
+	if got := get(p, target).Header().Get("Age"); got != "7" {
+		t.Errorf("hit: Age %q, want 7", got)
+	}
+}
+
+func TestUpstreamAgeCountsAgainstFreshness(t *testing.T) {
+	upstream := &countingHandler{body: "hello", header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"50"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{XCacheHeader: true})
+
+	get(p, target)
+	rec := get(p, target)
+	if got := rec.Header().Get("Age"); got != "50" {
+		t.Errorf("hit: Age %q, want the upstream's 50", got)
+	}
+	// Ten more seconds use up the rest of max-age.
+	for _, e := range p.cache.entries() {
+		if left := time.Until(e.expires); left > 11*time.Second || left < 9*time.Second {
+			t.Errorf("entry expires in %v, want about 10s", left)
+		}
+	}
+
+	stale := &countingHandler{body: "hello", header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"60"}}}
+	target = newTestUpstream(t, stale.ServeHTTP).String() + "/page"
+	get(p, target)
+	if got := get(p, target).Header().Get("X-Cache"); got == "HIT" {
+		t.Error("a response already as old as its max-age was served from the cache")
+	}
+}
+
+func TestCacheKeyCollisionIsAMiss(t *testing.T) {
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("body of " + req.URL.Path))
+	}).String()
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{XCacheHeader: true, LogFile: logs})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	get(p, target+"/a")
+	get(p, target+"/b")
+	var a, b *cacheEntry
+	for _, e := range p.cache.entries() {
+		switch string(e.body) {
+		case "body of /a":
+			a = e
+		case "body of /b":
+			b = e
+		}
+	}
+	if a == nil || b == nil {
+		t.Fatalf("cache holds %d entries, want /a and /b", p.cache.len())
+	}
+
+	// Force a collision: /b's key now holds /a's entry.
+	forged := testEntry(b.key, "body of /a")
+	forged.identity = a.identity
+	p.cache.add(forged)
+
+	rec := get(p, target+"/b")
+	if rec.Body.String() != "body of /b" || rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("colliding lookup: X-Cache %q, body %q, want a MISS with /b's body", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if n := m.counter("proxy_cache_collisions_total"); n != 1 {
+		t.Errorf("proxy_cache_collisions_total = %d, want 1", n)
+	}
+	if len(logs.lines("Cache key collision for "+target+"/b")) != 1 {
+		t.Errorf("collision wasn't logged:\n%s", logs)
+	}
+	// The fetched response replaces the forged entry.
+	if rec := get(p, target+"/b"); rec.Body.String() != "body of /b" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("next lookup: X-Cache %q, body %q, want a HIT with /b's body", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestCacheSharesIdenticalBodies(t *testing.T) {
+	body := strings.Repeat("mirror ", 100)
+	c := newLRUCache(1<<30, 0)
+	c.add(testEntry("http://a.example/file", body))
+	c.add(testEntry("http://b.example/file", body))
+	c.add(testEntry("http://c.example/other", "different"))
+
+	if n := c.bodyCount(); n != 2 {
+		t.Errorf("%d bodies stored for 3 entries with 2 distinct bodies, want 2", n)
+	}
+	a, _ := c.get("http://a.example/file")
+	b, _ := c.get("http://b.example/file")
+	if &a.body[0] != &b.body[0] {
+		t.Error("entries with identical bodies hold separate copies")
+	}
+	single := testEntry("x", body).size() - testEntry("x", "").size()
+	if got := c.size(); got > 2*single {
+		t.Errorf("cache size %d counts the shared body twice (body is %d bytes)", got, single)
+	}
+
+	// The shared body stays until its last entry goes.
+	c.remove("http://a.example/file")
+	if n := c.bodyCount(); n != 2 {
+		t.Errorf("after removing one sharer: %d bodies, want 2", n)
+	}
+	if b, ok := c.get("http://b.example/file"); !ok || string(b.body) != body {
+		t.Error("removing one sharer lost the other's body")
+	}
+	c.remove("http://b.example/file")
+	if n := c.bodyCount(); n != 1 {
+		t.Errorf("after removing both sharers: %d bodies, want 1", n)
+	}
+}
+
+func TestProxySharesIdenticalBodies(t *testing.T) {
+	upstream := &countingHandler{body: strings.Repeat("same ", 100)}
+	target := newTestUpstream(t, upstream.ServeHTTP).String()
+	p := newTestProxy(t, Config{CacheTTL: time.Minute})
+
+	get(p, target+"/mirror1/file")
+	get(p, target+"/mirror2/file")
+	if n, bodies := p.cache.len(), p.cache.bodyCount(); n != 2 || bodies != 1 {
+		t.Errorf("%d entries with %d bodies, want 2 entries sharing 1", n, bodies)
+	}
+}
+
+func TestCacheConcurrentUseKeepsTotals(t *testing.T) {
+	c := newLRUCache(1<<30, 200)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("k%d", (g*500+i)%700)
+				if _, ok := c.get(key); !ok {
+					c.add(testEntry(key, "body "+key))
+				}
+				if i%7 == 0 {
+					c.remove(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := c.len(); n > 200 {
+		t.Errorf("%d entries, want at most 200", n)
+	}
+	var entries, bytes int64
+	for _, e := range c.entries() {
+		entries++
+		bytes += e.size()
+	}
+	if int64(c.len()) != entries || c.size() != bytes {
+		t.Errorf("totals say %d entries, %d bytes; the shards hold %d, %d", c.len(), c.size(), entries, bytes)
+	}
+}
+
+// mutexLRU is a single-lock LRU of the kind lruCache's shards replaced, kept
+// as a baseline for the benchmarks.
+type mutexLRU struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	max   int
+}
+
+func (c *mutexLRU) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+func (c *mutexLRU) add(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[e.key] = c.ll.PushFront(e)
+	if c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// benchmarkEntries are the entries the parallel cache benchmarks read and
+// write, one in ten lookups being a write.
+var benchmarkEntries = func() []*cacheEntry {
+	entries := make([]*cacheEntry, 4096)
+	for i := range entries {
+		key := fmt.Sprintf("http://example.com/asset/%d", i)
+		entries[i] = testEntry(key, key)
+	}
+	return entries
+}()
+
+func BenchmarkCacheParallel(b *testing.B) {
+	c := newLRUCache(0, 2048)
+	for _, e := range benchmarkEntries[:2048] {
+		c.add(e)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			e := benchmarkEntries[i%len(benchmarkEntries)]
+			if i%10 == 0 {
+				c.add(testEntry(e.key, e.key))
+			} else {
+				c.get(e.key)
+			}
+		}
+	})
+}
+
+func BenchmarkMutexLRUParallel(b *testing.B) {
+	c := &mutexLRU{ll: list.New(), items: make(map[string]*list.Element), max: 2048}
+	for _, e := range benchmarkEntries[:2048] {
+		c.add(e)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			e := benchmarkEntries[i%len(benchmarkEntries)]
+			if i%10 == 0 {
+				c.add(testEntry(e.key, e.key))
+			} else {
+				c.get(e.key)
+			}
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// postCacheable reports whether req is a POST that may be cached: one that
+// opted in by sending -cache-post-header with the value 1, or one to a
+// -cache-graphql-paths endpoint, whose body then decides.
+func (p *Proxy) postCacheable(req *http.Request, u *url.URL) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+	return (p.cfg.CachePOSTHeader != "" && req.Header.Get(p.cfg.CachePOSTHeader) == "1") ||
+		p.graphQLEndpoint(u)
+}
+
+// cachePOSTMaxBody is the largest POST body read into memory to be folded
+// into a cache key; larger POSTs are streamed upstream and not cached.
+const cachePOSTMaxBody = 1 << 20
+
+// bufferBody reads up to limit bytes of req's body so it can be folded into
+// the cache key, and puts it back for forwarding. An empty body is returned
+// as non-nil. A larger body is put back with what was read in front, to be
+// streamed, and false is returned.
+func bufferBody(req *http.Request, limit int64) ([]byte, bool, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, false, err
+	}
+	if int64(len(body)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+// cachePOSTBodyLimit returns how much of a POST body bufferBody may read: at
+// most cachePOSTMaxBody, and no more than the cache could hold at all.
+func (p *Proxy) cachePOSTBodyLimit() int64 {
+	if p.cfg.CacheMaxBytes > 0 {
+		return min(cachePOSTMaxBody, p.cfg.CacheMaxBytes)
+	}
+	return cachePOSTMaxBody
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postCacheOptIn(p *Proxy, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("X-Cache-POST", "1")
+	return serve(p, req)
+}
+
+func TestPOSTCachedByBody(t *testing.T) {
+	upstream := &flakyUpstream{}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/search"
+	p := newTestProxy(t, Config{CachePOSTHeader: "X-Cache-POST", XCacheHeader: true})
+
+	for i, tc := range []struct{ body, want string }{
+		{"q=one", "MISS"},
+		{"q=one", "HIT"},
+		{"q=two", "MISS"},
+	} {
+		rec := postCacheOptIn(p, target, tc.body)
+		if got := rec.Header().Get("X-Cache"); got != tc.want {
+			t.Errorf("POST %d %q: X-Cache %q, want %q", i, tc.body, got, tc.want)
+		}
+		if rec.Body.String() != tc.body {
+			t.Errorf("POST %d %q: body %q", i, tc.body, rec.Body.String())
+		}
+	}
+	if n := len(upstream.received()); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
+
+func TestPOSTOverCacheBodyLimitStreamedUncached(t *testing.T) {
+	upstream := &flakyUpstream{}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/search"
+	p := newTestProxy(t, Config{CachePOSTHeader: "X-Cache-POST", CacheMaxBytes: 1024})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	body := strings.Repeat("x", 2048)
+	for i := 0; i < 2; i++ {
+		rec := postCacheOptIn(p, target, body)
+		if rec.Code != http.StatusOK || rec.Body.Len() != len(body) {
+			t.Fatalf("POST %d: status %d, %d bytes", i, rec.Code, rec.Body.Len())
+		}
+	}
+	got := upstream.received()
+	if len(got) != 2 || got[0] != body || got[1] != body {
+		t.Errorf("upstream got %d requests, want 2 with the whole body each", len(got))
+	}
+	if n := m.counter("proxy_cache_bypass_total{reason=body-size}"); n != 2 {
+		t.Errorf("proxy_cache_bypass_total{reason=body-size} = %d, want 2", n)
+	}
+}
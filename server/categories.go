@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// categoryList is a named host list loaded from a file.
+type categoryList struct {
+	name string
+	path string
+}
+
+// parseCategoryLists parses a comma-separated list of name=path pairs, such
+// as "ads=/etc/proxy/ads.txt,malware=/etc/proxy/malware.txt".
+func parseCategoryLists(s string) ([]categoryList, error) {
+	var lists []categoryList
+	for _, item := range splitList(s) {
+		name, path, ok := strings.Cut(item, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("invalid category list %q, want name=path", item)
+		}
+		lists = append(lists, categoryList{name: name, path: path})
+	}
+	return lists, nil
+}
+
+func (p *Proxy) hasCategory(name string) bool {
+	for _, list := range p.cfg.CategoryLists {
+		if list.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCategories reads every category list and swaps in the new index only
+// if all of them load, so a bad reload keeps the previous lists in force.
+func (p *Proxy) loadCategories() error {
+	index := make(map[string][]string)
+	for _, list := range p.cfg.CategoryLists {
+		if err := readHostList(list, index); err != nil {
+			return err
+		}
+	}
+	p.categoriesMu.Lock()
+	p.hostCategories = index
+	p.categoriesMu.Unlock()
+	return nil
+}
+
+// readHostList adds the hosts in list's file to index. Each line holds one
+// host, optionally preceded by an address as in a hosts file; blank lines
+// and lines starting with # are skipped.
+func readHostList(list categoryList, index map[string][]string) error {
+	f, err := os.Open(list.path)
+	if err != nil {
+		return fmt.Errorf("category %s: %v", list.name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		host := strings.ToLower(strings.TrimSuffix(fields[len(fields)-1], "."))
+		index[host] = append(index[host], list.name)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("category %s: %v", list.name, err)
+	}
+	return nil
+}
+
+// blockedCategory returns the first enforced category listing host or one
+// of its parent domains.
+func (p *Proxy) blockedCategory(host string) (string, bool) {
+	if len(p.blockedCategories) == 0 {
+		return "", false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	p.categoriesMu.RLock()
+	defer p.categoriesMu.RUnlock()
+	for {
+		for _, category := range p.hostCategories[host] {
+			if p.blockedCategories[category] {
+				return category, true
+			}
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return "", false
+		}
+		host = host[i+1:]
+	}
+}
+
+// reloadCategoriesOnSIGHUP reloads the category lists each time the process
+// receives SIGHUP.
+func (p *Proxy) reloadCategoriesOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := p.loadCategories(); err != nil {
+			p.logEvent("Failed to reload category lists, keeping previous lists: %v", err)
+			continue
+		}
+		p.logEvent("Reloaded category lists")
+	}
+}
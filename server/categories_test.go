@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCategoryLists writes each category's hosts to a file in a temporary
+// directory and returns the lists.
+func writeCategoryLists(t *testing.T, hosts map[string]string) []categoryList {
+	t.Helper()
+	dir := t.TempDir()
+	var specs []string
+	for name, content := range hosts {
+		path := filepath.Join(dir, name+".txt")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, name+"="+path)
+	}
+	lists, err := parseCategoryLists(strings.Join(specs, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lists
+}
+
+func TestBlockedCategory(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	u := newTestUpstream(t, upstream.ServeHTTP)
+	_, port, _ := net.SplitHostPort(u.Host)
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{
+		LogFile: logs,
+		CategoryLists: writeCategoryLists(t, map[string]string{
+			"ads":     "# ad servers\nlocalhost\n0.0.0.0 tracker.example.\n",
+			"malware": "127.0.0.1\n",
+		}),
+		BlockCategories: []string{"ads"},
+	})
+
+	if rec := get(p, "http://localhost:"+port+"/"); rec.Code != http.StatusForbidden {
+		t.Errorf("host in a blocked category: status %d, want 403", rec.Code)
+	}
+	if len(logs.lines("host is in category ads")) != 1 {
+		t.Errorf("block not logged with its category:\n%s", logs)
+	}
+	if rec := get(p, u.String()+"/"); rec.Code != http.StatusOK {
+		t.Errorf("host in an allowed category: status %d, want 200", rec.Code)
+	}
+	if n := upstream.requests(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+
+	for host, want := range map[string]bool{
+		"tracker.example":     true,
+		"cdn.tracker.example": true, // parent domains match
+		"TRACKER.example.":    true,
+		"nottracker.example":  false,
+	} {
+		if _, blocked := p.blockedCategory(host); blocked != want {
+			t.Errorf("blockedCategory(%q) = %v, want %v", host, blocked, want)
+		}
+	}
+}
+
+func TestReloadCategories(t *testing.T) {
+	lists := writeCategoryLists(t, map[string]string{"ads": "old.example\n"})
+	p := newTestProxy(t, Config{CategoryLists: lists, BlockCategories: []string{"ads"}})
+
+	os.WriteFile(lists[0].path, []byte("new.example\n"), 0o644)
+	if err := p.loadCategories(); err != nil {
+		t.Fatal(err)
+	}
+	if _, blocked := p.blockedCategory("old.example"); blocked {
+		t.Error("old.example still blocked after reload")
+	}
+	if _, blocked := p.blockedCategory("new.example"); !blocked {
+		t.Error("new.example not blocked after reload")
+	}
+
+	// A list that fails to load keeps the previous lists in force.
+	os.Remove(lists[0].path)
+	if err := p.loadCategories(); err == nil {
+		t.Error("reload of a missing list succeeded")
+	}
+	if _, blocked := p.blockedCategory("new.example"); !blocked {
+		t.Error("failed reload dropped the previous lists")
+	}
+}
+
+func TestUnknownBlockCategory(t *testing.T) {
+	lists := writeCategoryLists(t, map[string]string{"ads": "ads.example\n"})
+	if _, err := NewProxy(Config{CategoryLists: lists, BlockCategories: []string{"malware"}}); err == nil {
+		t.Error("NewProxy accepted a category with no list")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseNetworks parses a comma-separated list of CIDRs or bare IPs, as
+// -trusted-proxies, -admin-allow and -priority-tiers networks are given.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range splitList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (p *Proxy) isTrustedProxy(ip net.IP) bool {
+	for _, n := range p.cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a request should be attributed to. When the
+// peer is a trusted proxy it walks X-Forwarded-For from the right and
+// returns the first untrusted hop, so entries a client prepends itself are
+// ignored.
+func (p *Proxy) clientIP(req *http.Request) string {
+	peer := extractIP(req.RemoteAddr)
+	ip := net.ParseIP(peer)
+	if ip == nil || !p.isTrustedProxy(ip) {
+		return peer
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	addr := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		addr = hop.String()
+		if !p.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPFromForwardedFor(t *testing.T) {
+	trusted, err := parseNetworks("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{TrustedProxies: trusted})
+
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		// An untrusted peer's X-Forwarded-For is ignored, spoofed or not.
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		// A trusted peer's last hop is the client.
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		// Entries the client prepends itself are skipped.
+		{"10.1.2.3:1234", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		// Chained trusted proxies are walked through.
+		{"10.1.2.3:1234", "198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		// A trusted peer sending no header is the client.
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		// A malformed hop ends the walk at the last good address.
+		{"10.1.2.3:1234", "198.51.100.1, garbage", "10.1.2.3"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := p.clientIP(req); got != tc.want {
+			t.Errorf("peer %s, X-Forwarded-For %q: client %s, want %s", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestSpoofedForwardedForDoesNotEvadeRateLimit(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{RateLimit: 1})
+
+	codes := []int{}
+	for _, xff := range []string{"198.51.100.1", "198.51.100.2"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Forwarded-For", xff)
+		codes = append(codes, serve(p, req).Code)
+	}
+	if codes[1] != http.StatusTooManyRequests {
+		t.Errorf("statuses %v: a new X-Forwarded-For from an untrusted peer reset its quota", codes)
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := parseNetworks("10.0.0.0/8,::1,192.0.2.7")
+	if err != nil || len(nets) != 3 {
+		t.Fatalf("parseNetworks: %v, %v", nets, err)
+	}
+	if got := nets[2].String(); got != "192.0.2.7/32" {
+		t.Errorf("bare IPv4 parsed as %s, want 192.0.2.7/32", got)
+	}
+	for _, s := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := parseNetworks(s); err == nil {
+			t.Errorf("parseNetworks(%q) succeeded", s)
+		}
+	}
+}
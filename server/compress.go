@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// supportedEncodings are the content codings the proxy can compress with.
+var supportedEncodings = map[string]bool{"br": true, "zstd": true, "gzip": true}
+
+// parseEncodings parses the -compress-encodings list, most preferred first.
+func parseEncodings(s string) ([]string, error) {
+	var encodings []string
+	for _, item := range splitList(s) {
+		item = strings.ToLower(item)
+		if !supportedEncodings[item] {
+			return nil, fmt.Errorf("unsupported encoding %q, want br, zstd or gzip", item)
+		}
+		encodings = append(encodings, item)
+	}
+	return encodings, nil
+}
+
+// negotiateEncoding picks the coding from offered, ordered by the proxy's
+// preference, with the highest q-value in the client's Accept-Encoding. A
+// "*" element covers codings the client doesn't name. It returns "" when
+// the client accepts none of them.
+func negotiateEncoding(req *http.Request, offered []string) string {
+	accepted := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "*" {
+			wildcard = qValue(params)
+		} else if coding != "" {
+			accepted[coding] = qValue(params)
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range offered {
+		q, ok := accepted[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// qValue returns the q parameter from an Accept-Encoding element's
+// parameters, defaulting to 1 when absent or malformed.
+func qValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			return q
+		}
+	}
+	return 1
+}
+
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json"
+}
+
+// responseEncoding returns the coding a response with the given header and
+// body should be compressed with on its way to the client, or "" to send it
+// as is.
+func (p *Proxy) responseEncoding(req *http.Request, header http.Header, body []byte) string {
+	if !p.cfg.Compress || len(body) < p.cfg.CompressMinSize || req.Method == http.MethodHead || header.Get("Content-Range") != "" {
+		return ""
+	}
+	if noTransform(header) {
+		return ""
+	}
+	if ce := header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return ""
+	}
+	if !compressibleType(header.Get("Content-Type")) {
+		return ""
+	}
+	return negotiateEncoding(req, p.cfg.CompressEncodings)
+}
+
+// compressBody encodes body with the named content coding.
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		w = gzip.NewWriter(&buf)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// getEncoded sends a proxied GET accepting the given codings.
+func getEncoded(p *Proxy, target, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	return serve(p, req)
+}
+
+func TestCompressesCompressibleResponses(t *testing.T) {
+	text := strings.Repeat("compress me ", 200)
+	upstream := &countingHandler{body: text, header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{Compress: true, CompressMinSize: 1024, CompressEncodings: []string{"gzip"}})
+
+	rec := getEncoded(p, target, "gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", got)
+	}
+	if rec.Body.Len() >= len(text) {
+		t.Errorf("compressed body is %d bytes, not smaller than %d", rec.Body.Len(), len(text))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || string(body) != text {
+		t.Errorf("decompressed body differs (%d bytes, %v)", len(body), err)
+	}
+	if vary := rec.Header().Get("Vary"); !strings.Contains(vary, "Accept-Encoding") {
+		t.Errorf("Vary %q, want it to name Accept-Encoding", vary)
+	}
+
+	if rec := getEncoded(p, target, "identity"); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != text {
+		t.Errorf("client not accepting gzip got Content-Encoding %q", rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestCompressSkipsSmallAndBinaryResponses(t *testing.T) {
+	small := &countingHandler{body: "tiny", header: http.Header{"Content-Type": {"text/plain"}}}
+	binary := &countingHandler{body: strings.Repeat("\x00", 4096), header: http.Header{"Content-Type": {"image/png"}}}
+	p := newTestProxy(t, Config{Compress: true, CompressMinSize: 1024, CompressEncodings: []string{"gzip"}})
+
+	for name, h := range map[string]*countingHandler{"small": small, "binary": binary} {
+		target := newTestUpstream(t, h.ServeHTTP).String() + "/page"
+		rec := getEncoded(p, target, "gzip")
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s response: Content-Encoding %q, want none", name, got)
+		}
+		if rec.Body.String() != h.body {
+			t.Errorf("%s response: body changed", name)
+		}
+	}
+}
+
+// decode undoes the named content coding.
+func decode(t *testing.T, encoding string, body io.Reader) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "br":
+		r = brotli.NewReader(body)
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	default:
+		r = body
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", encoding, err)
+	}
+	return string(out)
+}
+
+func TestCompressNegotiatesBestEncoding(t *testing.T) {
+	text := strings.Repeat("negotiate me ", 200)
+	upstream := &countingHandler{body: text, header: http.Header{"Content-Type": {"application/json"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{Compress: true, CompressMinSize: 1024, CompressEncodings: []string{"br", "zstd", "gzip"}})
+
+	for accept, want := range map[string]string{
+		"gzip, deflate, br, zstd":    "br",
+		"gzip, zstd":                 "zstd",
+		"br;q=0.5, zstd;q=0.8, gzip": "gzip",
+		"br;q=0, gzip;q=0.1":         "gzip",
+		"*":                          "br",
+		"zstd, *;q=0":                "zstd",
+		"deflate":                    "",
+		"br;q=0, zstd;q=0, gzip;q=0": "",
+	} {
+		rec := getEncoded(p, target, accept)
+		if got := rec.Header().Get("Content-Encoding"); got != want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, want %q", accept, got, want)
+			continue
+		}
+		if body := decode(t, want, rec.Body); body != text {
+			t.Errorf("Accept-Encoding %q: decoded body differs (%d bytes)", accept, len(body))
+		}
+	}
+}
+
+func TestParseEncodings(t *testing.T) {
+	got, err := parseEncodings("BR, zstd,gzip")
+	if err != nil || strings.Join(got, ",") != "br,zstd,gzip" {
+		t.Errorf("parseEncodings = %v, %v", got, err)
+	}
+	if _, err := parseEncodings("br,deflate"); err == nil {
+		t.Error("parseEncodings accepted deflate")
+	}
+}
+
+func TestCompressSkipsNoTransformResponses(t *testing.T) {
+	text := strings.Repeat("leave me alone ", 200)
+	upstream := &countingHandler{body: text, header: http.Header{
+		"Content-Type":  {"text/plain"},
+		"Cache-Control": {"max-age=60, no-transform"},
+	}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{Compress: true, CompressMinSize: 1024, CompressEncodings: []string{"br", "zstd", "gzip"}, XCacheHeader: true})
+
+	// Neither the response from upstream nor the cached copy is compressed.
+	for i, want := range []string{"MISS", "HIT"} {
+		rec := getEncoded(p, target, "gzip, br, zstd")
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache %q, want %q", i, got, want)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("request %d: Content-Encoding %q, want none", i, got)
+		}
+		if rec.Body.String() != text {
+			t.Errorf("request %d: body changed (%d bytes)", i, rec.Body.Len())
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "net/http"
+
+// limitConns caps how many requests and tunnels each client IP may have open
+// at once, answering 429 beyond -max-conns-per-client.
+func (p *Proxy) limitConns(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if p.cfg.MaxConnsPerClient <= 0 {
+			next(res, req)
+			return
+		}
+
+		ip := p.clientIP(req)
+		p.inFlightMux.Lock()
+		if p.inFlight[ip] >= p.cfg.MaxConnsPerClient {
+			p.inFlightMux.Unlock()
+			http.Error(res, "Too Many Connections", http.StatusTooManyRequests)
+			p.logEvent("Connection limit exceeded for client %s", ip)
+			p.metrics.IncCounter("proxy_conn_limited_total", nil)
+			return
+		}
+		p.inFlight[ip]++
+		p.inFlightMux.Unlock()
+
+		defer func() {
+			p.inFlightMux.Lock()
+			if p.inFlight[ip]--; p.inFlight[ip] == 0 {
+				delete(p.inFlight, ip)
+			}
+			p.inFlightMux.Unlock()
+		}()
+		next(res, req)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitInFlight waits until ip has n requests or tunnels open on p.
+func waitInFlight(t *testing.T, p *Proxy, ip string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		p.inFlightMux.Lock()
+		got := p.inFlight[ip]
+		p.inFlightMux.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d open, want %d", ip, got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnLimitPerClient(t *testing.T) {
+	release := make(chan struct{})
+	u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		res.Write([]byte("ok"))
+	})
+	metrics := newRecordingMetrics()
+	p := newTestProxy(t, Config{MaxConnsPerClient: 3})
+	p.metrics = metrics
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(p, freshGet(u.String()+"/slow")).Code
+		}()
+	}
+	waitInFlight(t, p, "192.0.2.1", 3)
+
+	for i := 0; i < 2; i++ {
+		if rec := get(p, u.String()+"/fast"); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("excess request %d: status %d, want 429", i, rec.Code)
+		}
+	}
+	other := httptest.NewRequest(http.MethodGet, u.String()+"/fast", nil)
+	other.RemoteAddr = "198.51.100.7:1234"
+	if rec := serve(p, other); rec.Code != http.StatusOK {
+		t.Errorf("another client: status %d, want 200", rec.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request within the limit: status %d, want 200", code)
+		}
+	}
+	if n := metrics.counter("proxy_conn_limited_total"); n != 2 {
+		t.Errorf("proxy_conn_limited_total = %d, want 2", n)
+	}
+	// Finished requests give their slots back.
+	waitInFlight(t, p, "192.0.2.1", 0)
+	if rec := get(p, u.String()+"/fast"); rec.Code != http.StatusOK {
+		t.Errorf("after the others finish: status %d, want 200", rec.Code)
+	}
+}
+
+func TestConnLimitCountsTunnels(t *testing.T) {
+	dest := newEchoServer(t)
+	p := newTestProxy(t, Config{MaxConnsPerClient: 2})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	openTunnel(t, srv.Listener.Addr().String(), dest)
+	openTunnel(t, srv.Listener.Addr().String(), dest)
+	waitInFlight(t, p, "127.0.0.1", 2)
+
+	req := connectRequest(dest)
+	req.RemoteAddr = "127.0.0.1:40000"
+	if rec := serve(p, req); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("third tunnel: status %d, want 429", rec.Code)
+	}
+	for _, tunnel := range listTunnels(t, p) {
+		serve(p, adminRequest(http.MethodDelete, fmt.Sprintf("/admin/tunnels/%d", tunnel.ID)))
+	}
+	waitInFlight(t, p, "127.0.0.1", 0)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// requestContext returns the context a request's upstream work runs under:
+// the inbound request's, which is cancelled when the client goes away,
+// bounded by -request-timeout when set.
+func (p *Proxy) requestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	if p.cfg.RequestTimeout > 0 {
+		return context.WithTimeout(req.Context(), p.cfg.RequestTimeout)
+	}
+	return context.WithCancel(req.Context())
+}
+
+// handleCancelled answers a request whose upstream work failed because ctx
+// ended, and reports whether it did: with 504 once -request-timeout has
+// passed, and with nothing when the client has gone away.
+func (p *Proxy) handleCancelled(ctx context.Context, res http.ResponseWriter, req *http.Request) bool {
+	switch err := ctx.Err(); {
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(res, "Gateway Timeout", http.StatusGatewayTimeout)
+		p.logEvent("Timed out forwarding %s after %v", req.RequestURI, p.cfg.RequestTimeout)
+		p.metrics.IncCounter("proxy_upstream_errors_total", map[string]string{"reason": "timeout"})
+		return true
+	case err != nil:
+		p.logEvent("Client went away during %s", req.RequestURI)
+		p.metrics.IncCounter("proxy_client_cancelled_total", nil)
+		return true
+	}
+	return false
+}
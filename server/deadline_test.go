@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientCancellationReachesUpstream(t *testing.T) {
+	arrived := make(chan struct{})
+	cancelled := make(chan struct{})
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		close(arrived)
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}).String() + "/slow"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(p, freshGet(target).WithContext(ctx))
+	}()
+	<-arrived
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request not cancelled after the client went away")
+	}
+	<-done
+	if len(logs.lines("Client went away during "+target)) != 1 {
+		t.Errorf("cancellation wasn't logged:\n%s", logs)
+	}
+	if n := m.counter("proxy_client_cancelled_total"); n != 1 {
+		t.Errorf("proxy_client_cancelled_total = %d, want 1", n)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}).String() + "/slow"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{RequestTimeout: 50 * time.Millisecond, LogFile: logs})
+
+	start := time.Now()
+	if rec := serve(p, freshGet(target)); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v, want it cut off at -request-timeout", elapsed)
+	}
+	if len(logs.lines("Timed out forwarding "+target+" after 50ms")) != 1 {
+		t.Errorf("timeout wasn't logged:\n%s", logs)
+	}
+}
+
+func TestCancelledClientSkipsTunnelDial(t *testing.T) {
+	dest := newEchoServer(t)
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := serve(p, connectRequest(dest).WithContext(ctx))
+	// Nothing is written back: had the dial gone ahead, the recorder would
+	// hold the failed hijack's error.
+	if rec.Body.Len() != 0 {
+		t.Errorf("CONNECT from a client that went away was answered %d %q", rec.Code, rec.Body.String())
+	}
+	if len(logs.lines("Client went away during")) != 1 {
+		t.Errorf("cancellation wasn't logged:\n%s", logs)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// redactedHeaders lists headers whose values are masked in header dumps.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// debugRequested reports whether headers should be dumped for req, either
+// because -dump-headers is set or an admin client sent X-Proxy-Debug: 1.
+// Other clients' X-Proxy-Debug is ignored, so they can't fill the log.
+func (p *Proxy) debugRequested(req *http.Request) bool {
+	return p.cfg.DumpHeaders || (req.Header.Get("X-Proxy-Debug") == "1" && p.isAdminClient(req))
+}
+
+// formatHeaders renders header as sorted "Name: value" pairs with sensitive
+// values masked.
+func formatHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range header[name] {
+			if redactedHeaders[http.CanonicalHeaderKey(name)] {
+				value = "***"
+			}
+			b.WriteString("\n  ")
+			b.WriteString(name)
+			b.WriteString(": ")
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+func (p *Proxy) dumpRequestHeaders(req *http.Request) {
+	p.logDebug("Request headers for %s %s:%s", req.Method, req.RequestURI, formatHeaders(req.Header))
+}
+
+func (p *Proxy) dumpResponseHeaders(req *http.Request, status int, header http.Header) {
+	p.logDebug("Response headers for %s %s (%d):%s", req.Method, req.RequestURI, status, formatHeaders(header))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHeaderOnlyFromAdminClients(t *testing.T) {
+	upstream := &countingHandler{body: "hello", header: http.Header{"Set-Cookie": {"session=abc"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs})
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("X-Proxy-Debug", "1")
+	req.Header.Set("Authorization", "Bearer token")
+	serve(p, req)
+	if n := len(logs.lines("DEBUG")); n != 0 {
+		t.Errorf("X-Proxy-Debug from a proxy client dumped %d lines:\n%s", n, logs)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, target+"?again", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	req.Header.Set("X-Proxy-Debug", "1")
+	req.Header.Set("Authorization", "Bearer token")
+	serve(p, req)
+	if len(logs.lines("DEBUG Request headers")) != 1 || len(logs.lines("DEBUG Response headers")) != 1 {
+		t.Errorf("X-Proxy-Debug from loopback didn't dump both header sets:\n%s", logs)
+	}
+	if out := logs.String(); strings.Contains(out, "Bearer token") || strings.Contains(out, "session=abc") {
+		t.Errorf("dump shows a sensitive value:\n%s", out)
+	}
+}
+
+func TestFormatHeadersMasksSensitiveValues(t *testing.T) {
+	got := formatHeaders(http.Header{
+		"Cookie":              {"a=b"},
+		"Proxy-Authorization": {"Basic x"},
+		"Accept":              {"text/html"},
+	})
+	want := "\n  Accept: text/html\n  Cookie: ***\n  Proxy-Authorization: ***"
+	if got != want {
+		t.Errorf("formatHeaders = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// connectDialTimeout bounds the total time spent dialing a CONNECT target
+// across all of its addresses.
+const connectDialTimeout = 10 * time.Second
+
+// upstreamDialTimeout bounds dialing an upstream for a forwarded request,
+// including the lookup.
+const upstreamDialTimeout = 30 * time.Second
+
+// newDialer returns the dialer used for forwarded requests and CONNECT
+// tunnels.
+func (p *Proxy) newDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: 30 * time.Second, Resolver: p.resolver}
+	if p.cfg.SourceIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: p.cfg.SourceIP}
+	}
+	return d
+}
+
+// upstreamDial returns the dial function for forwarded requests: the
+// dialer's own, which resolves hosts itself, unless -max-dns-lookups is set,
+// in which case hosts are resolved through lookupIPAddr so each lookup waits
+// for a free slot.
+func (p *Proxy) upstreamDial() dialFunc {
+	if p.dnsSlots == nil {
+		return p.newDialer().DialContext
+	}
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, upstreamDialTimeout)
+		defer cancel()
+		return p.dialAddrs(ctx, addr)
+	}
+}
+
+// parseSourceIP parses s and checks it is assigned to a local interface by
+// binding to it.
+func parseSourceIP(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind to %s: %v", s, err)
+	}
+	ln.Close()
+	return ip, nil
+}
+
+// parseDNSServer checks that s is an IP address with an optional port,
+// defaulting to 53, and returns it as host:port.
+func parseDNSServer(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, "53"
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) == nil {
+		return "", fmt.Errorf("invalid DNS server %q, want an IP address with optional port", s)
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+}
+
+// newResolver returns a resolver that sends every query to server, or the
+// system resolver when server is empty.
+func newResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// lookupIPAddr resolves host with p.resolver. With -max-dns-lookups set, it
+// first waits for one of that many slots, so a burst of requests for new
+// hosts queues instead of flooding the resolver; IP literals need no lookup
+// and skip the wait.
+func (p *Proxy) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if p.dnsSlots != nil && net.ParseIP(host) == nil {
+		select {
+		case p.dnsSlots <- struct{}{}:
+			defer func() { <-p.dnsSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return p.resolver.LookupIPAddr(ctx, host)
+}
+
+// dialDirect connects to hostport, trying each resolved address in turn with
+// IPv6 and IPv4 interleaved until one succeeds or connectDialTimeout passes.
+func (p *Proxy) dialDirect(ctx context.Context, hostport string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectDialTimeout)
+	defer cancel()
+	return p.dialAddrs(ctx, hostport)
+}
+
+// dialAddrs resolves hostport's host and dials its addresses as dialDirect
+// describes, until ctx's deadline.
+func (p *Proxy) dialAddrs(ctx context.Context, hostport string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := p.lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if p.cfg.SourceIP != nil {
+		addrs = sameFamily(addrs, p.cfg.SourceIP)
+	}
+	addrs = interleaveFamilies(addrs)
+
+	var (
+		dialer   = p.newDialer()
+		firstErr error
+	)
+	for i, addr := range addrs {
+		attemptCtx, attemptCancel := context.WithDeadline(ctx, partialDeadline(ctx, len(addrs)-i))
+		conn, err := dialer.DialContext(attemptCtx, "tcp", net.JoinHostPort(addr.IP.String(), port))
+		attemptCancel()
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses for " + host)
+	}
+	return nil, firstErr
+}
+
+// partialDeadline splits the time left on ctx evenly between the remaining
+// dial attempts so one unreachable address cannot use up the whole budget.
+func partialDeadline(ctx context.Context, remaining int) time.Time {
+	deadline, _ := ctx.Deadline()
+	left := time.Until(deadline)
+	return time.Now().Add(left / time.Duration(remaining))
+}
+
+// sameFamily keeps only the addresses reachable from a source bound to ip,
+// that is those of the same IP version.
+func sameFamily(addrs []net.IPAddr, ip net.IP) []net.IPAddr {
+	var out []net.IPAddr
+	for _, addr := range addrs {
+		if (addr.IP.To4() == nil) == (ip.To4() == nil) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// interleaveFamilies reorders addrs so IPv6 and IPv4 addresses alternate,
+// starting with the family of the first address and otherwise keeping the
+// resolver's order.
+func interleaveFamilies(addrs []net.IPAddr) []net.IPAddr {
+	var first, second []net.IPAddr
+	for _, addr := range addrs {
+		if (addr.IP.To4() == nil) == (addrs[0].IP.To4() == nil) {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+
+	out := make([]net.IPAddr, 0, len(addrs))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			out = append(out, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			out = append(out, second[0])
+			second = second[1:]
+		}
+	}
+	return out
+}
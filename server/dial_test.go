@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubDNS answers A queries for every name with its addresses, and AAAA
+// queries with none, over UDP until the test ends. It counts the queries
+// it gets and how many names it was asked about, and, when it delays its
+// answers, the most names it was resolving at once.
+type stubDNS struct {
+	addr  string
+	ips   []net.IP
+	delay time.Duration
+
+	mu          sync.Mutex
+	names       map[string]int
+	pending     map[string]int
+	maxInFlight int
+}
+
+func newStubDNS(t *testing.T, ips ...string) *stubDNS {
+	t.Helper()
+	return newSlowStubDNS(t, 0, ips...)
+}
+
+// newSlowStubDNS is newStubDNS answering every query after delay.
+func newSlowStubDNS(t *testing.T, delay time.Duration, ips ...string) *stubDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &stubDNS{addr: conn.LocalAddr().String(), delay: delay, names: make(map[string]int), pending: make(map[string]int)}
+	for _, ip := range ips {
+		s.ips = append(s.ips, net.ParseIP(ip).To4())
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply, name := s.answer(buf[:n])
+			if reply == nil {
+				continue
+			}
+			if s.delay == 0 {
+				conn.WriteTo(reply, from)
+				continue
+			}
+			go func() {
+				s.track(name, 1)
+				time.Sleep(s.delay)
+				s.track(name, -1)
+				conn.WriteTo(reply, from)
+			}()
+		}
+	}()
+	return s
+}
+
+// answer builds the reply to query, or nil if it can't be parsed, and
+// returns the name asked about.
+func (s *stubDNS) answer(query []byte) ([]byte, string) {
+	if len(query) < 12 {
+		return nil, ""
+	}
+	// The question is the name's labels, a zero byte, then type and class.
+	end := 12
+	var name []byte
+	for end < len(query) && query[end] != 0 {
+		l := int(query[end])
+		if end+1+l > len(query) {
+			return nil, ""
+		}
+		name = append(append(name, query[end+1:end+1+l]...), '.')
+		end += 1 + l
+	}
+	end += 5
+	if end > len(query) {
+		return nil, ""
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+	s.mu.Lock()
+	s.names[string(name)]++
+	s.mu.Unlock()
+
+	var answers []net.IP
+	if qtype == 1 {
+		answers = s.ips
+	}
+	reply := append([]byte(nil), query[:end]...)
+	binary.BigEndian.PutUint16(reply[2:], 0x8180) // response, recursion available
+	binary.BigEndian.PutUint16(reply[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(reply[8:], 0)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+	for _, ip := range answers {
+		reply = append(reply, 0xc0, 12) // pointer to the question's name
+		reply = binary.BigEndian.AppendUint16(reply, 1)
+		reply = binary.BigEndian.AppendUint16(reply, 1)
+		reply = binary.BigEndian.AppendUint32(reply, 60)
+		reply = binary.BigEndian.AppendUint16(reply, 4)
+		reply = append(reply, ip...)
+	}
+	return reply, string(name)
+}
+
+// track counts a query for name starting, with delta 1, or being answered,
+// with -1. A and AAAA queries for one name count as one lookup.
+func (s *stubDNS) track(name string, delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[name] += delta
+	if s.pending[name] == 0 {
+		delete(s.pending, name)
+	}
+	if len(s.pending) > s.maxInFlight {
+		s.maxInFlight = len(s.pending)
+	}
+}
+
+// mostInFlight returns the most names s was resolving at once.
+func (s *stubDNS) mostInFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxInFlight
+}
+
+func (s *stubDNS) queried(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.names[name]
+}
+
+func TestDialTriesNextAddress(t *testing.T) {
+	dest := newEchoServer(t)
+	_, port, _ := net.SplitHostPort(dest)
+	// dest listens on 127.0.0.1 only, so 127.0.0.2 refuses the connection.
+	dns := newStubDNS(t, "127.0.0.2", "127.0.0.1")
+	p := newTestProxy(t, Config{})
+	p.resolver = newResolver(dns.addr)
+
+	conn, err := p.dialDirect(context.Background(), net.JoinHostPort("multi.example.com", port))
+	if err != nil {
+		t.Fatalf("dialDirect: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("connected to %s, want 127.0.0.1", got)
+	}
+	conn.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+		t.Errorf("echo: %q, %v", buf, err)
+	}
+}
+
+func TestDialFailsWhenNoAddressAnswers(t *testing.T) {
+	dns := newStubDNS(t, "127.0.0.2", "127.0.0.3")
+	p := newTestProxy(t, Config{})
+	p.resolver = newResolver(dns.addr)
+
+	if conn, err := p.dialDirect(context.Background(), "multi.example.com:9"); err == nil {
+		conn.Close()
+		t.Fatal("dialDirect succeeded with no reachable address")
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("2001:db8::2")},
+		{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("192.0.2.2")}, {IP: net.ParseIP("192.0.2.3")},
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	got := interleaveFamilies(addrs)
+	for i := range want {
+		if got[i].IP.String() != want[i] {
+			t.Fatalf("interleaveFamilies = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSourceIPBindsOutboundConnections(t *testing.T) {
+	ip, err := parseSourceIP("127.0.0.2")
+	if err != nil {
+		t.Skipf("cannot bind 127.0.0.2 here: %v", err)
+	}
+	p := newTestProxy(t, Config{SourceIP: ip})
+	if got, ok := p.newDialer().LocalAddr.(*net.TCPAddr); !ok || !got.IP.Equal(ip) {
+		t.Fatalf("dialer LocalAddr = %v, want %s", p.newDialer().LocalAddr, ip)
+	}
+
+	conn, err := p.dialDirect(context.Background(), newEchoServer(t))
+	if err != nil {
+		t.Fatalf("dialDirect: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.LocalAddr().(*net.TCPAddr).IP; !got.Equal(ip) {
+		t.Errorf("connection from %s, want %s", got, ip)
+	}
+}
+
+func TestParseSourceIP(t *testing.T) {
+	if ip, err := parseSourceIP(""); ip != nil || err != nil {
+		t.Errorf(`parseSourceIP("") = %v, %v; want nil, nil`, ip, err)
+	}
+	// 192.0.2.1 is a documentation address no test host has.
+	for _, s := range []string{"not-an-ip", "192.0.2.1"} {
+		if _, err := parseSourceIP(s); err == nil {
+			t.Errorf("parseSourceIP(%q) succeeded", s)
+		}
+	}
+	if p := newTestProxy(t, Config{}); p.newDialer().LocalAddr != nil {
+		t.Errorf("dialer LocalAddr = %v without -source-ip", p.newDialer().LocalAddr)
+	}
+}
+
+func TestDNSServerUsedForForwardedRequests(t *testing.T) {
+	upstream := &countingHandler{body: "internal"}
+	u := newTestUpstream(t, upstream.ServeHTTP)
+	_, port, _ := net.SplitHostPort(u.Host)
+	dns := newStubDNS(t, "127.0.0.1")
+	p := newTestProxy(t, Config{DNSServer: dns.addr})
+
+	rec := get(p, "http://app.corp.internal:"+port+"/")
+	if rec.Code != http.StatusOK || rec.Body.String() != "internal" {
+		t.Errorf("forwarded request: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if dns.queried("app.corp.internal.") == 0 {
+		t.Error("forwarded request did not resolve through the stub server")
+	}
+
+	dest := newEchoServer(t)
+	_, port, _ = net.SplitHostPort(dest)
+	conn, err := p.dialTunnel(context.Background(), net.JoinHostPort("tunnel.corp.internal", port))
+	if err != nil {
+		t.Fatalf("dialTunnel: %v", err)
+	}
+	conn.Close()
+	if dns.queried("tunnel.corp.internal.") == 0 {
+		t.Error("CONNECT did not resolve through the stub server")
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                "",
+		"10.0.0.53":       "10.0.0.53:53",
+		"10.0.0.53:5353":  "10.0.0.53:5353",
+		"2001:db8::53":    "[2001:db8::53]:53",
+		"[2001:db8::53]":  "[2001:db8::53]:53",
+		"[2001:db8::1]:5": "[2001:db8::1]:5",
+	} {
+		if got, err := parseDNSServer(in); err != nil || got != want {
+			t.Errorf("parseDNSServer(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := parseDNSServer("dns.example.com"); err == nil {
+		t.Error("parseDNSServer accepted a host name")
+	}
+}
+
+func TestMaxDNSLookups(t *testing.T) {
+	u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("ok"))
+	})
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	for _, limit := range []int{0, 3} {
+		dns := newSlowStubDNS(t, 30*time.Millisecond, "127.0.0.1")
+		p := newTestProxy(t, Config{DNSServer: dns.addr, MaxDNSLookups: limit})
+		var wg sync.WaitGroup
+		for i := 0; i < 12; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				target := fmt.Sprintf("http://host%d.example.com:%s/", i, port)
+				if rec := get(p, target); rec.Code != http.StatusOK {
+					t.Errorf("%s: status %d", target, rec.Code)
+				}
+			}(i)
+		}
+		wg.Wait()
+		most := dns.mostInFlight()
+		if limit > 0 && most > limit {
+			t.Errorf("-max-dns-lookups %d: %d lookups ran at once", limit, most)
+		}
+		if limit == 0 && most <= 3 {
+			t.Errorf("without -max-dns-lookups: at most %d lookups ran at once, want more than 3", most)
+		}
+	}
+}
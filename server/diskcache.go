@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// diskBodyPrefix starts the name of every body file the cache writes under
+// -cache-disk-dir, so leftovers can be told apart from anything else there.
+const diskBodyPrefix = "body-"
+
+// spillToDisk moves e's body into a new file under the disk cache directory.
+// The file is named by the body's hash but made unique, so a concurrent
+// store of the same bytes never overwrites a file another entry is using;
+// lruCache drops the duplicate when the entry is added.
+func (p *Proxy) spillToDisk(e *cacheEntry) error {
+	hash := sha256.Sum256(e.body)
+	f, err := os.CreateTemp(p.cfg.CacheDiskDir, diskBodyPrefix+hex.EncodeToString(hash[:])+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(e.body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	e.bodyHash = hash
+	e.bodyPath = f.Name()
+	e.diskSize = int64(len(e.body))
+	e.body = nil
+	return nil
+}
+
+// cleanDiskCache removes body files left by a previous run. Snapshots hold
+// only in-memory bodies, so nothing can refer to them any more.
+func cleanDiskCache(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, diskBodyPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveCachedFile streams a disk-backed cache hit from its open body file
+// without reading it into memory. A 200 goes through http.ServeContent, which
+// also answers Range and conditional requests; other statuses are copied as
+// is. Disk-backed bodies are never compressed on the way out.
+func serveCachedFile(res http.ResponseWriter, req *http.Request, status int, header http.Header, f *os.File, size int64) {
+	if status == http.StatusOK {
+		serveCachedRange(res, req, header, f)
+		return
+	}
+	yieldServer(res.Header(), header)
+	for h, values := range header {
+		for _, value := range values {
+			res.Header().Add(h, value)
+		}
+	}
+	res.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	res.WriteHeader(status)
+	if req.Method != http.MethodHead {
+		io.Copy(res, f)
+	}
+}
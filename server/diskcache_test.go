@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hashingWriter is a ResponseWriter that keeps only a hash of the body, so
+// it doesn't itself hold the response in memory.
+type hashingWriter struct {
+	header http.Header
+	status int
+	body   hash.Hash
+	n      int64
+}
+
+func newHashingWriter() *hashingWriter {
+	return &hashingWriter{header: http.Header{}, body: sha256.New()}
+}
+
+func (w *hashingWriter) Header() http.Header { return w.header }
+
+func (w *hashingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.n += int64(len(p))
+	return w.body.Write(p)
+}
+
+func TestDiskCacheStreamsLargeHits(t *testing.T) {
+	body := strings.Repeat("0123456789abcdef", 1<<19) // 8 MiB
+	upstream := &countingHandler{body: body, header: http.Header{"Content-Type": {"application/octet-stream"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/large.bin"
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, CacheDiskDir: t.TempDir(), CacheDiskMinSize: 1 << 20, XCacheHeader: true})
+
+	get(p, target)
+	entries := p.cache.entries()
+	if len(entries) != 1 || entries[0].bodyPath == "" || entries[0].body != nil {
+		t.Fatal("large body not moved to disk")
+	}
+	if info, err := os.Stat(entries[0].bodyPath); err != nil || info.Size() != int64(len(body)) {
+		t.Fatalf("body file: %v, %v", info, err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	w := newHashingWriter()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	runtime.ReadMemStats(&after)
+
+	if w.header.Get("X-Cache") != "HIT" || w.n != int64(len(body)) || string(w.body.Sum(nil)) != string(sha256Sum(body)) {
+		t.Fatalf("hit: X-Cache %q, %d bytes; want the whole body from the cache", w.header.Get("X-Cache"), w.n)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("serving the %d byte hit allocated %d bytes, want it streamed", len(body), allocated)
+	}
+	if n := upstream.requests(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+
+	rec := getRange(p, target, "bytes=1048576-1048591")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "0123456789abcdef" {
+		t.Errorf("range from disk: status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func sha256Sum(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
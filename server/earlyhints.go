@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// relayEarlyHints returns proxyReq with a client trace that passes each
+// 103 Early Hints response from upstream on to res as it arrives, so the
+// client can start preloading before the final response is ready. Other
+// interim responses are left to the transport. Clients older than HTTP/1.1
+// can't receive 1xx responses and get none.
+func (p *Proxy) relayEarlyHints(res http.ResponseWriter, req, proxyReq *http.Request) *http.Request {
+	if !p.cfg.EarlyHints || !req.ProtoAtLeast(1, 1) {
+		return proxyReq
+	}
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code != http.StatusEarlyHints {
+				return nil
+			}
+			hints := http.Header(header).Clone()
+			removeHopByHop(hints)
+			stripHeaders(hints, p.cfg.StripResponseHeaders)
+
+			// The interim response is sent with whatever res holds, so swap
+			// the hints in and put back anything set for the final response.
+			saved := res.Header().Clone()
+			clear(res.Header())
+			for name, values := range hints {
+				res.Header()[name] = values
+			}
+			res.WriteHeader(http.StatusEarlyHints)
+			clear(res.Header())
+			for name, values := range saved {
+				res.Header()[name] = values
+			}
+			p.metrics.IncCounter("proxy_early_hints_total", nil)
+			return nil
+		},
+	}
+	return proxyReq.WithContext(httptrace.WithClientTrace(proxyReq.Context(), trace))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"testing"
+)
+
+func TestEarlyHintsRelayed(t *testing.T) {
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Link", "</app.css>; rel=preload; as=style")
+		res.WriteHeader(http.StatusEarlyHints)
+		res.Header().Del("Link")
+		res.Header().Set("Cache-Control", "no-store")
+		res.Write([]byte("page"))
+	}).String() + "/page"
+
+	for _, enabled := range []bool{true, false} {
+		srv := httptest.NewServer(newTestProxy(t, Config{EarlyHints: enabled}))
+		proxyURL, _ := url.Parse(srv.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		var hints []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Get("Link"))
+				}
+				return nil
+			},
+		}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, target, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("early hints %v: %v", enabled, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "page" {
+			t.Errorf("early hints %v: status %d, body %q", enabled, resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Link"); got != "" {
+			t.Errorf("early hints %v: final response has Link %q", enabled, got)
+		}
+		switch {
+		case enabled && (len(hints) != 1 || hints[0] != "</app.css>; rel=preload; as=style"):
+			t.Errorf("client got early hints %q, want the upstream's Link", hints)
+		case !enabled && len(hints) != 0:
+			t.Errorf("without -early-hints: client got early hints %q", hints)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+// settingsFlags registers a few of main's flags on a fresh FlagSet, with
+// main's names and defaults.
+func settingsFlags(cfg *Config, addr *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	fs.StringVar(addr, "addr", ":8080", "")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", 0, "")
+	fs.IntVar(&cfg.RateLimit, "rate-limit", defaultRateLimit, "")
+	fs.BoolVar(&cfg.Compress, "compress", false, "")
+	return fs
+}
+
+func TestEnvName(t *testing.T) {
+	for flagName, want := range map[string]string{
+		"addr":                  "PROXY_ADDR",
+		"cache-ttl":             "PROXY_CACHE_TTL",
+		"handler-queue-timeout": "PROXY_HANDLER_QUEUE_TIMEOUT",
+	} {
+		if got := envName(flagName); got != want {
+			t.Errorf("envName(%q) = %q, want %q", flagName, got, want)
+		}
+	}
+}
+
+func TestSettingsFromEnv(t *testing.T) {
+	t.Setenv("PROXY_RATE_LIMIT", "250")
+	t.Setenv("PROXY_CACHE_TTL", "90s")
+	t.Setenv("PROXY_ADDR", ":9090")
+
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		rateLimit int
+		cacheTTL  time.Duration
+		addr      string
+	}{
+		{"env over defaults", nil, 250, 90 * time.Second, ":9090"},
+		{"flags over env", []string{"-rate-limit=5", "-addr=:7070"}, 5, 90 * time.Second, ":7070"},
+	} {
+		var cfg Config
+		var addr string
+		fs := settingsFlags(&cfg, &addr)
+		if err := setFlagsFromEnv(fs); err != nil {
+			t.Fatalf("%s: setFlagsFromEnv: %v", tc.name, err)
+		}
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatalf("%s: Parse: %v", tc.name, err)
+		}
+		if cfg.RateLimit != tc.rateLimit || cfg.CacheTTL != tc.cacheTTL || addr != tc.addr {
+			t.Errorf("%s: rate limit %d, cache TTL %v, addr %q; want %d, %v, %q",
+				tc.name, cfg.RateLimit, cfg.CacheTTL, addr, tc.rateLimit, tc.cacheTTL, tc.addr)
+		}
+		// A setting in neither place keeps its default.
+		if cfg.Compress {
+			t.Errorf("%s: compress on, want its default of off", tc.name)
+		}
+	}
+}
+
+func TestSettingsFromEnvRejectsBadValue(t *testing.T) {
+	t.Setenv("PROXY_RATE_LIMIT", "lots")
+	var cfg Config
+	var addr string
+	err := setFlagsFromEnv(settingsFlags(&cfg, &addr))
+	if err == nil || !strings.Contains(err.Error(), "PROXY_RATE_LIMIT") {
+		t.Errorf("setFlagsFromEnv = %v, want an error naming PROXY_RATE_LIMIT", err)
+	}
+}
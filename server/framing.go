@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// checkFraming rejects requests whose body length is ambiguous, which a
+// proxy could otherwise frame differently from the upstream (request
+// smuggling). net/http's own server already refuses differing duplicate
+// Content-Length headers and drops Content-Length when chunked is present,
+// so this guards the handler when requests reach it some other way.
+func checkFraming(req *http.Request) error {
+	lengths := req.Header.Values("Content-Length")
+	if len(req.TransferEncoding) > 0 || req.Header.Get("Transfer-Encoding") != "" {
+		if len(lengths) > 0 {
+			return errors.New("both Content-Length and Transfer-Encoding present")
+		}
+		if len(req.TransferEncoding) > 1 || (len(req.TransferEncoding) == 1 && req.TransferEncoding[0] != "chunked") {
+			return errors.New("unsupported Transfer-Encoding")
+		}
+	}
+	var first string
+	for _, header := range lengths {
+		for _, value := range strings.Split(header, ",") {
+			value = strings.TrimSpace(value)
+			if first == "" {
+				first = value
+			} else if value != first {
+				return errors.New("conflicting Content-Length headers")
+			}
+		}
+	}
+	return nil
+}
+
+// frameOutbound makes the outbound request carry exactly one framing
+// mechanism: the length net/http parsed from the client, or chunked when it
+// is unknown. Copied framing headers are dropped so they can't disagree.
+func frameOutbound(out, in *http.Request) {
+	out.Header.Del("Content-Length")
+	out.Header.Del("Transfer-Encoding")
+	out.ContentLength = in.ContentLength
+	if in.ContentLength == 0 {
+		out.Body = http.NoBody
+	}
+}
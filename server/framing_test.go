@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAmbiguousFramingRejected(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/submit"
+	p := newTestProxy(t, Config{})
+
+	cases := []struct {
+		name   string
+		header http.Header
+		te     []string
+	}{
+		{"length and chunked", http.Header{"Content-Length": {"5"}}, []string{"chunked"}},
+		{"length and chunked header", http.Header{"Content-Length": {"5"}, "Transfer-Encoding": {"chunked"}}, nil},
+		{"two lengths", http.Header{"Content-Length": {"5", "6"}}, nil},
+		{"list of lengths", http.Header{"Content-Length": {"5, 6"}}, nil},
+		{"unsupported coding", nil, []string{"gzip", "chunked"}},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader("hello"))
+		for name, values := range c.header {
+			req.Header[name] = values
+		}
+		req.TransferEncoding = c.te
+		if rec := serve(p, req); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", c.name, rec.Code)
+		}
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("upstream got %d requests, want 0", n)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader("hello"))
+	req.Header["Content-Length"] = []string{"5", "5"}
+	if rec := serve(p, req); rec.Code != http.StatusOK {
+		t.Errorf("repeated identical lengths: status %d, want 200", rec.Code)
+	}
+}
+
+func TestOutboundFramingNormalized(t *testing.T) {
+	type framing struct {
+		length int64
+		te     []string
+		header string
+		body   string
+	}
+	got := make(chan framing, 1)
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		got <- framing{req.ContentLength, req.TransferEncoding, req.Header.Get("Content-Length"), string(body)}
+	}).String() + "/submit"
+	p := newTestProxy(t, Config{})
+
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader("hello"))
+	req.Header["Content-Length"] = []string{"5", "5"}
+	serve(p, req)
+	if f := <-got; f.length != 5 || len(f.te) != 0 || f.body != "hello" {
+		t.Errorf("known length: upstream saw length %d, Transfer-Encoding %v, body %q", f.length, f.te, f.body)
+	}
+
+	// A chunked client body of unknown length goes upstream chunked, without
+	// a Content-Length.
+	req = httptest.NewRequest(http.MethodPost, target, io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo")))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	serve(p, req)
+	if f := <-got; f.length != -1 || len(f.te) != 1 || f.te[0] != "chunked" || f.header != "" || f.body != "hello" {
+		t.Errorf("chunked: upstream saw length %d, Transfer-Encoding %v, Content-Length %q, body %q", f.length, f.te, f.header, f.body)
+	}
+}
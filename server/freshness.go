@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCacheableStatuses are the status codes cached unless
+// -cacheable-statuses says otherwise.
+const defaultCacheableStatuses = "200,203,300,301,404,410"
+
+// statusSet holds individual status codes and whole classes such as 2xx.
+type statusSet struct {
+	codes   map[int]bool
+	classes map[int]bool
+}
+
+// parseStatusSet parses a comma-separated list of status codes and classes,
+// such as "200,301,4xx".
+func parseStatusSet(s string) (statusSet, error) {
+	set := statusSet{codes: make(map[int]bool), classes: make(map[int]bool)}
+	for _, item := range splitList(s) {
+		if len(item) == 3 && strings.HasSuffix(strings.ToLower(item), "xx") && item[0] >= '1' && item[0] <= '5' {
+			set.classes[int(item[0]-'0')] = true
+			continue
+		}
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			return statusSet{}, fmt.Errorf("invalid status %q", item)
+		}
+		set.codes[code] = true
+	}
+	return set, nil
+}
+
+func (s statusSet) contains(code int) bool {
+	return s.codes[code] || s.classes[code/100]
+}
+
+// ttlRule assigns a TTL to URLs whose host or path matches pattern, where
+// "*" matches any run of characters.
+type ttlRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// parseTTLOverrides parses a comma-separated list of pattern=duration pairs,
+// such as "*.jpg=1h,/api/*=10s".
+func parseTTLOverrides(s string) ([]ttlRule, error) {
+	var rules []ttlRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(item, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid TTL override %q, want pattern=duration", item)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL override %q: %v", item, err)
+		}
+		rules = append(rules, ttlRule{pattern: pattern, ttl: ttl})
+	}
+	return rules, nil
+}
+
+// globMatch reports whether s matches pattern, where "*" matches any
+// sequence of characters, including "/" and ".".
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// parseCacheControl splits a Cache-Control header into lower-cased
+// directives mapped to their (unquoted) values.
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return directives
+}
+
+// cacheTTL returns how long a response for u may be cached and whether it
+// may be cached at all. Explicit upstream Cache-Control wins, then the first
+// matching override, then -cache-ttl. A zero TTL means the entry never
+// expires.
+func (p *Proxy) cacheTTL(u *url.URL, header http.Header) (time.Duration, bool) {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return 0, false
+		}
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	for _, rule := range p.cfg.TTLOverrides {
+		if globMatch(rule.pattern, u.Hostname()) || globMatch(rule.pattern, u.Path) {
+			return rule.ttl, true
+		}
+	}
+	return p.cfg.CacheTTL, true
+}
+
+// clientRequiresRevalidation reports whether a request forbids answering it
+// from the cache without checking with the upstream: Cache-Control
+// no-cache or max-age=0, or Pragma: no-cache from HTTP/1.0 clients that
+// send no Cache-Control.
+func clientRequiresRevalidation(header http.Header) bool {
+	if header.Get("Cache-Control") == "" {
+		return strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache")
+	}
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	return cc["max-age"] == "0"
+}
+
+// immutable reports whether a response carries Cache-Control: immutable,
+// promising it won't change while fresh, so there is nothing to revalidate.
+func immutable(header http.Header) bool {
+	_, ok := parseCacheControl(header.Get("Cache-Control"))["immutable"]
+	return ok
+}
+
+// noTransform reports whether a response carries Cache-Control:
+// no-transform, which forbids the proxy from changing its body: it is
+// neither compressed nor redacted.
+func noTransform(header http.Header) bool {
+	_, ok := parseCacheControl(header.Get("Cache-Control"))["no-transform"]
+	return ok
+}
+
+// sharedWithAuthorization reports whether a response to a request carrying
+// Authorization may be stored and served to other clients: only when its
+// Cache-Control says public or gives an s-maxage (RFC 9111, section 3.5).
+// Otherwise it may hold one user's data, which the cache key, made without
+// the credentials, can't keep apart from another's.
+func sharedWithAuthorization(header http.Header) bool {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	_, public := cc["public"]
+	_, sMaxAge := cc["s-maxage"]
+	return public || sMaxAge
+}
+
+// staleWhileRevalidate returns how long past expiry a response may be served
+// while it is refreshed in the background. The upstream's
+// stale-while-revalidate directive wins over -stale-while-revalidate.
+func (p *Proxy) staleWhileRevalidate(header http.Header) time.Duration {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	if value, ok := cc["stale-while-revalidate"]; ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return p.cfg.StaleWhileRevalidate
+}
+
+// upstreamAge returns the Age the upstream reported for a response, which
+// it may have served from its own cache.
+func upstreamAge(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(header.Get("Age")))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cacheBypassReason returns why req must skip the cache entirely, neither
+// reading nor storing an entry, or "" when it may use the cache.
+func (p *Proxy) cacheBypassReason(req *http.Request, u *url.URL) string {
+	for _, method := range p.cfg.CacheBypassMethods {
+		if req.Method == method {
+			return "method"
+		}
+	}
+	if !p.hostCacheable(u.Hostname()) {
+		return "host"
+	}
+	// A multipart body is checked before POST caching, which would buffer
+	// the whole upload to key it.
+	if isMultipart(req.Header) {
+		return "multipart"
+	}
+	// Only GETs are cached, and POSTs that opt in; other methods change
+	// state. A HEAD is answered from a cached GET, but carries no body to
+	// serve a later GET from, so it is never stored.
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && !p.postCacheable(req, u) {
+		return "method"
+	}
+	// A request pinned to one backend must see that backend's response,
+	// not one cached from another.
+	if p.cfg.XUpstreamHeader && p.backends != nil && !req.URL.IsAbs() && req.Header.Get("X-Upstream") != "" {
+		return "pinned"
+	}
+	return ""
+}
+
+// hostCacheable reports whether host matches -cacheable-hosts, which allows
+// every host when empty.
+func (p *Proxy) hostCacheable(host string) bool {
+	if len(p.cfg.CacheableHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range p.cfg.CacheableHosts {
+		if globMatch(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypeCacheable reports whether a response with header's
+// Content-Type matches -cacheable-content-types, which allows every type
+// when empty. A response without a Content-Type never matches a list.
+func (p *Proxy) contentTypeCacheable(header http.Header) bool {
+	if len(p.cfg.CacheableContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range p.cfg.CacheableContentTypes {
+		if globMatch(strings.ToLower(pattern), mediaType) {
+			return true
+		}
+	}
+	return false
+}
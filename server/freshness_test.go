@@ -0,0 +1,284 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheTTLOverrides(t *testing.T) {
+	rules, err := parseTTLOverrides("*.jpg=1h, /api/*=10s, static.example.com=0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{CacheTTL: 5 * time.Minute, TTLOverrides: rules})
+
+	for _, tc := range []struct {
+		url  string
+		want time.Duration
+	}{
+		{"http://example.com/logo.jpg", time.Hour},
+		{"http://example.com/api/users", 10 * time.Second},
+		{"http://static.example.com/app.js", 0},
+		{"http://example.com/index.html", 5 * time.Minute},
+	} {
+		u, _ := url.Parse(tc.url)
+		ttl, ok := p.cacheTTL(u, http.Header{})
+		if !ok || ttl != tc.want {
+			t.Errorf("cacheTTL(%s) = %v, %v; want %v, true", tc.url, ttl, ok, tc.want)
+		}
+	}
+
+	// Upstream Cache-Control wins over an override.
+	u, _ := url.Parse("http://example.com/logo.jpg")
+	if ttl, ok := p.cacheTTL(u, http.Header{"Cache-Control": {"max-age=30"}}); !ok || ttl != 30*time.Second {
+		t.Errorf("with max-age=30: %v, %v; want 30s, true", ttl, ok)
+	}
+	if _, ok := p.cacheTTL(u, http.Header{"Cache-Control": {"private"}}); ok {
+		t.Error("private response cacheable")
+	}
+}
+
+func TestParseTTLOverridesRejectsBadRules(t *testing.T) {
+	for _, s := range []string{"*.jpg", "=1h", "*.jpg=soon"} {
+		if _, err := parseTTLOverrides(s); err == nil {
+			t.Errorf("parseTTLOverrides(%q) succeeded", s)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*.jpg", "/a/b.jpg", true},
+		{"*.jpg", "/a/b.png", false},
+		{"/api/*", "/api/v1/x", true},
+		{"/api/*/x", "/api/v1/x", true},
+		{"/api/*/x", "/api/v1/y", false},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	} {
+		if got := globMatch(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
+
+// statusUpstream answers each request with the status code in its path,
+// counting requests per path.
+func statusUpstream(t *testing.T) (*url.URL, *countingHandler) {
+	counter := &countingHandler{body: "body"}
+	u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/"))
+		counter.mu.Lock()
+		counter.count++
+		counter.mu.Unlock()
+		res.WriteHeader(code)
+		res.Write([]byte("body"))
+	})
+	return u, counter
+}
+
+func TestCacheableStatuses(t *testing.T) {
+	cases := []struct {
+		statuses string
+		code     int
+		cached   bool
+	}{
+		{"", 200, true},
+		{"", 404, true},
+		{"", 500, false},
+		{"", 403, false},
+		{"2xx,500", 500, true},
+		{"2xx,500", 201, true},
+		{"2xx,500", 404, false},
+	}
+	for _, c := range cases {
+		upstream, counter := statusUpstream(t)
+		cfg := Config{CacheTTL: time.Minute}
+		if c.statuses != "" {
+			set, err := parseStatusSet(c.statuses)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.CacheableStatuses = set
+		}
+		p := newTestProxy(t, cfg)
+		target := upstream.String() + "/" + strconv.Itoa(c.code)
+		for i := 0; i < 2; i++ {
+			if rec := get(p, target); rec.Code != c.code {
+				t.Fatalf("%d: status %d", c.code, rec.Code)
+			}
+		}
+		want := 2
+		if c.cached {
+			want = 1
+		}
+		if n := counter.requests(); n != want {
+			t.Errorf("statuses %q, response %d: upstream got %d requests, want %d", c.statuses, c.code, n, want)
+		}
+	}
+}
+
+func TestParseStatusSetRejectsBadItems(t *testing.T) {
+	for _, s := range []string{"abc", "99", "600", "6xx"} {
+		if _, err := parseStatusSet(s); err == nil {
+			t.Errorf("parseStatusSet(%q) succeeded", s)
+		}
+	}
+}
+
+func TestCacheableHosts(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	u := newTestUpstream(t, upstream.ServeHTTP)
+	_, port, _ := net.SplitHostPort(u.Host)
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true, CacheableHosts: []string{"127.0.0.*", "*.cdn.example"}})
+
+	cacheable := "http://127.0.0.1:" + port + "/page"
+	get(p, cacheable)
+	if got := get(p, cacheable).Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("cacheable host: X-Cache %q, want HIT", got)
+	}
+	other := "http://localhost:" + port + "/page"
+	for i := 0; i < 2; i++ {
+		if got := get(p, other).Header().Get("X-Cache"); got != "BYPASS" {
+			t.Errorf("other host, request %d: X-Cache %q, want BYPASS", i, got)
+		}
+	}
+	if n := upstream.requests(); n != 3 {
+		t.Errorf("upstream got %d requests, want 3", n)
+	}
+	if n := p.cache.len(); n != 1 {
+		t.Errorf("cache holds %d entries, want 1", n)
+	}
+
+	for host, want := range map[string]bool{"img.cdn.example": true, "IMG.CDN.example": true, "cdn.example": false, "example.com": false} {
+		if got := p.hostCacheable(host); got != want {
+			t.Errorf("hostCacheable(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestCacheableContentTypes(t *testing.T) {
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		fetched[req.URL.Query().Get("type")]++
+		mu.Unlock()
+		res.Header().Set("Content-Type", req.URL.Query().Get("type"))
+		res.Write([]byte("body"))
+	})
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, CacheableContentTypes: []string{"text/*", "application/json"}})
+
+	for contentType, cached := range map[string]bool{
+		"text/html; charset=utf-8": true,
+		"Text/CSS":                 true,
+		"application/json":         true,
+		"application/json-seq":     false,
+		"application/octet-stream": false,
+		"video/mp4":                false,
+	} {
+		target := u.String() + "/?type=" + url.QueryEscape(contentType)
+		get(p, target)
+		get(p, target)
+		mu.Lock()
+		n := fetched[contentType]
+		mu.Unlock()
+		if want := map[bool]int{true: 1, false: 2}[cached]; n != want {
+			t.Errorf("%s: upstream got %d requests, want %d", contentType, n, want)
+		}
+	}
+}
+
+func TestImmutableIgnoresClientNoCache(t *testing.T) {
+	immutableAsset := &countingHandler{body: "v1", header: http.Header{"Cache-Control": {"max-age=3600, immutable"}}}
+	ordinary := &countingHandler{body: "v1", header: http.Header{"Cache-Control": {"max-age=3600"}}}
+	p := newTestProxy(t, Config{XCacheHeader: true})
+
+	asset := newTestUpstream(t, immutableAsset.ServeHTTP).String() + "/app.3f2a.js"
+	get(p, asset)
+	for _, req := range []*http.Request{freshGet(asset), freshGet(asset)} {
+		req.Header.Set("Pragma", "no-cache")
+		if got := serve(p, req).Header().Get("X-Cache"); got != "HIT" {
+			t.Errorf("immutable entry with no-cache: X-Cache %q, want HIT", got)
+		}
+	}
+	if n := immutableAsset.requests(); n != 1 {
+		t.Errorf("immutable upstream got %d requests, want 1", n)
+	}
+
+	target := newTestUpstream(t, ordinary.ServeHTTP).String() + "/app.js"
+	get(p, target)
+	if got := serve(p, freshGet(target)).Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("ordinary entry with no-cache: X-Cache %q, want MISS", got)
+	}
+	if n := ordinary.requests(); n != 2 {
+		t.Errorf("ordinary upstream got %d requests, want 2", n)
+	}
+
+	// Once expired, an immutable entry is fetched again like any other.
+	for _, e := range p.cache.entries() {
+		e.expires = time.Now().Add(-time.Second)
+		e.staleUntil = e.expires
+	}
+	if got := serve(p, freshGet(asset)).Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("expired immutable entry with no-cache: X-Cache %q, want MISS", got)
+	}
+	if n := immutableAsset.requests(); n != 2 {
+		t.Errorf("immutable upstream got %d requests, want 2", n)
+	}
+}
+
+func TestCacheBypassMethods(t *testing.T) {
+	upstream := &countingHandler{body: "fresh"}
+	u := newTestUpstream(t, upstream.ServeHTTP)
+	target := u.String() + "/page"
+	p := newTestProxy(t, Config{XCacheHeader: true, CacheBypassMethods: []string{"GET", "PUT"}})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	// A bypassed GET neither reads an entry that is there...
+	parsed, _ := url.Parse(target)
+	seed := func(p *Proxy) {
+		identity := p.cacheIdentity(parsed, http.Header{}, nil)
+		e := testEntry(p.cacheKey(identity), "cached")
+		e.identity = identity
+		p.cache.add(e)
+	}
+	seed(p)
+	for i := 0; i < 2; i++ {
+		rec := get(p, target)
+		if rec.Body.String() != "fresh" || rec.Header().Get("X-Cache") != "BYPASS" {
+			t.Errorf("GET %d: X-Cache %q, body %q, want a BYPASS from upstream", i, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+	}
+	// ...nor stores one.
+	if n := p.cache.len(); n != 1 {
+		t.Errorf("cache holds %d entries, want only the seeded one", n)
+	}
+	if n := upstream.requests(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+	if n := m.counter("proxy_cache_bypass_total{reason=method}"); n != 2 {
+		t.Errorf("proxy_cache_bypass_total{reason=method} = %d, want 2", n)
+	}
+
+	// Without the bypass the seeded entry is served.
+	p = newTestProxy(t, Config{XCacheHeader: true})
+	seed(p)
+	if rec := get(p, target); rec.Body.String() != "cached" {
+		t.Errorf("GET without the bypass: X-Cache %q, body %q, want the seeded entry", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	if _, err := NewProxy(Config{CacheBypassMethods: []string{"POST"}, CachePOSTHeader: "X-Cache-POST"}); err == nil {
+		t.Error("NewProxy accepted POST caching with POST in -cache-bypass-methods")
+	}
+}
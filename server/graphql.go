@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// graphQLRequest is the JSON body of a GraphQL POST.
+type graphQLRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+}
+
+// graphQLOperation is one operation defined in a GraphQL document.
+type graphQLOperation struct {
+	kind string // query, mutation or subscription
+	name string
+}
+
+// graphQLEndpoint reports whether POSTs to u are parsed as GraphQL for
+// caching, by -cache-graphql-paths.
+func (p *Proxy) graphQLEndpoint(u *url.URL) bool {
+	for _, path := range p.cfg.CacheGraphQLPaths {
+		if u.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// graphQLCacheKey returns what identifies a GraphQL POST body for the cache
+// key: its query, operation name and variables, re-encoded so that
+// variables differing only in key order or spacing share an entry. Only
+// query operations are cached; for anything else, including bodies this
+// can't parse, batches and persisted queries sent without their text, it
+// returns the reason to bypass the cache instead.
+func graphQLCacheKey(body []byte) ([]byte, string) {
+	var gql graphQLRequest
+	if err := json.Unmarshal(body, &gql); err != nil || gql.Query == "" {
+		return nil, "graphql"
+	}
+	kind, ok := graphQLOperationKind(gql.Query, gql.OperationName)
+	if !ok {
+		return nil, "graphql"
+	}
+	if kind != "query" {
+		return nil, "graphql-" + kind
+	}
+
+	var variables interface{}
+	if len(gql.Variables) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(gql.Variables))
+		dec.UseNumber()
+		if err := dec.Decode(&variables); err != nil {
+			return nil, "graphql"
+		}
+	}
+	key, err := json.Marshal(struct {
+		Query         string      `json:"query"`
+		OperationName string      `json:"operationName"`
+		Variables     interface{} `json:"variables"`
+	}{gql.Query, gql.OperationName, variables})
+	if err != nil {
+		return nil, "graphql"
+	}
+	return key, ""
+}
+
+// graphQLOperationKind returns the kind of the operation a request runs:
+// the one named operationName, or the document's only operation when
+// operationName is empty.
+func graphQLOperationKind(query, operationName string) (string, bool) {
+	ops, ok := graphQLOperations(query)
+	if !ok {
+		return "", false
+	}
+	if operationName == "" {
+		if len(ops) != 1 {
+			return "", false
+		}
+		return ops[0].kind, true
+	}
+	for _, op := range ops {
+		if op.name == operationName {
+			return op.kind, true
+		}
+	}
+	return "", false
+}
+
+// graphQLOperations lists the operations defined in a GraphQL document. It
+// reads only as much of the syntax as that takes: it skips comments,
+// strings, selection sets and variable definitions, and expects each
+// top-level definition to be an operation, a fragment or a shorthand query
+// ({ ... }). It reports false for anything else, such as unbalanced
+// brackets or schema definitions.
+func graphQLOperations(query string) ([]graphQLOperation, bool) {
+	var (
+		ops    []graphQLOperation
+		depth  int    // open braces
+		parens int    // open parentheses
+		header string // keyword of the definition whose header is being read
+		named  bool   // whether the header's name has been read
+	)
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '#':
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], `"""`):
+			i += 3
+			for i < len(query) && !strings.HasPrefix(query[i:], `"""`) {
+				if strings.HasPrefix(query[i:], `\"""`) {
+					i++
+				}
+				i++
+			}
+			i += 3
+		case c == '"':
+			i++
+			for i < len(query) && query[i] != '"' && query[i] != '\n' {
+				if query[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+		case c == '{':
+			if depth == 0 && parens == 0 {
+				if header == "" {
+					ops = append(ops, graphQLOperation{kind: "query"})
+				}
+				header = ""
+			}
+			depth++
+			i++
+		case c == '}':
+			if depth--; depth < 0 {
+				return nil, false
+			}
+			i++
+		case c == '(':
+			parens++
+			i++
+		case c == ')':
+			if parens--; parens < 0 {
+				return nil, false
+			}
+			i++
+		case c == '@':
+			// A directive's name is never the operation's.
+			for i++; i < len(query) && isGraphQLNameChar(query[i]); i++ {
+			}
+		case isGraphQLNameStart(c):
+			j := i + 1
+			for j < len(query) && isGraphQLNameChar(query[j]) {
+				j++
+			}
+			name := query[i:j]
+			i = j
+			if depth > 0 || parens > 0 {
+				continue
+			}
+			switch {
+			case header == "" && (name == "query" || name == "mutation" || name == "subscription"):
+				ops = append(ops, graphQLOperation{kind: name})
+				header, named = name, false
+			case header == "" && name == "fragment":
+				header, named = name, true
+			case header == "":
+				return nil, false
+			case !named:
+				ops[len(ops)-1].name = name
+				named = true
+			}
+		default:
+			i++
+		}
+	}
+	return ops, depth == 0 && parens == 0 && header == ""
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return isGraphQLNameStart(c) || '0' <= c && c <= '9'
+}
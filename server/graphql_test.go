@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLCacheKey(t *testing.T) {
+	a, reason := graphQLCacheKey([]byte(`{"query":"query Q { a }","variables":{"x":1,"y":"z"}}`))
+	if reason != "" {
+		t.Fatalf("query bypassed with %q", reason)
+	}
+	b, _ := graphQLCacheKey([]byte(`{ "variables": {"y": "z", "x": 1}, "query": "query Q { a }" }`))
+	if !bytes.Equal(a, b) {
+		t.Errorf("keys differ for reordered variables:\n%s\n%s", a, b)
+	}
+	c, _ := graphQLCacheKey([]byte(`{"query":"query Q { a }","variables":{"x":2,"y":"z"}}`))
+	if bytes.Equal(a, c) {
+		t.Error("keys equal for different variables")
+	}
+
+	for body, want := range map[string]string{
+		`{"query":"mutation M { a }"}`:               "graphql-mutation",
+		`{"query":"subscription S { a }"}`:           "graphql-subscription",
+		`[{"query":"{ a }"}]`:                        "graphql",
+		`not json`:                                   "graphql",
+		`{"query":"query A { a } mutation B { b }"}`: "graphql",
+		`{"query":"query A { a } mutation B { b }","operationName":"B"}`: "graphql-mutation",
+	} {
+		if _, reason := graphQLCacheKey([]byte(body)); reason != want {
+			t.Errorf("graphQLCacheKey(%s) bypass %q, want %q", body, reason, want)
+		}
+	}
+}
+
+func TestGraphQLQueriesCachedMutationsNot(t *testing.T) {
+	upstream := &flakyUpstream{}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/graphql"
+	p := newTestProxy(t, Config{CacheGraphQLPaths: []string{"/graphql"}, XCacheHeader: true})
+
+	post := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		return serve(p, req).Header().Get("X-Cache")
+	}
+	query := `{"query":"{ a }","variables":{"x":1,"y":2}}`
+	if got := post(query); got != "MISS" {
+		t.Errorf("first query: X-Cache %q, want MISS", got)
+	}
+	if got := post(`{"variables":{"y":2,"x":1},"query":"{ a }"}`); got != "HIT" {
+		t.Errorf("same query, variables reordered: X-Cache %q, want HIT", got)
+	}
+	mutation := `{"query":"mutation { a }"}`
+	post(mutation)
+	post(mutation)
+	if n := len(upstream.received()); n != 3 {
+		t.Errorf("upstream got %d requests, want 3", n)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// isGRPC reports whether header describes a gRPC message, such as
+// application/grpc or application/grpc+proto.
+func isGRPC(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+"))
+}
+
+// grpcTransport sends gRPC requests over HTTP/2 whatever -upstream-http2
+// says: with TLS for https upstreams and cleartext (h2c) for http ones, as
+// gRPC services usually expect.
+type grpcTransport struct {
+	tls       *http2.Transport
+	cleartext *http2.Transport
+}
+
+func (p *Proxy) newGRPCClient() *http.Client {
+	dial := p.upstreamDial()
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.cfg.InsecureUpstream}
+	t := grpcTransport{
+		tls: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		},
+		cleartext: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		},
+	}
+	return &http.Client{
+		Transport: t,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (t grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.cleartext.RoundTrip(req)
+	}
+	return t.tls.RoundTrip(req)
+}
+
+// forwardGRPC relays a gRPC call to target, streaming both bodies and
+// passing the response trailers, which carry grpc-status, through. Calls
+// are never cached, scanned, compressed or mirrored.
+func (p *Proxy) forwardGRPC(res http.ResponseWriter, req *http.Request, target *url.URL, selected *backend, start time.Time) {
+	p.metrics.IncCounter("proxy_cache_bypass_total", map[string]string{"reason": "grpc"})
+
+	proxyReq, err := http.NewRequestWithContext(req.Context(), req.Method, target.String(), req.Body)
+	if err != nil {
+		http.Error(res, "Failed to create request", http.StatusInternalServerError)
+		return
+	}
+	proxyReq.Header = p.outboundHeader(req.Header, req.ProtoMajor, req.ProtoMinor)
+	// TE is hop-by-hop, but gRPC servers require "TE: trailers" on every
+	// hop to know the client can receive grpc-status.
+	proxyReq.Header.Set("Te", "trailers")
+	frameOutbound(proxyReq, req)
+	proxyReq.Trailer = req.Trailer
+
+	p.countUpstreamRequest()
+	resp, err := p.grpcClient.Do(proxyReq)
+	if err != nil && selected != nil {
+		p.backends.markDown(selected)
+		p.logEvent("Marked backend %s down for %v", selected.url.Host, backendRetryAfter)
+	}
+	if err != nil {
+		http.Error(res, "Failed to forward request", http.StatusBadGateway)
+		p.logEvent("Failed to forward gRPC call: %s, error: %v", req.RequestURI, err)
+		p.metrics.IncCounter("proxy_upstream_errors_total", map[string]string{"reason": "forward"})
+		return
+	}
+	defer resp.Body.Close()
+	p.prepareResponseHeader(resp)
+
+	n, err := streamResponse(res, resp)
+	if err != nil {
+		p.logEvent("gRPC call ended with error: %s, error: %v", req.RequestURI, err)
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	p.logEvent("Streamed gRPC call %s, %d bytes, grpc-status %s in %v", req.RequestURI, n, status, time.Since(start))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcFrame wraps msg in gRPC's length-prefixed message framing.
+func grpcFrame(msg string) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// readGRPCFrame reads one length-prefixed message from r.
+func readGRPCFrame(r io.Reader) (string, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return "", err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+// newH2CServer serves h over cleartext HTTP/2 until the test ends.
+func newH2CServer(t *testing.T, h http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGRPCUnaryCall(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newH2CServer(t, http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		if req.ProtoMajor != 2 || req.Header.Get("Te") != "trailers" {
+			t.Errorf("upstream got %s with TE %q, want HTTP/2 with TE trailers", req.Proto, req.Header.Get("Te"))
+		}
+		name, err := readGRPCFrame(req.Body)
+		if err != nil {
+			t.Errorf("reading request message: %v", err)
+		}
+		res.Header().Set("Content-Type", "application/grpc")
+		res.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		res.Write(grpcFrame("hello, " + name))
+		res.Header().Set("Grpc-Status", "0")
+		res.Header().Set("Grpc-Message", "OK")
+	}))
+	target, _ := url.Parse(upstream.URL)
+	proxy := newH2CServer(t, newTestProxy(t, Config{DefaultUpstream: target}))
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/greeter.Greeter/SayHello", bytes.NewReader(grpcFrame("gopher")))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		reply, err := readGRPCFrame(resp.Body)
+		if err != nil {
+			t.Fatalf("call %d: reading reply: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if reply != "hello, gopher" {
+			t.Errorf("call %d: reply %q, want %q", i, reply, "hello, gopher")
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Errorf("call %d: grpc-status trailer %q, want 0", i, got)
+		}
+		if got := resp.Trailer.Get("Grpc-Message"); got != "OK" {
+			t.Errorf("call %d: grpc-message trailer %q, want OK", i, got)
+		}
+	}
+	// gRPC calls are never answered from the cache.
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream got %d calls, want 2", n)
+	}
+}
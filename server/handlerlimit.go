@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// limitHandlers caps how many requests and tunnels the proxy handles at
+// once, across all clients, at -max-handlers. Each holds goroutines and
+// buffers while it runs, and a tunnel holds its slot until it closes. A
+// request arriving when every slot is taken waits up to
+// -handler-queue-timeout for one, then is shed with 503.
+func (p *Proxy) limitHandlers(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if p.handlerSlots == nil {
+			next(res, req)
+			return
+		}
+		if !p.acquireHandlerSlot(req) {
+			http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+			p.logEvent("Shed %s from %s: all %d handler slots busy", req.RequestURI, p.clientIP(req), cap(p.handlerSlots))
+			p.metrics.IncCounter("proxy_handler_shed_total", nil)
+			return
+		}
+		defer func() {
+			<-p.handlerSlots
+			p.reportHandlers()
+		}()
+		p.reportHandlers()
+		next(res, req)
+	}
+}
+
+// acquireHandlerSlot takes a slot, waiting up to -handler-queue-timeout,
+// and reports whether it got one before then or before the client left.
+func (p *Proxy) acquireHandlerSlot(req *http.Request) bool {
+	select {
+	case p.handlerSlots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(p.cfg.HandlerQueueTimeout)
+	defer timer.Stop()
+	select {
+	case p.handlerSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// reportHandlers updates the gauges of handler slots in use and of the
+// process's goroutines.
+func (p *Proxy) reportHandlers() {
+	p.metrics.SetGauge("proxy_active_handlers", float64(len(p.handlerSlots)), nil)
+	p.metrics.SetGauge("proxy_goroutines", float64(runtime.NumGoroutine()), nil)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingUpstream holds every request until release is closed, signalling
+// arrived as each one comes in.
+func blockingUpstream(t *testing.T) (target string, arrived chan struct{}, release chan struct{}) {
+	arrived = make(chan struct{}, 16)
+	release = make(chan struct{})
+	target = newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		res.Write([]byte("done"))
+	}).String()
+	return target, arrived, release
+}
+
+func TestMaxHandlersShedsBeyondCeiling(t *testing.T) {
+	target, arrived, release := blockingUpstream(t)
+	p := newTestProxy(t, Config{MaxHandlers: 2, HandlerQueueTimeout: 50 * time.Millisecond})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = get(p, fmt.Sprintf("%s/held/%d", target, i)).Code
+		}(i)
+	}
+	for range codes {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatal("held requests never reached upstream")
+		}
+	}
+	if got := m.gauge("proxy_active_handlers"); got != 2 {
+		t.Errorf("proxy_active_handlers %v with the ceiling reached, want 2", got)
+	}
+	if m.gauge("proxy_goroutines") == 0 {
+		t.Error("proxy_goroutines not reported")
+	}
+
+	start := time.Now()
+	if code := get(p, target+"/shed").Code; code != http.StatusServiceUnavailable {
+		t.Errorf("request beyond the ceiling: status %d, want 503", code)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("request was shed after %v, before the queue timeout", waited)
+	}
+	if n := m.counter("proxy_handler_shed_total"); n != 1 {
+		t.Errorf("proxy_handler_shed_total %d, want 1", n)
+	}
+
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("held request %d: status %d, want 200", i, code)
+		}
+	}
+	if got := m.gauge("proxy_active_handlers"); got != 0 {
+		t.Errorf("proxy_active_handlers %v after the held requests finished, want 0", got)
+	}
+	if code := get(p, target+"/after").Code; code != http.StatusOK {
+		t.Errorf("request after slots freed: status %d, want 200", code)
+	}
+}
+
+func TestMaxHandlersQueuesBriefly(t *testing.T) {
+	target, arrived, release := blockingUpstream(t)
+	p := newTestProxy(t, Config{MaxHandlers: 1, HandlerQueueTimeout: 5 * time.Second})
+
+	held := make(chan int)
+	go func() { held <- get(p, target+"/held").Code }()
+	<-arrived
+
+	// A slot that frees up within the queue timeout goes to the waiting
+	// request rather than it being shed.
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	if code := get(p, target+"/queued").Code; code != http.StatusOK {
+		t.Errorf("queued request: status %d, want 200", code)
+	}
+	if code := <-held; code != http.StatusOK {
+		t.Errorf("held request: status %d, want 200", code)
+	}
+}
+
+func TestMaxHandlersShedsLeavingClient(t *testing.T) {
+	target, arrived, release := blockingUpstream(t)
+	defer close(release)
+	p := newTestProxy(t, Config{MaxHandlers: 1, HandlerQueueTimeout: time.Minute})
+
+	go get(p, target+"/held")
+	<-arrived
+
+	req := httptest.NewRequest(http.MethodGet, target+"/gone", nil)
+	ctx, cancel := context.WithTimeout(req.Context(), 50*time.Millisecond)
+	defer cancel()
+	if code := serve(p, req.WithContext(ctx)).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("client that left while queued: status %d, want 503", code)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthChecker probes every backend once per interval with a GET for
+// -health-check-path and takes backends that keep failing out of rotation
+// until they pass again.
+type healthChecker struct {
+	backgroundLoop
+	proxy    *Proxy
+	interval time.Duration
+}
+
+func newHealthChecker(p *Proxy, interval time.Duration) *healthChecker {
+	return &healthChecker{proxy: p, interval: interval}
+}
+
+// Start probes the backends straight away and then once per interval, in
+// the background, until ctx is cancelled or Stop is called. Stopping
+// cancels probes in flight.
+func (c *healthChecker) Start(ctx context.Context) {
+	c.start(ctx, func(ctx context.Context) {
+		c.check(ctx)
+		runEvery(ctx, c.interval, func() { c.check(ctx) })
+	})
+}
+
+// check probes all backends at once, so one slow backend doesn't hold up
+// the others.
+func (c *healthChecker) check(ctx context.Context) {
+	p := c.proxy
+	var wg sync.WaitGroup
+	for _, b := range p.backends.backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			err := p.probe(ctx, b)
+			if ctx.Err() != nil {
+				return
+			}
+			if !p.backends.recordProbe(b, err == nil, p.cfg.HealthCheckFailures, p.cfg.HealthCheckSuccesses) {
+				return
+			}
+			if err != nil {
+				p.logEvent("Backend %s failed %d health checks, marking it down: %v", b.url.Host, p.cfg.HealthCheckFailures, err)
+			} else {
+				p.logEvent("Backend %s passed %d health checks, marking it up", b.url.Host, p.cfg.HealthCheckSuccesses)
+			}
+			p.metrics.IncCounter("proxy_backend_health_changes_total", map[string]string{"backend": b.url.Host})
+		}(b)
+	}
+	wg.Wait()
+}
+
+// probe sends one health check to b, failing unless it answers with
+// -health-check-status within -health-check-timeout.
+func (p *Proxy) probe(ctx context.Context, b *backend) error {
+	if p.cfg.HealthCheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.HealthCheckTimeout)
+		defer cancel()
+	}
+	target := b.url.JoinPath(p.cfg.HealthCheckPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != p.cfg.HealthCheckStatus {
+		return fmt.Errorf("got status %d, want %d", resp.StatusCode, p.cfg.HealthCheckStatus)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// healthStats returns each backend's health from /stats, keyed by URL.
+func healthStats(t *testing.T, p *Proxy) map[string]bool {
+	t.Helper()
+	rec := serve(p, adminRequest(http.MethodGet, "/stats"))
+	var s stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatalf("GET /stats: status %d, %v", rec.Code, err)
+	}
+	healthy := make(map[string]bool)
+	for _, b := range s.Backends {
+		healthy[b.URL] = b.Healthy
+	}
+	return healthy
+}
+
+func TestHealthCheckMarksBackendDown(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	backend := func(name string, fails *atomic.Bool) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/healthz" && fails.Load() {
+				http.Error(res, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			res.Write([]byte(name))
+		}
+	}
+	good := newTestUpstream(t, backend("good", &atomic.Bool{}))
+	bad := newTestUpstream(t, backend("bad", &failing))
+	backends, err := parseBackends(good.String() + "," + bad.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{
+		Backends:             backends,
+		HealthCheckPath:      "/healthz",
+		HealthCheckFailures:  2,
+		HealthCheckSuccesses: 2,
+		LogFile:              logs,
+	})
+	checker := newHealthChecker(p, time.Hour)
+	ctx := context.Background()
+
+	// One failed probe isn't enough to take the backend out.
+	checker.check(ctx)
+	if !healthStats(t, p)[bad.String()] {
+		t.Fatal("backend marked down after one failed probe")
+	}
+	checker.check(ctx)
+	if healthy := healthStats(t, p); healthy[bad.String()] || !healthy[good.String()] {
+		t.Fatalf("after two failed probes: health %v, want only %s down", healthy, bad)
+	}
+	if len(logs.lines("Backend "+bad.Host+" failed 2 health checks, marking it down")) != 1 {
+		t.Errorf("marking down wasn't logged:\n%s", logs)
+	}
+	for i := 0; i < 4; i++ {
+		if body := serve(p, originGet("/")).Body.String(); body != "good" {
+			t.Errorf("request %d went to %q, want good", i, body)
+		}
+	}
+
+	// It comes back after two passing probes in a row.
+	failing.Store(false)
+	checker.check(ctx)
+	if healthStats(t, p)[bad.String()] {
+		t.Fatal("backend marked up after one passing probe")
+	}
+	checker.check(ctx)
+	if !healthStats(t, p)[bad.String()] {
+		t.Fatal("backend still down after two passing probes")
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		seen[serve(p, originGet("/")).Body.String()] = true
+	}
+	if !seen["bad"] {
+		t.Errorf("recovered backend got no requests, saw %v", seen)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	slow := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+	})
+	backends, err := parseBackends(slow.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{Backends: backends, HealthCheckPath: "/healthz", HealthCheckTimeout: 50 * time.Millisecond})
+	start := time.Now()
+	if err := p.probe(context.Background(), backends[0]); err == nil {
+		t.Error("probe of a slow backend succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("probe took %v, want it cut off at the timeout", elapsed)
+	}
+}
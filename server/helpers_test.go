@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestProxy builds a Proxy from cfg, failing the test if cfg is invalid.
+// The rate limit is raised out of the way unless the test sets one.
+func newTestProxy(t testing.TB, cfg Config) *Proxy {
+	t.Helper()
+	if cfg.RateLimit == 0 {
+		cfg.RateLimit = 1 << 30
+	}
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatalf("NewProxy: %v", err)
+	}
+	return p
+}
+
+// newTestUpstream serves h until the test ends and returns its URL.
+func newTestUpstream(t testing.TB, h http.HandlerFunc) *url.URL {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// serve sends req through p and returns the recorded response.
+func serve(p *Proxy, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	return rec
+}
+
+// get sends a proxied GET for the absolute URL target through p.
+func get(p *Proxy, target string) *httptest.ResponseRecorder {
+	return serve(p, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// countingHandler answers every request with body and counts the requests.
+type countingHandler struct {
+	mu     sync.Mutex
+	count  int
+	header http.Header
+	body   string
+}
+
+func (h *countingHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	h.count++
+	h.mu.Unlock()
+	for name, values := range h.header {
+		res.Header()[name] = values
+	}
+	res.Write([]byte(h.body))
+}
+
+func (h *countingHandler) requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// logBuffer collects a proxy's log file; writes from concurrent requests
+// are safe.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// lines returns the logged lines containing substr.
+func (b *logBuffer) lines(substr string) []string {
+	var found []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.Contains(line, substr) {
+			found = append(found, line)
+		}
+	}
+	return found
+}
+
+// recordingMetrics is a Metrics sink that remembers every call, keyed by
+// metric name and sorted labels, e.g. `proxy_cache_hits_total` or
+// `proxy_requests_total{cache=miss}`.
+type recordingMetrics struct {
+	mu        sync.Mutex
+	counters  map[string]int
+	durations map[string][]time.Duration
+	sizes     map[string][]int64
+	gauges    map[string]float64
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		counters:  make(map[string]int),
+		durations: make(map[string][]time.Duration),
+		sizes:     make(map[string][]int64),
+		gauges:    make(map[string]float64),
+	}
+}
+
+func metricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *recordingMetrics) IncCounter(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[metricKey(name, labels)]++
+}
+
+func (m *recordingMetrics) ObserveDuration(name string, d time.Duration, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey(name, labels)
+	m.durations[key] = append(m.durations[key], d)
+}
+
+func (m *recordingMetrics) ObserveSize(name string, bytes int64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey(name, labels)
+	m.sizes[key] = append(m.sizes[key], bytes)
+}
+
+func (m *recordingMetrics) SetGauge(name string, value float64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[metricKey(name, labels)] = value
+}
+
+func (m *recordingMetrics) counter(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[key]
+}
+
+func (m *recordingMetrics) gauge(key string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gauges[key]
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders apply only to a single connection and are never passed
+// between the client and upstream sides of the proxy (RFC 9110 section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes the hop-by-hop headers from header, along with any
+// header the Connection header names, so persistence on one side of the
+// proxy is negotiated independently of the other. net/http then handles
+// keep-alive for each connection itself, including HTTP/1.0 clients that
+// must ask for it with an explicit Connection: keep-alive.
+func removeHopByHop(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	stripHeaders(header, hopByHopHeaders)
+}
+
+// keepHeaders deletes every header not in names from an outbound request
+// header. Framing does not depend on it: the body length and Host are set
+// from the request itself, not copied headers. Unless kept, User-Agent is
+// left present but empty, which stops net/http sending its own.
+func keepHeaders(header http.Header, names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range header {
+		if !keep[name] {
+			delete(header, name)
+		}
+	}
+	if !keep["User-Agent"] {
+		header["User-Agent"] = []string{""}
+	}
+}
+
+// stripHeaders deletes every header in names from header.
+func stripHeaders(header http.Header, names []string) {
+	for _, name := range names {
+		header.Del(name)
+	}
+}
+
+// outboundHeader returns the header to send upstream for a client request
+// with header in, received over proto version major.minor: hop-by-hop and
+// -strip-request-headers dropped, -forward-headers filtered, the proxy's
+// own control headers removed and Via added. Forwarded requests, gRPC calls
+// and background revalidations all build their headers here, so a rule
+// added for one applies to every request the proxy sends upstream.
+func (p *Proxy) outboundHeader(in http.Header, major, minor int) http.Header {
+	out := in.Clone()
+	if out == nil {
+		out = make(http.Header)
+	}
+	// Client and upstream connections are managed apart: a client's
+	// Connection: close ends only its own connection, which net/http
+	// handles, and is dropped here with the other hop-by-hop headers so the
+	// upstream connection goes back to the pool.
+	removeHopByHop(out)
+	stripHeaders(out, p.cfg.StripRequestHeaders)
+	if len(p.cfg.ForwardHeadersAllowlist) > 0 {
+		keepHeaders(out, p.cfg.ForwardHeadersAllowlist)
+	}
+	out.Del("X-Proxy-Debug")
+	if p.cfg.XUpstreamHeader {
+		out.Del("X-Upstream")
+	}
+	if p.cfg.CachePOSTHeader != "" {
+		out.Del(p.cfg.CachePOSTHeader)
+	}
+	if p.cfg.Scanner != nil {
+		// Let the transport negotiate compression so the body it hands back
+		// is decoded and can be scanned.
+		out.Del("Accept-Encoding")
+	}
+	p.addVia(out, major, minor)
+	return out
+}
+
+// prepareResponseHeader readies the header of a response from upstream for
+// the client and the cache, on every path that receives one.
+func (p *Proxy) prepareResponseHeader(resp *http.Response) {
+	removeHopByHop(resp.Header)
+	stripHeaders(resp.Header, p.cfg.StripResponseHeaders)
+	p.addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRemoveHopByHop(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"close, X-Session", "Foo"},
+		"X-Session":         {"abc"},
+		"Foo":               {"bar"},
+		"Keep-Alive":        {"timeout=5"},
+		"Te":                {"trailers"},
+		"Transfer-Encoding": {"chunked"},
+		"Upgrade":           {"websocket"},
+		"Accept":            {"*/*"},
+	}
+	removeHopByHop(header)
+	if len(header) != 1 || header.Get("Accept") != "*/*" {
+		t.Errorf("left %v, want only Accept", header)
+	}
+}
+
+// TestClientConnectionCloseKeepsUpstreamPool checks that a client's
+// Connection: close ends its own connection without reaching upstream, where
+// the pooled connection is reused by the next client.
+func TestClientConnectionCloseKeepsUpstreamPool(t *testing.T) {
+	var seen []string
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		seen = append(seen, req.Header.Get("Connection")+req.Header.Get("X-Session"))
+		res.Write([]byte("hello"))
+	}).String() + "/page"
+	p := newTestProxy(t, Config{})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close, X-Session\r\nX-Session: abc\r\nCache-Control: no-cache\r\n\r\n", target, conn.RemoteAddr())
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		io.ReadAll(resp.Body)
+		if !resp.Close {
+			t.Errorf("request %d: response doesn't say the connection closes", i)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Errorf("request %d: client connection read %v, want EOF", i, err)
+		}
+	}
+
+	// The client's Connection header and what it names stay on its side...
+	for i, s := range seen {
+		if s != "" {
+			t.Errorf("upstream request %d got Connection and X-Session %q", i, s)
+		}
+	}
+	// ...and the upstream connection outlives both client connections.
+	if stats := p.upstreamConns.upstreamStats(); len(stats) != 1 || stats[0].Dialed != 1 || stats[0].Reused != 1 {
+		t.Errorf("upstream stats %+v, want one connection dialed and reused once", stats)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// canonicalHost lowercases a host[:port] authority and drops the port when
+// it is the default for scheme, so equivalent spellings of a host share
+// cache entries and are matched alike against -allowed-hosts.
+func canonicalHost(scheme, hostport string) string {
+	hostport = strings.ToLower(hostport)
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return hostport
+}
+
+// hostAllowed reports whether host matches -allowed-hosts, which allows
+// every host when empty.
+func (p *Proxy) hostAllowed(host string) bool {
+	if len(p.cfg.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range p.cfg.AllowedHosts {
+		if globMatch(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedHosts(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	u := newTestUpstream(t, upstream.ServeHTTP)
+	_, port, _ := net.SplitHostPort(u.Host)
+	p := newTestProxy(t, Config{AllowedHosts: []string{"127.0.0.1", "*.api.example"}})
+
+	if rec := get(p, u.String()+"/"); rec.Code != http.StatusOK {
+		t.Errorf("allowed host: status %d, want 200", rec.Code)
+	}
+	if rec := get(p, "http://localhost:"+port+"/"); rec.Code != http.StatusBadRequest {
+		t.Errorf("disallowed host: status %d, want 400", rec.Code)
+	}
+	// Origin-form requests are checked against their Host header.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "localhost:" + port
+	if rec := serve(p, req); rec.Code != http.StatusBadRequest {
+		t.Errorf("disallowed origin-form Host: status %d, want 400", rec.Code)
+	}
+	if rec := serve(p, connectRequest("localhost:"+port)); rec.Code != http.StatusBadRequest {
+		t.Errorf("CONNECT to a disallowed host: status %d, want 400", rec.Code)
+	}
+	if n := upstream.requests(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+
+	for host, want := range map[string]bool{"v1.api.example": true, "V1.API.example": true, "api.example": false, "evil.example": false} {
+		if got := p.hostAllowed(host); got != want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestConflictingHostRejected(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	u := newTestUpstream(t, upstream.ServeHTTP)
+	p := newTestProxy(t, Config{})
+
+	req := httptest.NewRequest(http.MethodGet, u.String()+"/", nil)
+	req.Host = "internal.example"
+	if rec := serve(p, req); rec.Code != http.StatusBadRequest {
+		t.Errorf("Host conflicting with the target: status %d, want 400", rec.Code)
+	}
+	// The same host spelled differently is not a conflict.
+	req = httptest.NewRequest(http.MethodGet, "http://LOCALHOST:80/", nil)
+	req.Host = "localhost"
+	if got, _, err := requestURL(req); err != nil || got.Host != "localhost" {
+		t.Errorf("requestURL = %v, %v; want host localhost", got, err)
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("upstream got %d requests, want 0", n)
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	for _, c := range []struct{ scheme, in, want string }{
+		{"http", "Example.COM:80", "example.com"},
+		{"https", "example.com:443", "example.com"},
+		{"http", "example.com:443", "example.com:443"},
+		{"https", "[2001:DB8::1]:443", "[2001:db8::1]"},
+		{"http", "example.com", "example.com"},
+	} {
+		if got := canonicalHost(c.scheme, c.in); got != c.want {
+			t.Errorf("canonicalHost(%q, %q) = %q, want %q", c.scheme, c.in, got, c.want)
+		}
+	}
+}
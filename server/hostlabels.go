@@ -0,0 +1,49 @@
+package main
+
+import "sync"
+
+// otherHostLabel stands in for every host past -metrics-host-limit.
+const otherHostLabel = "other"
+
+// hostLabeler hands out host label values, one per distinct host for the
+// first limit hosts seen and otherHostLabel for the rest, so a client
+// requesting many hosts can't grow the metric series without bound.
+type hostLabeler struct {
+	limit int
+	mu    sync.RWMutex
+	hosts map[string]bool
+}
+
+func newHostLabeler(limit int) *hostLabeler {
+	return &hostLabeler{limit: limit, hosts: make(map[string]bool)}
+}
+
+// label returns the label value for host.
+func (l *hostLabeler) label(host string) string {
+	l.mu.RLock()
+	known := l.hosts[host]
+	l.mu.RUnlock()
+	if known {
+		return host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hosts[host] {
+		return host
+	}
+	if len(l.hosts) >= l.limit {
+		return otherHostLabel
+	}
+	l.hosts[host] = true
+	return host
+}
+
+// hostLabels adds a host label for host to labels when -metrics-host-limit
+// is set.
+func (p *Proxy) hostLabels(labels map[string]string, host string) map[string]string {
+	if p.hostLabeler != nil {
+		labels["host"] = p.hostLabeler.label(host)
+	}
+	return labels
+}
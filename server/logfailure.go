@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// recordLogWrite tracks the outcome of a log file write. A failure is
+// always counted, and reported on stderr when writes start failing; a later
+// successful write clears the failure.
+func (p *Proxy) recordLogWrite(err error) {
+	if err == nil {
+		if p.logWriteFailing.Swap(false) {
+			fmt.Fprintln(os.Stderr, "Log file writes recovered")
+		}
+		return
+	}
+	p.metrics.IncCounter("proxy_log_write_errors_total", nil)
+	if !p.logWriteFailing.Swap(true) {
+		fmt.Fprintf(os.Stderr, "ALERT: failed to write log file, events are being lost: %v\n", err)
+	}
+}
+
+// failClosed answers 503 while log writes are failing and -log-fail-closed
+// is set. Each rejection is itself logged, which retries the log file and
+// reopens the proxy once writes succeed again.
+func (p *Proxy) failClosed(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if p.cfg.LogFailClosed && p.logWriteFailing.Load() {
+			http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+			p.logEvent("Rejected %s %s from %s: log file is not writable", req.Method, req.RequestURI, p.clientIP(req))
+			return
+		}
+		next(res, req)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// brokenLog fails every write while broken is set, like a full disk.
+type brokenLog struct {
+	broken atomic.Bool
+}
+
+func (l *brokenLog) Write(p []byte) (int, error) {
+	if l.broken.Load() {
+		return 0, errors.New("no space left on device")
+	}
+	return len(p), nil
+}
+
+func TestLogFailClosed(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &brokenLog{}
+	metrics := newRecordingMetrics()
+	p := newTestProxy(t, Config{LogFile: logs, LogFailClosed: true})
+	p.metrics = metrics
+
+	logs.broken.Store(true)
+	p.logEvent("disk fills up")
+	for i := 0; i < 2; i++ {
+		if rec := get(p, target); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("request %d while the log fails: status %d, want 503", i, rec.Code)
+		}
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("upstream got %d requests while the log failed", n)
+	}
+	if n := metrics.counter("proxy_log_write_errors_total"); n < 3 {
+		t.Errorf("proxy_log_write_errors_total = %d, want at least 3", n)
+	}
+
+	// The next rejection's log line goes through and reopens the proxy.
+	logs.broken.Store(false)
+	get(p, target)
+	if rec := get(p, target); rec.Code != http.StatusOK {
+		t.Errorf("after the log recovers: status %d, want 200", rec.Code)
+	}
+}
+
+func TestLogFailureCountedWhenFailingOpen(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &brokenLog{}
+	metrics := newRecordingMetrics()
+	p := newTestProxy(t, Config{LogFile: logs})
+	p.metrics = metrics
+
+	logs.broken.Store(true)
+	p.logEvent("disk fills up")
+	if rec := get(p, target); rec.Code != http.StatusOK {
+		t.Errorf("without -log-fail-closed: status %d, want 200", rec.Code)
+	}
+	if n := metrics.counter("proxy_log_write_errors_total"); n < 1 {
+		t.Errorf("proxy_log_write_errors_total = %d, want the failure counted", n)
+	}
+	if !p.logWriteFailing.Load() {
+		t.Error("log failure not recorded")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// rejectInMaintenance answers 503 with a Retry-After while maintenance mode
+// is on. The proxy's own endpoints are served before this, so admin and
+// health requests keep working.
+func (p *Proxy) rejectInMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if p.maintenance.Load() {
+			p.setRetryAfter(res.Header())
+			http.Error(res, "Service Unavailable: the proxy is down for maintenance", http.StatusServiceUnavailable)
+			p.logEvent("Rejected %s %s from %s: maintenance mode", req.Method, req.RequestURI, p.clientIP(req))
+			return
+		}
+		next(res, req)
+	}
+}
+
+func (p *Proxy) setRetryAfter(header http.Header) {
+	if seconds := int64(p.cfg.MaintenanceRetryAfter.Seconds()); seconds > 0 {
+		header.Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+}
+
+type maintenanceStatus struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// handleMaintenance turns maintenance mode on or off as the enabled form
+// value says, or toggles it when enabled is absent, and reports the new
+// state.
+func (p *Proxy) handleMaintenance(res http.ResponseWriter, req *http.Request) {
+	enabled := !p.maintenance.Load()
+	if value := req.FormValue("enabled"); value != "" {
+		var err error
+		if enabled, err = strconv.ParseBool(value); err != nil {
+			http.Error(res, "Invalid enabled value", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if p.maintenance.Swap(enabled) != enabled {
+		if enabled {
+			p.logEvent("Maintenance mode on by admin request")
+		} else {
+			p.logEvent("Maintenance mode off by admin request")
+		}
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(maintenanceStatus{Maintenance: enabled})
+}
+
+// handleHealth reports whether the proxy is accepting proxied requests:
+// 200 normally, 503 in maintenance mode.
+func (p *Proxy) handleHealth(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if p.maintenance.Load() {
+		p.setRetryAfter(res.Header())
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte("maintenance\n"))
+		return
+	}
+	res.Write([]byte("ok\n"))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// adminRequest returns a request for the proxy's own path from the loopback
+// address admins use.
+func adminRequest(method, path string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	return req
+}
+
+func TestMaintenanceRejectsProxyingButNotAdmin(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{})
+
+	if rec := serve(p, adminRequest(http.MethodPost, "/admin/maintenance?enabled=true")); rec.Code != http.StatusOK {
+		t.Fatalf("enabling maintenance: status %d", rec.Code)
+	}
+	rec := get(p, target)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("proxied GET in maintenance: status %d, want 503", rec.Code)
+	}
+	if upstream.requests() != 0 {
+		t.Errorf("upstream got %d requests in maintenance, want 0", upstream.requests())
+	}
+	if rec := serve(p, httptest.NewRequest(http.MethodGet, "/healthz", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz in maintenance: status %d, want 503", rec.Code)
+	}
+
+	if rec := serve(p, adminRequest(http.MethodPost, "/admin/maintenance?enabled=false")); rec.Code != http.StatusOK {
+		t.Fatalf("disabling maintenance: status %d", rec.Code)
+	}
+	if rec := get(p, target); rec.Code != http.StatusOK {
+		t.Errorf("proxied GET after maintenance: status %d, want 200", rec.Code)
+	}
+}
+
+func TestMaintenanceRefusesNonAdminClients(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.1.0.0/16")
+	p := newTestProxy(t, Config{AdminAllow: []*net.IPNet{allowed}})
+
+	for _, tc := range []struct {
+		remote string
+		want   int
+	}{
+		{"192.0.2.1:1234", http.StatusForbidden},
+		{"10.2.0.5:1234", http.StatusForbidden},
+		{"10.1.3.4:1234", http.StatusOK},
+		{"[::1]:1234", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/maintenance?enabled=false", nil)
+		req.RemoteAddr = tc.remote
+		if rec := serve(p, req); rec.Code != tc.want {
+			t.Errorf("from %s: status %d, want %d", tc.remote, rec.Code, tc.want)
+		}
+	}
+	if p.maintenance.Load() {
+		t.Error("maintenance mode was turned on")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/maintenance?enabled=true", nil)
+	serve(p, req)
+	if p.maintenance.Load() {
+		t.Error("a non-admin client turned maintenance mode on")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"runtime/metrics"
+	"time"
+)
+
+// memoryCheckInterval is how often the memory watcher samples the heap.
+const memoryCheckInterval = time.Second
+
+// memoryWatcher shrinks the cache when the live heap grows past
+// -cache-memory-fraction of -cache-memory-target, evicting least recently
+// used entries until the cache is smaller by the excess. The live heap is
+// only measured by a garbage collection, so after evicting it waits for the
+// next one before judging again, rather than evicting more for memory that
+// has already been let go.
+type memoryWatcher struct {
+	backgroundLoop
+	proxy    *Proxy
+	interval time.Duration
+	// cycle is the GC cycle count after the last eviction.
+	cycle uint64
+}
+
+func newMemoryWatcher(p *Proxy, interval time.Duration) *memoryWatcher {
+	return &memoryWatcher{proxy: p, interval: interval}
+}
+
+// Start compares the live heap with the memory limit once per interval, in
+// the background, until ctx is cancelled or Stop is called.
+func (w *memoryWatcher) Start(ctx context.Context) {
+	w.start(ctx, func(ctx context.Context) {
+		runEvery(ctx, w.interval, w.check)
+	})
+}
+
+// check evicts from the cache if a garbage collection has run since the
+// last eviction and found the live heap over the limit.
+func (w *memoryWatcher) check() {
+	p := w.proxy
+	samples := []metrics.Sample{{Name: "/gc/heap/live:bytes"}, {Name: "/gc/cycles/total:gc-cycles"}}
+	metrics.Read(samples)
+	live, cycle := int64(samples[0].Value.Uint64()), samples[1].Value.Uint64()
+	if cycle <= w.cycle {
+		return
+	}
+
+	limit := int64(float64(p.cfg.CacheMemoryTarget) * p.cfg.CacheMemoryFraction)
+	if live <= limit {
+		return
+	}
+	size := p.cache.size()
+	target := size - (live - limit)
+	if target < 0 {
+		target = 0
+	}
+	w.cycle = cycle
+	if removed := p.cache.shrink(target); removed > 0 {
+		p.logEvent("Live heap of %d bytes is over %d, evicted %d cache entries (%d bytes)", live, limit, removed, size-p.cache.size())
+		p.metrics.IncCounter("proxy_cache_memory_evictions_total", nil)
+	}
+}
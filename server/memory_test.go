@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+// fillCache adds n entries of 64KiB each to p's cache.
+func fillCache(p *Proxy, n int) {
+	for i := 0; i < n; i++ {
+		body := fmt.Sprintf("%d", i) + strings.Repeat("x", 64<<10)
+		p.cache.add(testEntry(fmt.Sprint("k", i), body))
+	}
+}
+
+func TestMemoryWatcherEvictsUnderPressure(t *testing.T) {
+	logs := &logBuffer{}
+	// A 1MB target is far below what the test binary's heap already holds.
+	p := newTestProxy(t, Config{CacheMemoryTarget: 1 << 20, CacheMemoryFraction: 0.5, LogFile: logs})
+	m := newRecordingMetrics()
+	p.metrics = m
+	fillCache(p, 32)
+	w := newMemoryWatcher(p, memoryCheckInterval)
+	// Only the collections the test runs may measure the heap.
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	runtime.GC()
+	w.check()
+	if n := p.cache.len(); n != 0 {
+		t.Errorf("cache holds %d entries under pressure, want none", n)
+	}
+	if len(logs.lines("evicted 32 cache entries")) != 1 {
+		t.Errorf("eviction wasn't logged:\n%s", logs)
+	}
+	if n := m.counter("proxy_cache_memory_evictions_total"); n != 1 {
+		t.Errorf("proxy_cache_memory_evictions_total = %d, want 1", n)
+	}
+
+	// Until another collection measures the heap, nothing more is evicted.
+	fillCache(p, 8)
+	w.check()
+	if n := p.cache.len(); n != 8 {
+		t.Errorf("cache holds %d entries, want 8 kept until the next GC", n)
+	}
+}
+
+func TestMemoryWatcherLeavesCacheBelowLimit(t *testing.T) {
+	p := newTestProxy(t, Config{CacheMemoryTarget: 1 << 40})
+	fillCache(p, 32)
+	runtime.GC()
+	newMemoryWatcher(p, memoryCheckInterval).check()
+	if n := p.cache.len(); n != 32 {
+		t.Errorf("cache holds %d entries, want all 32 under a 1TB target", n)
+	}
+}
+
+func TestCacheShrink(t *testing.T) {
+	c := newLRUCache(0, 0)
+	for i := 0; i < 64; i++ {
+		c.add(testEntry(fmt.Sprint("k", i), fmt.Sprintf("%03d", i)+strings.Repeat("x", 1000)))
+	}
+	target := c.size() / 2
+	if removed := c.shrink(target); removed == 0 || c.size() > target {
+		t.Errorf("shrink(%d) removed %d entries, leaving %d bytes", target, removed, c.size())
+	}
+	if c.shrink(0); c.len() != 0 || c.size() != 0 {
+		t.Errorf("shrink(0) left %d entries, %d bytes", c.len(), c.size())
+	}
+}
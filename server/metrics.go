@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Metrics records proxy instrumentation. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	IncCounter(name string, labels map[string]string)
+	ObserveDuration(name string, d time.Duration, labels map[string]string)
+	ObserveSize(name string, bytes int64, labels map[string]string)
+	SetGauge(name string, value float64, labels map[string]string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(string, map[string]string)                     {}
+func (noopMetrics) ObserveDuration(string, time.Duration, map[string]string) {}
+func (noopMetrics) ObserveSize(string, int64, map[string]string)             {}
+func (noopMetrics) SetGauge(string, float64, map[string]string)              {}
+
+// newMetrics returns the sink selected by -metrics.
+func newMetrics(kind, statsdAddr string) (Metrics, error) {
+	switch kind {
+	case "", "none":
+		return noopMetrics{}, nil
+	case "prometheus":
+		return newPrometheusMetrics(), nil
+	case "statsd":
+		return newStatsdMetrics(statsdAddr)
+	default:
+		return nil, fmt.Errorf("unknown metrics sink %q, want none, prometheus or statsd", kind)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsPerRequest(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{CacheTTL: time.Minute})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	get(p, target)
+	get(p, target)
+
+	for key, want := range map[string]int{
+		"proxy_requests_total{method=GET}": 2,
+		"proxy_cache_misses_total":         1,
+		"proxy_cache_hits_total":           1,
+		"proxy_rate_limited_total":         0,
+	} {
+		if got := m.counter(key); got != want {
+			t.Errorf("%s = %d, want %d", key, got, want)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range []string{"proxy_request_duration_seconds{cache=miss}", "proxy_request_duration_seconds{cache=hit}"} {
+		if n := len(m.durations[key]); n != 1 {
+			t.Errorf("%s observed %d times, want 1", key, n)
+		}
+	}
+}
+
+func TestRateLimitedRequestMetric(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{RateLimit: 1})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	get(p, target)
+	if code := get(p, target).Code; code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", code)
+	}
+	if n := m.counter("proxy_rate_limited_total"); n != 1 {
+		t.Errorf("proxy_rate_limited_total = %d, want 1", n)
+	}
+	if n := m.counter("proxy_requests_total{method=GET}"); n != 1 {
+		t.Errorf("proxy_requests_total{method=GET} = %d, want only the request let through", n)
+	}
+}
+
+func TestSizeHistograms(t *testing.T) {
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		res.Write(body)
+	}).String() + "/echo"
+	p := newTestProxy(t, Config{})
+	m := newPrometheusMetrics()
+	p.metrics = m
+
+	// Each echoed body lands in its own bucket, both ways.
+	for _, size := range []int{100, 2 << 10, 100 << 10} {
+		if rec := postThrough(p, target, strings.Repeat("x", size)); rec.Body.Len() != size {
+			t.Fatalf("POST of %d bytes: echoed %d", size, rec.Body.Len())
+		}
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	exposition := rec.Body.String()
+	for _, name := range []string{"proxy_request_size_bytes", "proxy_response_size_bytes"} {
+		for _, line := range []string{
+			name + `_bucket{le="256"} 1`,
+			name + `_bucket{le="1024"} 1`,
+			name + `_bucket{le="4096"} 2`,
+			name + `_bucket{le="65536"} 2`,
+			name + `_bucket{le="262144"} 3`,
+			name + `_bucket{le="+Inf"} 3`,
+			name + `_sum 104548`,
+			name + `_count 3`,
+		} {
+			if !strings.Contains(exposition, line+"\n") {
+				t.Errorf("metrics have no line %q", line)
+			}
+		}
+	}
+	if t.Failed() {
+		t.Log(exposition)
+	}
+}
+
+func TestHostLabelledMetrics(t *testing.T) {
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		hosts = append(hosts, newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+			res.Write([]byte("ok"))
+		}).Host)
+	}
+	p := newTestProxy(t, Config{MetricsHostLimit: 2})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	// Each of the first two hosts gets its own series; the rest share one.
+	for i, host := range hosts {
+		for j := 0; j <= i; j++ {
+			get(p, "http://"+host+"/page")
+		}
+	}
+	for key, want := range map[string]int{
+		"proxy_requests_total{host=" + hosts[0] + ",method=GET}": 1,
+		"proxy_requests_total{host=" + hosts[1] + ",method=GET}": 2,
+		"proxy_requests_total{host=other,method=GET}":            3 + 4,
+		"proxy_requests_total{host=" + hosts[2] + ",method=GET}": 0,
+	} {
+		if got := m.counter(key); got != want {
+			t.Errorf("%s = %d, want %d", key, got, want)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := len(m.durations["proxy_request_duration_seconds{cache=miss,host="+hosts[1]+"}"]); n != 1 {
+		t.Errorf("%s latency observed %d times, want 1", hosts[1], n)
+	}
+	series := 0
+	for key := range m.counters {
+		if strings.HasPrefix(key, "proxy_requests_total{") {
+			series++
+		}
+	}
+	if series != 3 {
+		t.Errorf("%d proxy_requests_total series, want the limit of 2 plus other", series)
+	}
+}
+
+func TestMetricsEndpointIsAdminOnly(t *testing.T) {
+	p := newTestProxy(t, Config{Metrics: "prometheus"})
+	if rec := serve(p, adminRequest(http.MethodGet, "/metrics")); rec.Code != http.StatusOK {
+		t.Errorf("GET /metrics from loopback: status %d, want 200", rec.Code)
+	}
+	if rec := serve(p, httptest.NewRequest(http.MethodGet, "/metrics", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("GET /metrics from a proxy client: status %d, want 403", rec.Code)
+	}
+}
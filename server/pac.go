@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// handlePAC serves a proxy auto-config file sending clients through this
+// proxy, except for hosts matching the PACDirect patterns. The proxy
+// address is PACProxyAddr, or else the Host the PAC file was fetched from.
+func (p *Proxy) handlePAC(res http.ResponseWriter, req *http.Request) {
+	addr := p.cfg.PACProxyAddr
+	if addr == "" {
+		addr = req.Host
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, pattern := range p.cfg.PACDirect {
+		fmt.Fprintf(&b, "\tif (shExpMatch(host, %s)) return \"DIRECT\";\n", strconv.Quote(pattern))
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", strconv.Quote("PROXY "+addr))
+
+	res.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	res.Write([]byte(b.String()))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func fetchPAC(p *Proxy, host string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil)
+	req.Host = host
+	return serve(p, req)
+}
+
+func TestPACFile(t *testing.T) {
+	p := newTestProxy(t, Config{PACDirect: []string{"*.internal", "localhost"}})
+
+	rec := fetchPAC(p, "proxy.example:3128")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("Content-Type %q", got)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"function FindProxyForURL(url, host) {",
+		`if (shExpMatch(host, "*.internal")) return "DIRECT";`,
+		`if (shExpMatch(host, "localhost")) return "DIRECT";`,
+		`return "PROXY proxy.example:3128";`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("PAC file lacks %q:\n%s", want, body)
+		}
+	}
+
+	p = newTestProxy(t, Config{PACProxyAddr: "gateway.example:8080"})
+	if body := fetchPAC(p, "proxy.example:3128").Body.String(); !strings.Contains(body, `return "PROXY gateway.example:8080";`) {
+		t.Errorf("PAC file ignores PACProxyAddr:\n%s", body)
+	}
+}
+
+func TestPACFileNotRateLimited(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{RateLimit: 1})
+
+	for i := 0; i < 3; i++ {
+		if rec := fetchPAC(p, "proxy.example:3128"); rec.Code != http.StatusOK {
+			t.Errorf("PAC fetch %d: status %d, want 200", i, rec.Code)
+		}
+	}
+	// The fetches used none of the client's quota.
+	if rec := get(p, target); rec.Code != http.StatusOK {
+		t.Errorf("proxied request after PAC fetches: status %d, want 200", rec.Code)
+	}
+	if n := upstream.requests(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
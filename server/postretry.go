@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// postRetryBackoff is how long the first resend of a POST waits; each later
+// one waits that much longer again.
+const postRetryBackoff = 100 * time.Millisecond
+
+// bufferPOSTForRetry reads up to -post-retry-max-body of a POST's body into
+// memory and makes proxyReq replayable from it, reporting whether it did. A
+// larger body is forwarded as it streams, with what was read put back in
+// front, and isn't retried.
+func (p *Proxy) bufferPOSTForRetry(proxyReq *http.Request) (bool, error) {
+	if p.cfg.POSTRetries == 0 || proxyReq.Method != http.MethodPost {
+		return false, nil
+	}
+	if proxyReq.Body == nil || proxyReq.Body == http.NoBody {
+		proxyReq.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(proxyReq.Body, p.cfg.POSTRetryMaxBody+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(body)) > p.cfg.POSTRetryMaxBody {
+		proxyReq.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), proxyReq.Body), proxyReq.Body}
+		return false, nil
+	}
+	proxyReq.Body.Close()
+	proxyReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	proxyReq.Body, _ = proxyReq.GetBody()
+	return true, nil
+}
+
+// doPOSTWithRetries sends a buffered POST, resending it up to -post-retries
+// times while it fails with a connection error, before ctx ends and as long
+// as -retry-budget allows. Each resend may reach an upstream that already
+// acted on an earlier attempt, which is why the mode is only for POSTs that
+// are safe to repeat.
+func (p *Proxy) doPOSTWithRetries(ctx context.Context, proxyReq *http.Request) (*http.Response, error) {
+	resp, err := p.upstreamClient.Do(proxyReq)
+	for attempt := 1; attempt <= p.cfg.POSTRetries && err != nil && isConnectionError(err); attempt++ {
+		if !p.allowRetry("post") {
+			p.logEvent("Not retrying POST %s: retry budget spent", proxyReq.URL)
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(time.Duration(attempt) * postRetryBackoff):
+		}
+		p.logEvent("Retrying POST %s (attempt %d of %d) after error: %v", proxyReq.URL, attempt, p.cfg.POSTRetries, err)
+		p.metrics.IncCounter("proxy_post_retries_total", nil)
+		retry := proxyReq.Clone(ctx)
+		if retry.Body, err = proxyReq.GetBody(); err != nil {
+			return nil, err
+		}
+		resp, err = p.upstreamClient.Do(retry)
+	}
+	return resp, err
+}
+
+// isConnectionError reports whether err means the connection to the
+// upstream couldn't be made or broke, rather than that the request was
+// cancelled or the upstream's TLS certificate was refused.
+func isConnectionError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || isTLSError(err) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
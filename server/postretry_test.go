@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyUpstream drops the connection of the first fails requests without
+// answering, then echoes each request's body.
+type flakyUpstream struct {
+	mu     sync.Mutex
+	fails  int
+	bodies []string
+}
+
+func (u *flakyUpstream) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	u.mu.Lock()
+	u.bodies = append(u.bodies, string(body))
+	drop := len(u.bodies) <= u.fails
+	u.mu.Unlock()
+	if drop {
+		conn, _, _ := res.(http.Hijacker).Hijack()
+		conn.Close()
+		return
+	}
+	res.Write(body)
+}
+
+func (u *flakyUpstream) received() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.bodies...)
+}
+
+func postThrough(p *Proxy, target, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(http.MethodPost, target, r)
+	return serve(p, req)
+}
+
+func TestPOSTRetriedAfterConnectionError(t *testing.T) {
+	for _, body := range []string{"payload", ""} {
+		upstream := &flakyUpstream{fails: 1}
+		target := newTestUpstream(t, upstream.ServeHTTP).String() + "/submit"
+		p := newTestProxy(t, Config{POSTRetries: 2})
+
+		rec := postThrough(p, target, body)
+		if rec.Code != http.StatusOK || rec.Body.String() != body {
+			t.Errorf("POST %q: status %d, body %q", body, rec.Code, rec.Body.String())
+		}
+		got := upstream.received()
+		if len(got) != 2 || got[0] != body || got[1] != body {
+			t.Errorf("POST %q: upstream received %q, want it twice", body, got)
+		}
+	}
+}
+
+func TestPOSTRetriesGiveUp(t *testing.T) {
+	upstream := &flakyUpstream{fails: 10}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/submit"
+	p := newTestProxy(t, Config{POSTRetries: 2})
+
+	if rec := postThrough(p, target, "payload"); rec.Code == http.StatusOK {
+		t.Error("POST succeeded against an upstream that always drops it")
+	}
+	if n := len(upstream.received()); n != 3 {
+		t.Errorf("upstream received %d attempts, want 3", n)
+	}
+}
+
+func TestPOSTOverMaxBodyNotRetried(t *testing.T) {
+	upstream := &flakyUpstream{fails: 1}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/submit"
+	p := newTestProxy(t, Config{POSTRetries: 2, POSTRetryMaxBody: 4})
+
+	if rec := postThrough(p, target, "payload"); rec.Code == http.StatusOK {
+		t.Error("POST over -post-retry-max-body was retried")
+	}
+	if got := upstream.received(); len(got) != 1 || got[0] != "payload" {
+		t.Errorf("upstream received %q, want the whole body once", got)
+	}
+}
+
+// TestPOSTRetriesStopWhenBudgetSpent checks that under sustained failure a
+// POST is resent only while -retry-budget has room, then sent once.
+func TestPOSTRetriesStopWhenBudgetSpent(t *testing.T) {
+	upstream := &flakyUpstream{fails: 1000}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/submit"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{POSTRetries: 2, RetryBudget: 0.1, RetryBudgetWindow: time.Hour, LogFile: logs})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	// Each attempt adds a tenth of a retry to the retryBudgetMin allowed, so
+	// five POSTs are each tried three times, the sixth gets the one retry
+	// left, and later ones are sent once.
+	sent := 0
+	var attempts []int
+	for i := 0; i < 7; i++ {
+		postThrough(p, target, "payload")
+		n := len(upstream.received())
+		attempts = append(attempts, n-sent)
+		sent = n
+	}
+	if got, want := fmt.Sprint(attempts), "[3 3 3 3 3 2 1]"; got != want {
+		t.Errorf("attempts per POST %s, want %s", got, want)
+	}
+	if n := m.counter("proxy_retries_suppressed_total{reason=post}"); n != 2 {
+		t.Errorf("proxy_retries_suppressed_total{reason=post} = %d, want 2", n)
+	}
+	if n := len(logs.lines("retry budget spent")); n != 2 {
+		t.Errorf("logged %d skipped retries, want 2:\n%s", n, logs)
+	}
+}
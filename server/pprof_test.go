@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofIsOffByDefault(t *testing.T) {
+	p := newTestProxy(t, Config{})
+	// Without the route, the path falls through to proxying, which can't
+	// forward a request without a host.
+	if rec := serve(p, adminRequest(http.MethodGet, "/debug/pprof/")); rec.Code == http.StatusOK {
+		t.Errorf("GET /debug/pprof/ without -pprof: status 200")
+	}
+}
+
+func TestPprofIsAdminOnly(t *testing.T) {
+	p := newTestProxy(t, Config{Pprof: true})
+	if rec := serve(p, adminRequest(http.MethodGet, "/debug/pprof/cmdline")); rec.Code != http.StatusOK {
+		t.Errorf("GET /debug/pprof/cmdline from loopback: status %d, want 200", rec.Code)
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/symbol"} {
+		if rec := serve(p, httptest.NewRequest(http.MethodGet, path, nil)); rec.Code != http.StatusForbidden {
+			t.Errorf("GET %s from a proxy client: status %d, want 403", path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priorityTier gives requests from a network a fixed priority.
+type priorityTier struct {
+	network  *net.IPNet
+	priority int
+}
+
+// parsePriorityTiers parses a comma-separated list of cidr=priority pairs,
+// such as "10.0.0.0/8=10,192.168.1.5=5".
+func parsePriorityTiers(s string) ([]priorityTier, error) {
+	var tiers []priorityTier
+	for _, item := range splitList(s) {
+		cidr, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid priority tier %q, want cidr=priority", item)
+		}
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority in tier %q", item)
+		}
+		nets, err := parseNetworks(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network in tier %q", item)
+		}
+		tiers = append(tiers, priorityTier{network: nets[0], priority: priority})
+	}
+	return tiers, nil
+}
+
+// requestPriority returns the priority of req: its client IP's tier if one
+// matches, otherwise X-Priority when -priority-header is set, otherwise 0.
+func (p *Proxy) requestPriority(req *http.Request) int {
+	if ip := net.ParseIP(p.clientIP(req)); ip != nil {
+		for _, tier := range p.cfg.PriorityTiers {
+			if tier.network.Contains(ip) {
+				return tier.priority
+			}
+		}
+	}
+	if p.cfg.PriorityHeader {
+		if p, err := strconv.Atoi(req.Header.Get("X-Priority")); err == nil {
+			return p
+		}
+	}
+	return 0
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	index    int
+	ready    chan bool // receives true when granted a slot, false when shed
+}
+
+// waitQueue is a heap of waiters ordered by priority, then arrival.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// lowest returns the waiter that would be served last.
+func (q waitQueue) lowest() *waiter {
+	var low *waiter
+	for _, w := range q {
+		if low == nil || q.Less(low.index, w.index) {
+			low = w
+		}
+	}
+	return low
+}
+
+// priorityGate limits how many requests run at once. Requests beyond the
+// limit wait in a bounded queue and are admitted highest priority first. A
+// request is shed when it waits longer than timeout, or when the queue is
+// full and everything in it has at least its priority; otherwise the lowest
+// priority waiter is shed to make room.
+type priorityGate struct {
+	limit    int
+	maxQueue int
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	active int
+	queue  waitQueue
+	seq    uint64
+}
+
+func newPriorityGate(limit, maxQueue int, timeout time.Duration) *priorityGate {
+	return &priorityGate{limit: limit, maxQueue: maxQueue, timeout: timeout}
+}
+
+// acquire blocks until the request may run, returning false if it was shed.
+// Every successful acquire must be paired with release.
+func (g *priorityGate) acquire(req *http.Request, priority int) bool {
+	g.mu.Lock()
+	if g.active < g.limit {
+		g.active++
+		g.mu.Unlock()
+		return true
+	}
+	if len(g.queue) >= g.maxQueue {
+		low := g.queue.lowest()
+		if low == nil || low.priority >= priority {
+			g.mu.Unlock()
+			return false
+		}
+		heap.Remove(&g.queue, low.index)
+		low.ready <- false
+	}
+	w := &waiter{priority: priority, seq: g.seq, ready: make(chan bool, 1)}
+	g.seq++
+	heap.Push(&g.queue, w)
+	g.mu.Unlock()
+
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-w.ready:
+		return ok
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+
+	g.mu.Lock()
+	if w.index >= 0 {
+		heap.Remove(&g.queue, w.index)
+		g.mu.Unlock()
+		return false
+	}
+	g.mu.Unlock()
+	// The waiter was granted or shed while giving up; hand back a granted
+	// slot.
+	if <-w.ready {
+		g.release()
+	}
+	return false
+}
+
+// release frees a slot, handing it straight to the highest priority waiter
+// if there is one.
+func (g *priorityGate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.queue) > 0 {
+		heap.Pop(&g.queue).(*waiter).ready <- true
+		return
+	}
+	g.active--
+}
+
+// prioritized runs next under the concurrency gate when -max-concurrent is
+// set, answering 503 to requests that are shed.
+func (p *Proxy) prioritized(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if p.gate == nil {
+			next(res, req)
+			return
+		}
+		priority := p.requestPriority(req)
+		if !p.gate.acquire(req, priority) {
+			http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+			p.logEvent("Shed request from %s with priority %d: %s", p.clientIP(req), priority, req.RequestURI)
+			p.metrics.IncCounter("proxy_shed_total", nil)
+			return
+		}
+		defer p.gate.release()
+		next(res, req)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// queued waits until g has n waiters.
+func queued(t *testing.T, g *priorityGate, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		g.mu.Lock()
+		got := len(g.queue)
+		g.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue has %d waiters, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPriorityGateServesHighPriorityFirst(t *testing.T) {
+	g := newPriorityGate(1, 10, 5*time.Second)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if !g.acquire(req, 0) {
+		t.Fatal("first acquire was shed")
+	}
+
+	order := make(chan int, 3)
+	for i, priority := range []int{1, 5, 3} {
+		go func() {
+			if g.acquire(req, priority) {
+				order <- priority
+				g.release()
+			}
+		}()
+		queued(t, g, i+1)
+	}
+	g.release()
+
+	for _, want := range []int{5, 3, 1} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("served priority %d, want %d", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("priority %d was never served", want)
+		}
+	}
+}
+
+func TestPriorityGateShedsLowestWhenFull(t *testing.T) {
+	g := newPriorityGate(1, 1, 5*time.Second)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	g.acquire(req, 0)
+
+	low := make(chan bool, 1)
+	go func() { low <- g.acquire(req, 1) }()
+	queued(t, g, 1)
+
+	// An equal priority arrival finds the queue full and is shed itself.
+	if g.acquire(req, 1) {
+		t.Fatal("equal priority acquire on a full queue was admitted")
+	}
+	// A higher one displaces the queued low priority waiter.
+	high := make(chan bool, 1)
+	go func() { high <- g.acquire(req, 9) }()
+	if ok := <-low; ok {
+		t.Error("displaced low priority waiter was admitted")
+	}
+	queued(t, g, 1)
+	g.release()
+	if ok := <-high; !ok {
+		t.Error("high priority waiter was shed")
+	}
+	g.release()
+}
+
+func TestPriorityGateShedsAfterTimeout(t *testing.T) {
+	metrics := newRecordingMetrics()
+	block := make(chan struct{})
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		<-block
+	}).String() + "/slow"
+	p := newTestProxy(t, Config{MaxConcurrent: 1, QueueSize: 4, QueueTimeout: 20 * time.Millisecond, CacheTTL: time.Minute})
+	p.metrics = metrics
+
+	done := make(chan struct{})
+	go func() {
+		get(p, target)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		p.gate.mu.Lock()
+		active := p.gate.active
+		p.gate.mu.Unlock()
+		if active == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if rec := get(p, target); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("queued request: status %d, want 503", rec.Code)
+	}
+	if n := metrics.counter("proxy_shed_total"); n != 1 {
+		t.Errorf("proxy_shed_total = %d, want 1", n)
+	}
+	close(block)
+	<-done
+}
+
+func TestRequestPriority(t *testing.T) {
+	tiers, err := parsePriorityTiers("10.0.0.0/8=10,192.0.2.1=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{PriorityTiers: tiers, PriorityHeader: true})
+	cases := []struct {
+		remote, header string
+		want           int
+	}{
+		{"10.1.2.3:1000", "", 10},
+		{"192.0.2.1:1000", "99", 5}, // a tier wins over the header
+		{"198.51.100.7:1000", "7", 7},
+		{"198.51.100.7:1000", "high", 0},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = c.remote
+		if c.header != "" {
+			req.Header.Set("X-Priority", c.header)
+		}
+		if got := p.requestPriority(req); got != c.want {
+			t.Errorf("%s with X-Priority %q: priority %d, want %d", c.remote, c.header, got, c.want)
+		}
+	}
+	if _, err := parsePriorityTiers("10.0.0.0/8"); err == nil {
+		t.Error("tier without a priority parsed")
+	}
+}
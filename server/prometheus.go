@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the histogram upper bounds, in seconds, used for
+// ObserveDuration.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// sizeBuckets are the histogram upper bounds, in bytes, used for
+// ObserveSize: powers of four from 256B to 64MB.
+var sizeBuckets = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// prometheusMetrics keeps metrics in memory and serves them in the
+// Prometheus text exposition format.
+type prometheusMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	gauges     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		counters:   make(map[string]map[string]float64),
+		gauges:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+func (m *prometheusMetrics) IncCounter(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.counters[name] = series
+	}
+	series[formatLabels(labels)]++
+}
+
+func (m *prometheusMetrics) SetGauge(name string, value float64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.gauges[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.gauges[name] = series
+	}
+	series[formatLabels(labels)] = value
+}
+
+func (m *prometheusMetrics) ObserveDuration(name string, d time.Duration, labels map[string]string) {
+	m.observe(name, durationBuckets, d.Seconds(), labels)
+}
+
+func (m *prometheusMetrics) ObserveSize(name string, bytes int64, labels map[string]string) {
+	m.observe(name, sizeBuckets, float64(bytes), labels)
+}
+
+// observe adds v to the histogram name, creating it with bounds on first
+// use.
+func (m *prometheusMetrics) observe(name string, bounds []float64, v float64, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.histograms[name] = series
+	}
+	key := formatLabels(labels)
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+		series[key] = h
+	}
+
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// ServeHTTP writes all metrics in the text exposition format.
+func (m *prometheusMetrics) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.write(res)
+}
+
+func (m *prometheusMetrics) write(w io.Writer) {
+	for _, name := range sortedKeys(m.counters) {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		series := m.counters[name]
+		for _, labels := range sortedKeys(series) {
+			fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(series[labels]))
+		}
+	}
+	for _, name := range sortedKeys(m.gauges) {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		series := m.gauges[name]
+		for _, labels := range sortedKeys(series) {
+			fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(series[labels]))
+		}
+	}
+	for _, name := range sortedKeys(m.histograms) {
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		series := m.histograms[name]
+		for _, labels := range sortedKeys(series) {
+			h := series[labels]
+			var cumulative uint64
+			for i, bound := range h.bounds {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+		}
+	}
+}
+
+// formatLabels renders labels as a sorted {k="v",...} selector, or "" when
+// there are none.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, k := range sortedKeys(labels) {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel appends one more label to a selector built by formatLabels.
+func withLabel(selector, name, value string) string {
+	pair := name + "=" + strconv.Quote(value)
+	if selector == "" {
+		return "{" + pair + "}"
+	}
+	return selector[:len(selector)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the settings a Proxy is built from. main fills it in from the
+// command-line flags; zero values disable the corresponding feature.
+type Config struct {
+	// LogFile receives every event. It may be nil.
+	LogFile io.Writer
+	// LogStdout also prints every event to the console through the log
+	// package, which writes to standard error.
+	LogStdout bool
+	// LogFailClosed makes the proxy refuse new requests while LogFile can't
+	// be written, for deployments that require a complete audit log.
+	LogFailClosed bool
+	// MaintenanceRetryAfter is sent as Retry-After with the 503s answered
+	// in maintenance mode; zero leaves the header out.
+	MaintenanceRetryAfter time.Duration
+	// AccessLogFormat selects the access log line format: "common",
+	// "combined", "json", or empty to disable access logging.
+	AccessLogFormat string
+	// AccessLogSample is the fraction of successful requests given an
+	// access log line, from 0 to 1; errors and slow requests are always
+	// logged. The zero value logs only those.
+	AccessLogSample float64
+	DumpHeaders     bool
+	// RedactQueryParams lists query parameters, matched case-insensitively,
+	// whose values are replaced with *** in every log line. Forwarded
+	// requests keep the real values.
+	RedactQueryParams []string
+	// SlowThreshold is the latency above which a request is logged as slow;
+	// zero disables the slow-request log.
+	SlowThreshold time.Duration
+
+	CacheMaxBytes   int64
+	CacheMaxEntries int
+	// CacheMemoryTarget, when positive, is the heap size in bytes the cache
+	// gives way to: once the live heap passes CacheMemoryFraction of it,
+	// least recently used entries are evicted to bring it back under.
+	CacheMemoryTarget   int64
+	CacheMemoryFraction float64
+	// CacheAdmission is "all" (or empty) to cache every cacheable miss, or
+	// "tinylfu" to only cache one that would force an eviction when its key
+	// has been requested more often recently than the entry it displaces.
+	CacheAdmission string
+	// CacheDiskDir, when set, holds cached bodies of at least
+	// CacheDiskMinSize bytes, which are then streamed from disk on a hit.
+	CacheDiskDir         string
+	CacheDiskMinSize     int64
+	CacheTTL             time.Duration
+	StaleWhileRevalidate time.Duration
+	TTLOverrides         []ttlRule
+	// CacheableStatuses defaults to defaultCacheableStatuses when empty.
+	CacheableStatuses statusSet
+	CacheableHosts    []string
+	// CacheableContentTypes, when not empty, lists the media type patterns,
+	// such as "text/*", that responses must match to be cached.
+	CacheableContentTypes []string
+	// CacheKeyHeaders lists request headers whose values are folded into
+	// every cache key, so responses are cached separately per distinct value.
+	CacheKeyHeaders []string
+	// CacheNamespace prefixes every cache key so deployments sharing a cache
+	// backend don't collide.
+	CacheNamespace string
+	// CachePOSTHeader, when set, names a request header that lets a POST
+	// carrying it with the value 1 be cached under a key that includes a
+	// hash of its body. Other POSTs are only cached under CacheGraphQLPaths.
+	CachePOSTHeader string
+	// CacheGraphQLPaths lists URL paths whose POSTs are GraphQL requests.
+	// Those running a query are cached, keyed by the query, operation name
+	// and variables; mutations and subscriptions bypass the cache.
+	CacheGraphQLPaths []string
+	// CacheBypassMethods lists request methods that never read or store a
+	// cache entry, checked before any other cache policy. Methods other than
+	// GET, HEAD and opted-in POSTs are never cached either way.
+	CacheBypassMethods []string
+	XCacheHeader       bool
+
+	// StripRequestHeaders are removed from requests before they are
+	// forwarded, and StripResponseHeaders from upstream responses before
+	// they are cached or relayed.
+	StripRequestHeaders  []string
+	StripResponseHeaders []string
+	// TraceMode is how TRACE requests are answered, never forwarded:
+	// "reject" (or empty) with 405, or "echo" to send the request back.
+	TraceMode string
+	// ViaName, when set, identifies this proxy in the Via header it adds to
+	// forwarded requests and responses; a request whose Via already holds
+	// it is rejected with 508 Loop Detected.
+	ViaName string
+	// ServerName, when set, is sent as the Server header of responses the
+	// proxy generates itself, and of relayed responses whose upstream
+	// didn't send one.
+	ServerName string
+	// ForwardHeadersAllowlist, when not empty, lists the only request headers
+	// forwarded upstream.
+	ForwardHeadersAllowlist []string
+	// EarlyHints relays 103 Early Hints responses from upstream to the
+	// client ahead of the final response.
+	EarlyHints bool
+
+	Compress        bool
+	CompressMinSize int
+	// CompressEncodings lists the codings Compress may use, most preferred
+	// first.
+	CompressEncodings []string
+
+	UpstreamHTTP2 bool
+	// UpstreamIdleTimeout is how long an idle upstream connection is kept
+	// for reuse; zero keeps it until the upstream closes it.
+	UpstreamIdleTimeout time.Duration
+	// UpstreamMaxIdleConns caps idle upstream connections, in total and per
+	// host; zero means no limit.
+	UpstreamMaxIdleConns int
+	FollowRedirects      bool
+	MaxRedirects         int
+	InsecureUpstream     bool
+	// POSTRetries, when above zero, resends a POST that failed with a
+	// connection error up to that many times. Only bodies of at most
+	// POSTRetryMaxBody bytes are buffered to be resent; larger ones are
+	// streamed and not retried.
+	POSTRetries      int
+	POSTRetryMaxBody int64
+	// RetryBudget, when above zero, caps retries of upstream requests, POST
+	// resends and direct fallbacks alike, at that fraction of the requests,
+	// probes and tunnels sent upstream per RetryBudgetWindow, plus a few per
+	// window; further failures aren't retried.
+	RetryBudget       float64
+	RetryBudgetWindow time.Duration
+	// SourceIP, when set, is the local address all outbound connections are
+	// made from.
+	SourceIP net.IP
+	// DNSServer, when set, is the host:port of the DNS server used for all
+	// upstream lookups instead of the system resolver.
+	DNSServer string
+	// MaxDNSLookups caps how many upstream host lookups run at once; the
+	// rest wait their turn. Zero means no limit.
+	MaxDNSLookups int
+	// UpstreamProxy, when set, is an HTTP proxy that all forwarded requests
+	// and tunnels are sent through.
+	UpstreamProxy          *url.URL
+	UpstreamFallbackDirect bool
+	Backends               []*backend
+	// DefaultUpstream, when set and Backends is empty, receives origin-form
+	// requests, which come from clients talking to the proxy directly.
+	// Absolute-form requests are still forwarded to the URL they name.
+	DefaultUpstream *url.URL
+	// XUpstreamHeader lets an X-Upstream request header pin the backend for
+	// that request. An unknown value is ignored, or with XUpstreamStrict
+	// rejected with 400.
+	XUpstreamHeader bool
+	XUpstreamStrict bool
+	// StickySessions, when set, sends each client's requests to the same
+	// backend by consistent hashing instead of round-robin, moving them
+	// only while that backend is down: "ip" keys clients by IP address,
+	// "cookie" by the value of the StickyCookie cookie, which the proxy
+	// sets when a client doesn't send it.
+	StickySessions string
+	StickyCookie   string
+	// HealthCheckPath, when set, is requested from every backend by the
+	// health checker. A backend that fails HealthCheckFailures probes in a
+	// row, by not answering with HealthCheckStatus within
+	// HealthCheckTimeout, is passed over until it succeeds
+	// HealthCheckSuccesses in a row.
+	HealthCheckPath      string
+	HealthCheckStatus    int
+	HealthCheckTimeout   time.Duration
+	HealthCheckFailures  int
+	HealthCheckSuccesses int
+
+	// Metrics names the sink: "none", "prometheus" or "statsd".
+	Metrics    string
+	StatsdAddr string
+	// MetricsHostLimit, when positive, labels request counts and latencies
+	// with the target host, for up to that many distinct hosts; the rest
+	// share the host label "other".
+	MetricsHostLimit int
+	// Pprof serves Go's runtime profiles under /debug/pprof/ to admin
+	// clients.
+	Pprof bool
+
+	// RequestTimeout bounds each forwarded request, from when the handler
+	// starts until the response has been relayed, and each CONNECT dial;
+	// zero leaves them bounded only by the client going away.
+	RequestTimeout time.Duration
+
+	// TrustedProxies are the networks whose X-Forwarded-For entries are
+	// believed when working out a request's client IP.
+	TrustedProxies    []*net.IPNet
+	MaxConnsPerClient int
+	// AdminAllow lists the networks, besides loopback, whose clients may
+	// use the admin endpoints.
+	AdminAllow []*net.IPNet
+	// TunnelIdleTimeout closes a CONNECT tunnel after that long without
+	// bytes in either direction, and TunnelMaxLifetime after that long in
+	// all; zero disables each.
+	TunnelIdleTimeout time.Duration
+	TunnelMaxLifetime time.Duration
+	// TunnelBufferSize is the size of the buffer each direction of a tunnel
+	// copies through; zero uses 32KB.
+	TunnelBufferSize int
+	// RateLimit is how many requests each client may make per minute;
+	// zero means 60.
+	RateLimit int
+	// RateLimitJitter staggers clients' rate limit windows rather than
+	// resetting them all together.
+	RateLimitJitter bool
+	// RateLimitBody, when set, is the body of 429 responses to rate-limited
+	// clients, sent as RateLimitContentType, with {retry_after} replaced
+	// by the seconds until the client's quota refills.
+	RateLimitBody        string
+	RateLimitContentType string
+	MaxURLLength         int
+	// AllowedHosts, when not empty, lists the host patterns requests and
+	// tunnels may target; anything else is answered with 400.
+	AllowedHosts   []string
+	MaxConcurrent  int
+	QueueSize      int
+	QueueTimeout   time.Duration
+	PriorityTiers  []priorityTier
+	PriorityHeader bool
+	// MaxHandlers, when positive, caps the requests and tunnels handled at
+	// once across all clients. Past it, a request waits up to
+	// HandlerQueueTimeout for a slot and is then answered with 503.
+	MaxHandlers         int
+	HandlerQueueTimeout time.Duration
+
+	ShadowBackend *url.URL
+	ShadowRate    float64
+	ShadowMethods map[string]bool
+
+	CategoryLists   []categoryList
+	BlockCategories []string
+	// BlockAction is how requests for hosts blocked by category or schedule
+	// are answered: "deny" (or empty) with 403, "redirect" to
+	// BlockRedirectURL, or "blackhole" with an empty 204.
+	BlockAction      string
+	BlockRedirectURL string
+	// ScheduleRules allow or block hosts by time of day, read in
+	// ScheduleLocation, or local time when it is nil.
+	ScheduleRules    []scheduleRule
+	ScheduleLocation *time.Location
+
+	// PACProxyAddr is the host:port /proxy.pac points clients at; empty
+	// uses the Host the file was requested from.
+	PACProxyAddr string
+	// PACDirect lists shExpMatch host patterns /proxy.pac sends direct.
+	PACDirect []string
+
+	// Script, when set, is run on every forwarded request and upstream
+	// response.
+	Script *luaScript
+
+	// Scanner, when set, checks request bodies and buffered response bodies.
+	// Streamed event-stream and multipart responses are not scanned.
+	Scanner ContentScanner
+	// ScanMaxBody caps the request bodies buffered for Scanner, in bytes;
+	// larger ones are refused. Zero means 1 MiB.
+	ScanMaxBody int64
+}
+
+// Proxy is the forward proxy handler. It owns its configuration, cache, the
+// per-client rate-limit and connection counters, the open tunnels and the
+// event log, so separate Proxy values don't share any of them.
+type Proxy struct {
+	cfg            Config
+	metrics        Metrics
+	hostLabeler    *hostLabeler
+	resolver       *net.Resolver
+	dnsSlots       chan struct{}
+	upstreamClient *http.Client
+	upstreamConns  *connTracker
+	grpcClient     *http.Client
+	backends       *backendPool
+	gate           *priorityGate
+	handlerSlots   chan struct{}
+	retryBudget    *retryBudget
+
+	cache *lruCache
+
+	clients *clientCounters
+
+	inFlight    map[string]int
+	inFlightMux sync.Mutex
+
+	tunnels      map[uint64]*tunnel
+	tunnelsMux   sync.Mutex
+	nextTunnelID atomic.Uint64
+	// tunnelBuffers holds -tunnel-buffer-size copy buffers for tunnels.
+	tunnelBuffers *sync.Pool
+
+	blockedCategories map[string]bool
+	categoriesMu      sync.RWMutex
+	hostCategories    map[string][]string // host to the categories listing it
+
+	logFile      io.Writer
+	logFileMutex sync.Mutex
+	// queryRedactor matches the RedactQueryParams values; nil if none.
+	queryRedactor *regexp.Regexp
+	// logWriteFailing is set while the most recent log file write failed.
+	logWriteFailing atomic.Bool
+
+	// maintenance is set while proxied requests are rejected with 503.
+	maintenance atomic.Bool
+
+	session *sessionStats
+
+	localMux *http.ServeMux
+	forward  http.HandlerFunc
+	connect  http.HandlerFunc
+}
+
+// NewProxy checks cfg and returns a Proxy built from it, with the category
+// lists loaded and the metrics sink connected.
+func NewProxy(cfg Config) (*Proxy, error) {
+	if !validAccessLogFormat(cfg.AccessLogFormat) {
+		return nil, fmt.Errorf("invalid access log format %q, want common, combined or json", cfg.AccessLogFormat)
+	}
+	if !validTraceMode(cfg.TraceMode) {
+		return nil, fmt.Errorf("invalid trace mode %q, want reject or echo", cfg.TraceMode)
+	}
+	if !validBlockAction(cfg.BlockAction) {
+		return nil, fmt.Errorf("invalid block action %q, want deny, redirect or blackhole", cfg.BlockAction)
+	}
+	if cfg.BlockAction == "redirect" && cfg.BlockRedirectURL == "" {
+		return nil, fmt.Errorf("block action redirect needs a redirect URL")
+	}
+	if !validStickySessions(cfg.StickySessions) {
+		return nil, fmt.Errorf("invalid sticky session mode %q, want ip or cookie", cfg.StickySessions)
+	}
+	if cfg.StickySessions == "cookie" && cfg.StickyCookie == "" {
+		return nil, fmt.Errorf("sticky session mode cookie needs a cookie name")
+	}
+	for _, method := range cfg.CacheBypassMethods {
+		if method == http.MethodPost && (cfg.CachePOSTHeader != "" || len(cfg.CacheGraphQLPaths) > 0) {
+			return nil, fmt.Errorf("POST caching is enabled but POST is a cache bypass method")
+		}
+	}
+	if !validCacheAdmission(cfg.CacheAdmission) {
+		return nil, fmt.Errorf("invalid cache admission policy %q, want all or tinylfu", cfg.CacheAdmission)
+	}
+	if cfg.AccessLogSample < 0 || cfg.AccessLogSample > 1 {
+		return nil, fmt.Errorf("invalid access log sample %v, want 0 to 1", cfg.AccessLogSample)
+	}
+	if cfg.HealthCheckStatus == 0 {
+		cfg.HealthCheckStatus = http.StatusOK
+	}
+	if cfg.CacheMemoryFraction == 0 {
+		cfg.CacheMemoryFraction = 0.8
+	}
+	if cfg.CacheMemoryFraction < 0 || cfg.CacheMemoryFraction > 1 {
+		return nil, fmt.Errorf("invalid cache memory fraction %v, want between 0 and 1", cfg.CacheMemoryFraction)
+	}
+	if cfg.RetryBudget < 0 {
+		return nil, fmt.Errorf("invalid retry budget %v, want at least 0", cfg.RetryBudget)
+	}
+	if cfg.HandlerQueueTimeout == 0 {
+		cfg.HandlerQueueTimeout = 100 * time.Millisecond
+	}
+	if cfg.RetryBudgetWindow == 0 {
+		cfg.RetryBudgetWindow = 10 * time.Second
+	}
+	if cfg.ScanMaxBody < 0 {
+		return nil, fmt.Errorf("invalid scan max body %d, want at least 0", cfg.ScanMaxBody)
+	}
+	if cfg.ScanMaxBody == 0 {
+		cfg.ScanMaxBody = 1 << 20
+	}
+	if cfg.POSTRetries > 0 && cfg.POSTRetryMaxBody == 0 {
+		cfg.POSTRetryMaxBody = 1 << 20
+	}
+	if cfg.RateLimit == 0 {
+		cfg.RateLimit = defaultRateLimit
+	}
+	if cfg.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid rate limit %d, want at least 1", cfg.RateLimit)
+	}
+	if cfg.RateLimitContentType == "" {
+		cfg.RateLimitContentType = "text/plain; charset=utf-8"
+	}
+	if cfg.CacheableStatuses.codes == nil {
+		cfg.CacheableStatuses, _ = parseStatusSet(defaultCacheableStatuses)
+	}
+
+	p := &Proxy{
+		cfg:               cfg,
+		cache:             newLRUCache(cfg.CacheMaxBytes, cfg.CacheMaxEntries),
+		clients:           newClientCounters(rateLimitWindow, cfg.RateLimitJitter),
+		inFlight:          make(map[string]int),
+		tunnels:           make(map[uint64]*tunnel),
+		tunnelBuffers:     newTunnelBuffers(cfg.TunnelBufferSize),
+		blockedCategories: make(map[string]bool),
+		hostCategories:    make(map[string][]string),
+		logFile:           cfg.LogFile,
+		queryRedactor:     newQueryRedactor(cfg.RedactQueryParams),
+		session:           newSessionStats(),
+		localMux:          http.NewServeMux(),
+	}
+	if cfg.CacheAdmission == "tinylfu" {
+		p.cache.admission = newFrequencySketch(cfg.CacheMaxEntries)
+	}
+	for _, category := range cfg.BlockCategories {
+		if !p.hasCategory(category) {
+			return nil, fmt.Errorf("unknown category %q", category)
+		}
+		p.blockedCategories[category] = true
+	}
+	if err := p.loadCategories(); err != nil {
+		return nil, fmt.Errorf("loading category lists: %v", err)
+	}
+
+	if cfg.CacheDiskDir != "" {
+		if err := os.MkdirAll(cfg.CacheDiskDir, 0o700); err != nil {
+			return nil, fmt.Errorf("creating disk cache: %v", err)
+		}
+		if err := cleanDiskCache(cfg.CacheDiskDir); err != nil {
+			return nil, fmt.Errorf("cleaning disk cache: %v", err)
+		}
+	}
+
+	var err error
+	p.metrics, err = newMetrics(cfg.Metrics, cfg.StatsdAddr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MetricsHostLimit > 0 {
+		p.hostLabeler = newHostLabeler(cfg.MetricsHostLimit)
+	}
+	p.resolver = newResolver(cfg.DNSServer)
+	if cfg.MaxDNSLookups > 0 {
+		p.dnsSlots = make(chan struct{}, cfg.MaxDNSLookups)
+	}
+	p.upstreamConns = newConnTracker(p)
+	p.upstreamClient = p.newUpstreamClient()
+	p.grpcClient = p.newGRPCClient()
+	if len(cfg.Backends) > 0 {
+		p.backends = &backendPool{backends: cfg.Backends}
+		if cfg.StickySessions != "" {
+			p.backends.buildRing()
+		}
+	}
+	if cfg.RetryBudget > 0 {
+		p.retryBudget = newRetryBudget(cfg.RetryBudget, cfg.RetryBudgetWindow)
+	}
+	if cfg.MaxHandlers > 0 {
+		p.handlerSlots = make(chan struct{}, cfg.MaxHandlers)
+	}
+	if cfg.MaxConcurrent > 0 {
+		p.gate = newPriorityGate(cfg.MaxConcurrent, cfg.QueueSize, cfg.QueueTimeout)
+	}
+
+	p.forward = p.accessLogged(p.limitHandlers(p.rejectInMaintenance(p.failClosed(p.rateLimiter(p.limitConns(p.prioritized(p.handleRequestAndCache)))))))
+	p.connect = p.accessLogged(p.limitHandlers(p.rejectInMaintenance(p.failClosed(p.rateLimiter(p.limitConns(p.handleConnect))))))
+
+	p.localMux.HandleFunc("/stats", p.adminOnly(p.handleStats))
+	p.localMux.HandleFunc("GET /proxy.pac", p.handlePAC)
+	p.localMux.HandleFunc("GET /admin/tunnels", p.adminOnly(p.handleListTunnels))
+	p.localMux.HandleFunc("DELETE /admin/tunnels/{id}", p.adminOnly(p.handleCloseTunnel))
+	p.localMux.HandleFunc("POST /admin/maintenance", p.adminOnly(p.handleMaintenance))
+	p.localMux.HandleFunc("GET /healthz", p.handleHealth)
+	if h, ok := p.metrics.(http.Handler); ok {
+		p.localMux.HandleFunc("/metrics", p.adminOnly(h.ServeHTTP))
+	}
+	if cfg.Pprof {
+		p.localMux.HandleFunc("/debug/pprof/", p.adminOnly(pprof.Index))
+		p.localMux.HandleFunc("/debug/pprof/cmdline", p.adminOnly(pprof.Cmdline))
+		p.localMux.HandleFunc("/debug/pprof/profile", p.adminOnly(pprof.Profile))
+		p.localMux.HandleFunc("/debug/pprof/symbol", p.adminOnly(pprof.Symbol))
+		p.localMux.HandleFunc("/debug/pprof/trace", p.adminOnly(pprof.Trace))
+	}
+	return p, nil
+}
+
+// ServeHTTP routes CONNECT requests to the tunnel handler, origin-form
+// requests for a registered path to the proxy's own endpoints, such as
+// /stats, and everything else to the forwarding handler.
+func (p *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	p.setServer(res)
+	if req.Method == http.MethodConnect {
+		p.connect(res, req)
+		return
+	}
+	if strings.HasPrefix(req.RequestURI, "/") {
+		if _, pattern := p.localMux.Handler(req); pattern != "" {
+			p.localMux.ServeHTTP(res, req)
+			return
+		}
+	}
+	p.forward(res, req)
+}
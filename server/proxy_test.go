@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestProxyServesCacheHitInProcess runs a Proxy behind httptest and checks
+// that a repeated GET is answered from its cache.
+func TestProxyServesCacheHitInProcess(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP)
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true})
+
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for i, want := range []string{"MISS", "HIT"} {
+		resp, err := client.Get(target.String() + "/page")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("request %d: body %q, want %q", i, body, "hello")
+		}
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache %q, want %q", i, got, want)
+		}
+	}
+	if n := upstream.requests(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func BenchmarkProxyCacheHit(b *testing.B) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(b, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(b, Config{CacheTTL: time.Minute})
+	get(p, target)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if rec := get(p, target); rec.Code != http.StatusOK {
+			b.Fatalf("status %d", rec.Code)
+		}
+	}
+}
+
+func BenchmarkProxyCacheMiss(b *testing.B) {
+	upstream := &countingHandler{body: "hello", header: http.Header{"Cache-Control": {"no-store"}}}
+	target := newTestUpstream(b, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(b, Config{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if rec := get(p, target); rec.Code != http.StatusOK {
+			b.Fatalf("status %d", rec.Code)
+		}
+	}
+}
+
+// TestProxiesDoNotShareState checks that two Proxy values keep separate
+// caches and rate-limit counters.
+func TestProxiesDoNotShareState(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	first := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true, RateLimit: 3})
+	second := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true, RateLimit: 3})
+
+	get(first, target)
+	if got := get(first, target).Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("first proxy's second GET: X-Cache %q, want HIT", got)
+	}
+	if got := get(second, target).Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("second proxy's first GET: X-Cache %q, want MISS", got)
+	}
+	if n := first.cache.len(); n != 1 {
+		t.Errorf("first proxy caches %d entries, want 1", n)
+	}
+
+	// The first proxy's client uses up its quota of 3; the second's hasn't.
+	get(first, target)
+	if code := get(first, target).Code; code != http.StatusTooManyRequests {
+		t.Errorf("first proxy's fourth request: status %d, want 429", code)
+	}
+	if code := get(second, target).Code; code != http.StatusOK {
+		t.Errorf("second proxy's second request: status %d, want 200", code)
+	}
+}
+
+func TestSetCookieResponsesNotCached(t *testing.T) {
+	upstream := &countingHandler{body: "hello", header: http.Header{"Set-Cookie": {"session=abc"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true})
+
+	for i := 0; i < 2; i++ {
+		rec := get(p, target)
+		if got := rec.Header().Get("X-Cache"); got != "MISS" {
+			t.Errorf("request %d: X-Cache %q, want MISS", i, got)
+		}
+		if got := rec.Header().Get("Set-Cookie"); got != "session=abc" {
+			t.Errorf("request %d: Set-Cookie %q, want it passed through", i, got)
+		}
+	}
+	if n := upstream.requests(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+
+	// Stripping the cookie makes the response cacheable again.
+	p = newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true, StripResponseHeaders: []string{"Set-Cookie"}})
+	get(p, target)
+	rec := get(p, target)
+	if got := rec.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("with Set-Cookie stripped: X-Cache %q, want HIT", got)
+	}
+	if got := rec.Header().Get("Set-Cookie"); got != "" {
+		t.Errorf("with Set-Cookie stripped: got Set-Cookie %q", got)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a new connection may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLength is the longest a PROXY protocol v1 header can be,
+// including its CRLF.
+const proxyV1MaxLength = 107
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections that start with a PROXY
+// protocol v1 or v2 header, as sent by TCP load balancers such as HAProxy
+// or AWS NLB, and reports the client address the header names as the
+// connection's RemoteAddr. Only peers in from may send one: a header from
+// anyone else could claim any address, such as loopback to pass
+// adminOnly, so their connections are closed unread. Headers are read in a
+// goroutine per connection, so a slow or silent peer doesn't hold up
+// Accept; a connection without a valid header within proxyHeaderTimeout is
+// closed.
+type proxyProtocolListener struct {
+	net.Listener
+	from  []*net.IPNet
+	logf  func(format string, v ...interface{})
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newProxyProtocolListener(ln net.Listener, from []*net.IPNet, logf func(format string, v ...interface{})) *proxyProtocolListener {
+	l := &proxyProtocolListener{
+		Listener: ln,
+		from:     from,
+		logf:     logf,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads conn's PROXY header and hands the connection to Accept.
+func (l *proxyProtocolListener) handshake(conn net.Conn) {
+	if !l.trusted(conn.RemoteAddr()) {
+		l.logf("Closing connection from %s: not a -proxy-protocol-from peer", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	r := bufio.NewReader(conn)
+	remote, err := readProxyHeader(r)
+	if err != nil {
+		l.logf("Closing connection from %s: bad PROXY protocol header: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	select {
+	case l.conns <- &proxyProtocolConn{Conn: conn, r: r, remote: remote}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// trusted reports whether addr is in one of the networks allowed to send
+// PROXY headers.
+func (l *proxyProtocolListener) trusted(addr net.Addr) bool {
+	ip := net.ParseIP(extractIP(addr.String()))
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.from {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// proxyProtocolConn is a connection whose PROXY header has been read. Reads
+// go through r, which may already hold the first bytes after the header.
+type proxyProtocolConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr { return c.remote }
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r and returns
+// the source address it carries, or nil when the header says the
+// connection's own peer address stands, as for health checks from the load
+// balancer itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == proxyV2Signature[0] {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 reads a text header such as
+// "PROXY TCP4 203.0.113.7 192.0.2.1 56324 8080\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("missing PROXY header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header: the signature, version and command,
+// address family, a length and that many bytes of addresses and TLVs.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:12], proxyV2Signature) {
+		return nil, errors.New("missing PROXY header")
+	}
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", head[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch head[12] & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", head[12]&0x0f)
+	}
+	var size int
+	switch head[13] >> 4 {
+	case 1: // AF_INET
+		size = net.IPv4len
+	case 2: // AF_INET6
+		size = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry no IP address to use.
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, errors.New("v2 address block too short")
+	}
+	ip := net.IP(append([]byte(nil), body[:size]...))
+	port := binary.BigEndian.Uint16(body[2*size:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
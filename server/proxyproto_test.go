@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveProxyProtocol serves p on a listener that requires PROXY headers
+// from peers in from, or from loopback if from is empty, until the test
+// ends, and returns its address.
+func serveProxyProtocol(t *testing.T, p *Proxy, from ...string) string {
+	t.Helper()
+	if len(from) == 0 {
+		from = []string{"127.0.0.0/8"}
+	}
+	nets, err := parseNetworks(strings.Join(from, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: p}
+	go srv.Serve(newProxyProtocolListener(ln, nets, p.logEvent))
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// getWithProxyHeader sends header and then a proxied GET for target on a
+// new connection to addr, and returns the response status.
+func getWithProxyHeader(t *testing.T, addr string, header []byte, target string) (int, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(header)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example\r\nConnection: close\r\n\r\n", target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// proxyV2Header builds a v2 PROXY header for a TCP over IPv4 connection
+// from src.
+func proxyV2Header(src string) []byte {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x21, 0x11) // version 2 PROXY, AF_INET STREAM
+	h = binary.BigEndian.AppendUint16(h, 12)
+	h = append(h, net.ParseIP(src).To4()...)
+	h = append(h, net.ParseIP("192.0.2.1").To4()...)
+	h = binary.BigEndian.AppendUint16(h, 56324)
+	return binary.BigEndian.AppendUint16(h, 8080)
+}
+
+func TestProxyProtocolClientIPRateLimited(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	addr := serveProxyProtocol(t, newTestProxy(t, Config{RateLimit: 1}))
+
+	// Every connection comes from 127.0.0.1; the limit follows the
+	// addresses in the headers instead.
+	for i, c := range []struct {
+		header []byte
+		want   int
+	}{
+		{[]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 8080\r\n"), http.StatusOK},
+		{[]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56325 8080\r\n"), http.StatusTooManyRequests},
+		{[]byte("PROXY TCP4 203.0.113.8 192.0.2.1 56326 8080\r\n"), http.StatusOK},
+		{proxyV2Header("203.0.113.8"), http.StatusTooManyRequests},
+		{proxyV2Header("203.0.113.9"), http.StatusOK},
+	} {
+		if code, err := getWithProxyHeader(t, addr, c.header, target); err != nil || code != c.want {
+			t.Errorf("request %d: status %d, %v; want %d", i, code, err, c.want)
+		}
+	}
+}
+
+func TestProxyProtocolRejectsMissingHeader(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &logBuffer{}
+	addr := serveProxyProtocol(t, newTestProxy(t, Config{LogFile: logs}))
+
+	if code, err := getWithProxyHeader(t, addr, nil, target); err == nil {
+		t.Errorf("request without a PROXY header: status %d, want the connection closed", code)
+	}
+	if upstream.requests() != 0 {
+		t.Error("request without a PROXY header reached the upstream")
+	}
+	if len(logs.lines("bad PROXY protocol header")) != 1 {
+		t.Errorf("rejection wasn't logged:\n%s", logs)
+	}
+}
+
+// TestProxyProtocolUntrustedPeer checks that a peer outside
+// -proxy-protocol-from can't pick its own address, such as loopback or an
+// -admin-allow one, with a PROXY header.
+func TestProxyProtocolUntrustedPeer(t *testing.T) {
+	_, admins, _ := net.ParseCIDR("198.51.100.0/24")
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs, AdminAllow: []*net.IPNet{admins}})
+
+	// The test's connections come from 127.0.0.1, so only trusting
+	// 127.0.0.2 makes them untrusted.
+	untrusted := serveProxyProtocol(t, p, "127.0.0.2")
+	for _, header := range [][]byte{
+		[]byte("PROXY TCP4 127.0.0.1 192.0.2.1 56324 8080\r\n"),
+		[]byte("PROXY TCP4 198.51.100.7 192.0.2.1 56324 8080\r\n"),
+		proxyV2Header("198.51.100.7"),
+	} {
+		if code, err := getWithProxyHeader(t, untrusted, header, "/admin/tunnels"); err == nil {
+			t.Errorf("untrusted peer sending %q: status %d, want the connection closed", header, code)
+		}
+	}
+	if n := len(logs.lines("not a -proxy-protocol-from peer")); n != 3 {
+		t.Errorf("logged %d untrusted peers, want 3:\n%s", n, logs)
+	}
+
+	// From a trusted peer the same header is believed.
+	trusted := serveProxyProtocol(t, p, "127.0.0.1")
+	if code, err := getWithProxyHeader(t, trusted, proxyV2Header("198.51.100.7"), "/admin/tunnels"); err != nil || code != http.StatusOK {
+		t.Errorf("trusted peer naming an admin address: status %d, %v; want 200", code, err)
+	}
+	if code, err := getWithProxyHeader(t, trusted, proxyV2Header("203.0.113.7"), "/admin/tunnels"); err != nil || code != http.StatusForbidden {
+		t.Errorf("trusted peer naming a non-admin address: status %d, %v; want 403", code, err)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	local := append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0, 0)
+	for _, c := range []struct {
+		header string
+		want   string // "" for the connection's own address
+	}{
+		{"PROXY TCP4 203.0.113.7 192.0.2.1 56324 8080\r\n", "203.0.113.7:56324"},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 56324 8080\r\n", "[2001:db8::7]:56324"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{string(proxyV2Header("203.0.113.7")), "203.0.113.7:56324"},
+		{string(local), ""},
+	} {
+		addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte(c.header + "GET"))))
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if err != nil || got != c.want {
+			t.Errorf("readProxyHeader(%q) = %q, %v; want %q", c.header, got, err, c.want)
+		}
+	}
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 56324\r\n",
+		"PROXY TCP6 203.0.113.7 192.0.2.1 56324 8080\r\n",
+		"PROXY UDP4 203.0.113.7 192.0.2.1 56324 8080\r\n",
+		"PROXY TCP4 " + string(bytes.Repeat([]byte("9"), 120)) + "\r\n",
+	} {
+		if addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte(header)))); err == nil {
+			t.Errorf("readProxyHeader(%q) = %v, want an error", header, addr)
+		}
+	}
+}
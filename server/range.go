@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// serveCachedRange answers a Range request from the header and body of a
+// cached full 200 response, letting http.ServeContent handle range parsing,
+// If-Range and 206/416.
+func serveCachedRange(res http.ResponseWriter, req *http.Request, header http.Header, body io.ReadSeeker) {
+	yieldServer(res.Header(), header)
+	for h, values := range header {
+		if h == "Content-Length" || h == "Content-Range" {
+			continue
+		}
+		for _, value := range values {
+			res.Header().Add(h, value)
+		}
+	}
+	http.ServeContent(res, req, "", time.Time{}, body)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rangeUpstream serves body with range support, counting requests.
+func rangeUpstream(t *testing.T, body string, count *atomic.Int32) string {
+	return newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		count.Add(1)
+		http.ServeContent(res, req, "", time.Time{}, strings.NewReader(body))
+	}).String() + "/file"
+}
+
+func getRange(p *Proxy, target, byteRange string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Range", byteRange)
+	return serve(p, req)
+}
+
+func TestRangeServedFromCachedBody(t *testing.T) {
+	var count atomic.Int32
+	target := rangeUpstream(t, "0123456789", &count)
+	p := newTestProxy(t, Config{CacheTTL: time.Minute})
+
+	get(p, target)
+	rec := getRange(p, target, "bytes=2-5")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Errorf("range from cache: status %d, body %q; want 206 \"2345\"", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("Content-Range %q", got)
+	}
+	if rec := getRange(p, target, "bytes=20-30"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable range: status %d, want 416", rec.Code)
+	}
+	if n := count.Load(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func TestRangeMissPassedThroughUncached(t *testing.T) {
+	var count atomic.Int32
+	target := rangeUpstream(t, "0123456789", &count)
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true})
+
+	rec := getRange(p, target, "bytes=0-3")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "0123" {
+		t.Errorf("range miss: status %d, body %q; want the upstream's 206 \"0123\"", rec.Code, rec.Body.String())
+	}
+	// The partial response must not be served as the whole resource.
+	rec = get(p, target)
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Errorf("full GET after a range miss: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if n := count.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
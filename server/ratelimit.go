@@ -0,0 +1,155 @@
+package main
+
+import (
+	"hash/maphash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const counterShards = 64
+
+// clientCounters holds the per-client request counts for the current rate
+// limit window. Clients are spread over shards so concurrent requests from
+// different clients rarely share a lock, and a count is bumped atomically
+// under a shard's read lock; only a client's first request in a window and
+// the window reset take a shard's write lock.
+//
+// Without jitter every client's window ends when reset is called. With
+// jitter each client's window is offset within the period by a hash of its
+// IP, so quotas refill at different moments instead of all at once, and
+// reset only drops clients whose window has ended.
+type clientCounters struct {
+	seed   maphash.Seed
+	window time.Duration
+	jitter bool
+	shards [counterShards]counterShard
+	// lastReset is when reset last ran, or the counters were made, in Unix
+	// nanoseconds.
+	lastReset atomic.Int64
+}
+
+type counterShard struct {
+	mu     sync.RWMutex
+	counts map[string]*clientCount
+}
+
+type clientCount struct {
+	n atomic.Int64
+	// window is the index of the window n counts, always 0 without
+	// jitter. Written only under the shard's write lock.
+	window int64
+}
+
+func newClientCounters(window time.Duration, jitter bool) *clientCounters {
+	c := &clientCounters{seed: maphash.MakeSeed(), window: window, jitter: jitter}
+	for i := range c.shards {
+		c.shards[i].counts = make(map[string]*clientCount)
+	}
+	c.lastReset.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *clientCounters) shard(ip string) *counterShard {
+	return &c.shards[maphash.String(c.seed, ip)%counterShards]
+}
+
+// offset returns how far into each period ip's windows start.
+func (c *clientCounters) offset(ip string) time.Duration {
+	if !c.jitter || c.window <= 0 {
+		return 0
+	}
+	return time.Duration(maphash.String(c.seed, ip) % uint64(c.window))
+}
+
+// windowIndex numbers ip's window containing now.
+func (c *clientCounters) windowIndex(ip string, now time.Time) int64 {
+	if !c.jitter || c.window <= 0 {
+		return 0
+	}
+	return int64(time.Duration(now.UnixNano())-c.offset(ip)) / int64(c.window)
+}
+
+// windowEnd returns when ip's window containing now ends and its quota
+// refills. Without jitter that is when reset is next due, one window after
+// it last ran.
+func (c *clientCounters) windowEnd(ip string, now time.Time) time.Time {
+	if !c.jitter || c.window <= 0 {
+		return time.Unix(0, c.lastReset.Load()).Add(c.window)
+	}
+	start := time.Duration(c.windowIndex(ip, now))*c.window + c.offset(ip)
+	return time.Unix(0, int64(start+c.window))
+}
+
+// increment counts one more request from ip at now and returns the number
+// it had made before it in its current window.
+func (c *clientCounters) increment(ip string, now time.Time) int64 {
+	window := c.windowIndex(ip, now)
+	s := c.shard(ip)
+	s.mu.RLock()
+	if count, ok := s.counts[ip]; ok && count.window == window {
+		// The read lock keeps a reset from starting a new window until the
+		// add lands, so no request is counted in a window that's gone.
+		n := count.n.Add(1)
+		s.mu.RUnlock()
+		return n - 1
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count, ok := s.counts[ip]
+	if !ok {
+		count = &clientCount{window: window}
+		s.counts[ip] = count
+	} else if count.window != window {
+		count.window = window
+		count.n.Store(0)
+	}
+	return count.n.Add(1) - 1
+}
+
+// reset ends the window of every client without jitter. With jitter it only
+// forgets clients whose window ended before now, which would start over on
+// their next request anyway.
+func (c *clientCounters) reset(now time.Time) {
+	c.lastReset.Store(now.UnixNano())
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		if c.jitter {
+			for ip, count := range s.counts {
+				if count.window < c.windowIndex(ip, now) {
+					delete(s.counts, ip)
+				}
+			}
+		} else {
+			s.counts = make(map[string]*clientCount)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// writeRateLimited answers a request from ip that is over its rate limit
+// with 429 and a Retry-After of the seconds until its quota refills. The
+// body is -rate-limit-body, with {retry_after} replaced by the same number,
+// served as -rate-limit-content-type, or Go's plain text default.
+func (p *Proxy) writeRateLimited(res http.ResponseWriter, ip string, now time.Time) {
+	seconds := int64(p.clients.windowEnd(ip, now).Sub(now)+time.Second-1) / int64(time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	retryAfter := strconv.FormatInt(seconds, 10)
+	res.Header().Set("Retry-After", retryAfter)
+	if p.cfg.RateLimitBody == "" {
+		http.Error(res, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	res.Header().Set("Content-Type", p.cfg.RateLimitContentType)
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(http.StatusTooManyRequests)
+	res.Write([]byte(strings.ReplaceAll(p.cfg.RateLimitBody, "{retry_after}", retryAfter)))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func connectRequest(dest string) *http.Request {
+	req := httptest.NewRequest(http.MethodConnect, "http://"+dest, nil)
+	req.RequestURI = dest
+	req.Host = dest
+	return req
+}
+
+// TestConnectCountsTowardRateLimit checks CONNECT requests share a client's
+// request quota and get 429 once it is used up, before anything is dialed.
+func TestConnectCountsTowardRateLimit(t *testing.T) {
+	dest := newEchoServer(t)
+	p := newTestProxy(t, Config{RateLimit: 2})
+
+	// The recorder can't be hijacked, so allowed tunnels fail after the
+	// dial with 500; only the limit's answer matters here.
+	for i := 0; i < 2; i++ {
+		if rec := serve(p, connectRequest(dest)); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("CONNECT %d: 429 within the limit", i)
+		}
+	}
+	rec := serve(p, connectRequest(dest))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("CONNECT over the limit: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	// Plain requests draw on the same quota.
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	if code := get(p, target).Code; code != http.StatusTooManyRequests {
+		t.Errorf("GET after the CONNECTs: status %d, want 429", code)
+	}
+}
+
+func TestRateLimitIsPerClient(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{RateLimit: 1})
+
+	get(p, target)
+	if code := get(p, target).Code; code != http.StatusTooManyRequests {
+		t.Errorf("second request: status %d, want 429", code)
+	}
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	if code := serve(p, req).Code; code != http.StatusOK {
+		t.Errorf("another client's request: status %d, want 200", code)
+	}
+
+	p.clients.reset(time.Now())
+	if code := get(p, target).Code; code != http.StatusOK {
+		t.Errorf("after the window reset: status %d, want 200", code)
+	}
+}
+
+func TestRateLimitResponseBody(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+
+	p := newTestProxy(t, Config{RateLimit: 1})
+	get(p, target)
+	rec := get(p, target)
+	if got := rec.Header().Get("Content-Type"); rec.Code != http.StatusTooManyRequests || got != "text/plain; charset=utf-8" {
+		t.Errorf("default 429: status %d, Content-Type %q", rec.Code, got)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("default 429 has no Retry-After")
+	}
+
+	p = newTestProxy(t, Config{
+		RateLimit:            1,
+		RateLimitBody:        `{"error":"rate_limited","retry_after":{retry_after}}`,
+		RateLimitContentType: "application/json",
+	})
+	get(p, target)
+	rec = get(p, target)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", got)
+	}
+	var body struct {
+		Error      string `json:"error"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q: %v", rec.Body.String(), err)
+	}
+	retryAfter, _ := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if body.Error != "rate_limited" || body.RetryAfter != retryAfter {
+		t.Errorf("body %+v, want rate_limited with retry_after matching Retry-After %d", body, retryAfter)
+	}
+	if retryAfter < 1 || retryAfter > int(rateLimitWindow/time.Second) {
+		t.Errorf("Retry-After %d, want 1 to %v", retryAfter, rateLimitWindow)
+	}
+}
+
+// TestLimiterResetterResetsOnDemand drives the resetter by hand rather than
+// waiting on its ticker.
+func TestLimiterResetterResetsOnDemand(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{RateLimit: 2})
+	r := newLimiterResetter(p, time.Hour)
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2; i++ {
+			if code := get(p, target).Code; code != http.StatusOK {
+				t.Fatalf("round %d request %d: status %d, want 200", round, i, code)
+			}
+		}
+		if code := get(p, target).Code; code != http.StatusTooManyRequests {
+			t.Fatalf("round %d: status %d over the limit, want 429", round, code)
+		}
+		r.reset()
+	}
+}
+
+func TestLimiterResetterStops(t *testing.T) {
+	p := newTestProxy(t, Config{})
+	created := p.clients.lastReset.Load()
+	r := newLimiterResetter(p, time.Millisecond)
+	r.Start(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for p.clients.lastReset.Load() == created && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	r.Stop()
+	last := p.clients.lastReset.Load()
+	if last == created {
+		t.Fatal("resetter never ran")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if p.clients.lastReset.Load() != last {
+		t.Error("resetter ran after Stop")
+	}
+}
+
+func TestClientCountersConcurrentIncrements(t *testing.T) {
+	c := newClientCounters(time.Minute, false)
+	now := time.Now()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.increment("192.0.2."+strconv.Itoa(i%4), now)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		if n := c.increment("192.0.2."+strconv.Itoa(i), now); n != 2000 {
+			t.Errorf("client %d made %d requests before this one, want 2000", i, n)
+		}
+	}
+
+	c.reset(now)
+	if n := c.increment("192.0.2.0", now); n != 0 {
+		t.Errorf("after reset: %d earlier requests counted, want 0", n)
+	}
+}
+
+func TestClientCountersJitteredWindows(t *testing.T) {
+	c := newClientCounters(time.Minute, true)
+	now := time.Now()
+	c.increment("192.0.2.1", now)
+	if n := c.increment("192.0.2.1", now); n != 1 {
+		t.Errorf("same window: %d earlier requests, want 1", n)
+	}
+	// A reset inside the client's window keeps its count.
+	c.reset(now)
+	if n := c.increment("192.0.2.1", now); n != 2 {
+		t.Errorf("after a reset mid-window: %d earlier requests, want 2", n)
+	}
+	if n := c.increment("192.0.2.1", c.windowEnd("192.0.2.1", now)); n != 0 {
+		t.Errorf("next window: %d earlier requests, want 0", n)
+	}
+}
+
+// mutexCounters is the single-lock design clientCounters replaced, kept as
+// a baseline for the benchmarks.
+type mutexCounters struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (c *mutexCounters) increment(ip string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.counts[ip]
+	c.counts[ip] = n + 1
+	return n
+}
+
+// benchmarkIPs is how many distinct clients the parallel benchmarks spread
+// their requests over.
+var benchmarkIPs = func() []string {
+	ips := make([]string, 1024)
+	for i := range ips {
+		ips[i] = "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+	}
+	return ips
+}()
+
+func BenchmarkClientCountersParallel(b *testing.B) {
+	c := newClientCounters(time.Minute, false)
+	now := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.increment(benchmarkIPs[i%len(benchmarkIPs)], now)
+		}
+	})
+}
+
+func BenchmarkMutexCountersParallel(b *testing.B) {
+	c := &mutexCounters{counts: make(map[string]int64)}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.increment(benchmarkIPs[i%len(benchmarkIPs)])
+		}
+	})
+}
+
+func TestJitterOffsetsClientWindows(t *testing.T) {
+	now := time.Now()
+	plain := newClientCounters(time.Minute, false)
+	if a, b := plain.windowEnd("192.0.2.1", now), plain.windowEnd("198.51.100.7", now); !a.Equal(b) {
+		t.Errorf("without jitter windows end at %v and %v, want together", a, b)
+	}
+
+	c := newClientCounters(time.Minute, true)
+	ends := make(map[time.Time]bool)
+	for i := 0; i < 20; i++ {
+		end := c.windowEnd("192.0.2."+strconv.Itoa(i), now)
+		if !end.After(now) || end.Sub(now) > time.Minute {
+			t.Errorf("window ends %v from now, want within one window", end.Sub(now))
+		}
+		ends[end] = true
+	}
+	if len(ends) < 2 {
+		t.Error("with jitter every client's window ends at the same moment")
+	}
+	// Each client keeps its own offset from one window to the next.
+	first := c.windowEnd("192.0.2.1", now)
+	if next := c.windowEnd("192.0.2.1", first); !next.Equal(first.Add(time.Minute)) {
+		t.Errorf("next window ends %v after the first, want 1m", next.Sub(first))
+	}
+}
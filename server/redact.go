@@ -0,0 +1,30 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// newQueryRedactor returns a pattern matching the values of the named query
+// parameters wherever a URL appears in a log line, or nil when names is
+// empty. A value ends at the next parameter, whitespace, a quote or a
+// backslash, so URLs inside JSON access records, where & is escaped as
+// \u0026, are handled too.
+func newQueryRedactor(names []string) *regexp.Regexp {
+	if len(names) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	return regexp.MustCompile(`(?i)([?&]|\\u0026)(` + strings.Join(quoted, "|") + `)=[^&\s"\\]*`)
+}
+
+// redactQuery replaces the values of -redact-query-params in line with ***.
+func (p *Proxy) redactQuery(line string) string {
+	if p.queryRedactor == nil {
+		return line
+	}
+	return p.queryRedactor.ReplaceAllString(line, "${1}${2}=***")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactQuery(t *testing.T) {
+	p := newTestProxy(t, Config{RedactQueryParams: []string{"api_key", "token"}})
+	for line, want := range map[string]string{
+		"Served http://a.example/v1?api_key=s3cret&page=2 in 1ms": "Served http://a.example/v1?api_key=***&page=2 in 1ms",
+		`"GET /v1?page=2&TOKEN=abc HTTP/1.1"`:                     `"GET /v1?page=2&TOKEN=*** HTTP/1.1"`,
+		`{"url":"http://a.example/?page=2&token=abc"}`:            `{"url":"http://a.example/?page=2&token=***"}`,
+		"http://a.example/?my_token=abc&api_key_id=7":             "http://a.example/?my_token=abc&api_key_id=7",
+	} {
+		if got := p.redactQuery(line); got != want {
+			t.Errorf("redactQuery(%q) = %q, want %q", line, got, want)
+		}
+	}
+	if line := "/v1?api_key=s3cret"; newTestProxy(t, Config{}).redactQuery(line) != line {
+		t.Error("redacted without -redact-query-params")
+	}
+}
+
+func TestRedactedQueryForwardedIntact(t *testing.T) {
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.URL.RawQuery))
+	}).String() + "/v1?api_key=s3cret&page=2"
+
+	for _, format := range []string{"common", "json"} {
+		logs := &logBuffer{}
+		p := newTestProxy(t, Config{RedactQueryParams: []string{"api_key"}, AccessLogFormat: format, AccessLogSample: 1, LogFile: logs})
+		if body := get(p, target).Body.String(); body != "api_key=s3cret&page=2" {
+			t.Errorf("%s: upstream got query %q, want it intact", format, body)
+		}
+		if strings.Contains(logs.String(), "s3cret") {
+			t.Errorf("%s: log contains the api_key value:\n%s", format, logs)
+		}
+		if n := len(logs.lines("api_key=***")); n < 2 {
+			t.Errorf("%s: %d log lines have the redacted URL, want the event and access lines:\n%s", format, n, logs)
+		}
+	}
+}
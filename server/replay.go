@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayResult counts the outcomes of a -replay run.
+type replayResult struct {
+	Matched    int
+	Mismatched int
+	Failed     int
+	Skipped    int
+}
+
+// newReplayClient returns the client -replay sends requests with: through
+// proxy, handing redirects back so their status can be compared.
+func newReplayClient(proxy *url.URL) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxy), DisableCompression: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: time.Minute,
+	}
+}
+
+// replayLog re-issues the requests recorded in a json access log with
+// client, reporting each whose status differs from the logged one to out.
+// Lines that aren't access records are ignored, which lets the whole event
+// log be replayed. Requests are spaced as they were logged, divided by
+// speed, or sent back to back when speed is zero. Bodies aren't logged, so
+// requests are replayed without one, and CONNECT records are skipped.
+func replayLog(r io.Reader, client *http.Client, speed float64, out io.Writer) (replayResult, error) {
+	var (
+		result replayResult
+		last   time.Time
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var rec accessRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Method == "" || rec.URL == "" {
+			continue
+		}
+		if rec.Method == http.MethodConnect {
+			result.Skipped++
+			continue
+		}
+
+		if speed > 0 && !last.IsZero() {
+			if gap := rec.Time.Sub(last); gap > 0 {
+				time.Sleep(time.Duration(float64(gap) / speed))
+			}
+		}
+		last = rec.Time
+
+		status, err := replayRequest(client, rec)
+		switch {
+		case err != nil:
+			result.Failed++
+			fmt.Fprintf(out, "FAILED %s %s: %v\n", rec.Method, rec.URL, err)
+		case status != rec.Status:
+			result.Mismatched++
+			fmt.Fprintf(out, "MISMATCH %s %s: logged %d, replayed %d\n", rec.Method, rec.URL, rec.Status, status)
+		default:
+			result.Matched++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+	fmt.Fprintf(out, "Replayed %d requests: %d matched, %d mismatched, %d failed, %d skipped\n",
+		result.Matched+result.Mismatched+result.Failed, result.Matched, result.Mismatched, result.Failed, result.Skipped)
+	return result, nil
+}
+
+// replayRequest sends one recorded request and returns the status it got.
+func replayRequest(client *http.Client, rec accessRecord) (int, error) {
+	req, err := http.NewRequest(rec.Method, rec.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	if rec.UserAgent != "" {
+		req.Header.Set("User-Agent", rec.UserAgent)
+	}
+	if rec.Referer != "" {
+		req.Header.Set("Referer", rec.Referer)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// runReplay is the -replay mode: it replays the log at path through the
+// proxy at proxyAddr and returns the exit status, 1 if any request failed
+// or got a different status.
+func runReplay(path, proxyAddr string, speed float64) int {
+	proxy, err := url.Parse(proxyAddr)
+	if err != nil || proxy.Host == "" {
+		log.Printf("Error parsing -replay-proxy: invalid proxy URL %q", proxyAddr)
+		return 2
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Error opening replay log: %v", err)
+		return 2
+	}
+	defer f.Close()
+	result, err := replayLog(f, newReplayClient(proxy), speed, os.Stdout)
+	if err != nil {
+		log.Printf("Error reading replay log: %v", err)
+		return 2
+	}
+	if result.Mismatched > 0 || result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplayLog(t *testing.T) {
+	var gone atomic.Bool
+	u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/page" && gone.Load() {
+			http.NotFound(res, req)
+			return
+		}
+		res.Write([]byte("ok"))
+	})
+	target := u.String()
+
+	// Record a json access log, with events around it, from one proxy...
+	logs := &logBuffer{}
+	recorder := newTestProxy(t, Config{AccessLogFormat: "json", AccessLogSample: 1, LogFile: logs})
+	for _, path := range []string{"/page", "/about", "/contact"} {
+		get(recorder, target+path)
+	}
+	if n := len(logs.lines(`"method":"GET"`)); n != 3 {
+		t.Fatalf("recorded %d access records, want 3:\n%s", n, logs)
+	}
+	connect := fmt.Sprintf(`{"time":%q,"method":"CONNECT","url":"%s","status":200}`, time.Now().Format(time.RFC3339Nano), u.Host)
+	log := logs.String() + "not an access record\n" + connect + "\n"
+
+	// ...and replay it through another after /page has gone.
+	gone.Store(true)
+	srv := httptest.NewServer(newTestProxy(t, Config{}))
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	var out strings.Builder
+	result, err := replayLog(strings.NewReader(log), newReplayClient(proxyURL), 0, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := replayResult{Matched: 2, Mismatched: 1, Skipped: 1}
+	if result != want {
+		t.Errorf("result %+v, want %+v\n%s", result, want, out.String())
+	}
+	if mismatch := "MISMATCH GET " + target + "/page: logged 200, replayed 404"; !strings.Contains(out.String(), mismatch) {
+		t.Errorf("report doesn't contain %q:\n%s", mismatch, out.String())
+	}
+	if !strings.Contains(out.String(), "Replayed 3 requests: 2 matched, 1 mismatched, 0 failed, 1 skipped") {
+		t.Errorf("report has no summary:\n%s", out.String())
+	}
+
+	// Unreachable requests count as failed.
+	result, _ = replayLog(strings.NewReader(logs.String()), newReplayClient(unreachableProxyURL(t)), 0, &out)
+	if result.Failed != 3 {
+		t.Errorf("through an unreachable proxy: %d failed, want 3", result.Failed)
+	}
+}
+
+func TestReplayLogSpacing(t *testing.T) {
+	u := newTestUpstream(t, func(http.ResponseWriter, *http.Request) {})
+	srv := httptest.NewServer(newTestProxy(t, Config{}))
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+
+	logged := time.Now()
+	var log strings.Builder
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(&log, `{"time":%q,"method":"GET","url":"%s/","status":200}`+"\n", logged.Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano), u)
+	}
+
+	// Two one-second gaps at ten times speed take about 200ms.
+	start := time.Now()
+	result, err := replayLog(strings.NewReader(log.String()), newReplayClient(proxyURL), 10, &strings.Builder{})
+	elapsed := time.Since(start)
+	if err != nil || result.Matched != 3 {
+		t.Fatalf("result %+v, err %v", result, err)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("replay took %v, want about 200ms", elapsed)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// responseRecorder wraps a ResponseWriter to remember the status code and
+// the number of body bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	// Interim responses such as 103 Early Hints come before the real status.
+	if r.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through to the wrapped writer so streamed responses still
+// reach the client promptly.
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingBody wraps a request body to count the bytes read from it. The
+// first read error other than EOF, as when the client disconnects partway
+// through, is kept and calls abort, so the upstream request is cancelled
+// rather than left to pass on a truncated body.
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+	abort func()
+
+	mu  sync.Mutex
+	err error
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		b.mu.Lock()
+		first := b.err == nil
+		if first {
+			b.err = err
+		}
+		b.mu.Unlock()
+		if first && b.abort != nil {
+			b.abort()
+		}
+	}
+	return n, err
+}
+
+// readErr returns the error reading the body failed with, if it did.
+func (b *countingBody) readErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
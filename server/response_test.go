@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// failingBody yields n bytes and then fails, as the body of a client that
+// disconnects partway through sending it.
+type failingBody struct{ n int }
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.n == 0 {
+		return 0, errors.New("client disconnected")
+	}
+	if len(p) > b.n {
+		p = p[:b.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	b.n -= len(p)
+	return len(p), nil
+}
+
+func TestRequestBodyFailureAbortsUpstream(t *testing.T) {
+	var completed atomic.Int32
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		if body, err := io.ReadAll(req.Body); err == nil && len(body) == 5000 {
+			completed.Add(1)
+		}
+	}).String() + "/upload"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	req := httptest.NewRequest(http.MethodPost, target, &failingBody{n: 1000})
+	req.ContentLength = 5000
+	rec := serve(p, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	if completed.Load() != 0 {
+		t.Error("upstream handled the truncated body as complete")
+	}
+	if len(logs.lines("Aborted "+target+" after reading 1000 bytes of the request body, error: client disconnected")) != 1 {
+		t.Errorf("partial transfer wasn't logged:\n%s", logs)
+	}
+	if n := m.counter("proxy_request_body_errors_total"); n != 1 {
+		t.Errorf("proxy_request_body_errors_total = %d, want 1", n)
+	}
+
+	// A body that arrives whole is forwarded as usual.
+	if rec := postThrough(p, target, strings.Repeat("x", 5000)); rec.Code != http.StatusOK || completed.Load() != 1 {
+		t.Errorf("whole body: status %d, upstream completed %d", rec.Code, completed.Load())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryBudgetMin is how many retries each window allows however few
+// requests it has seen, so a quiet proxy can still retry.
+const retryBudgetMin = 10
+
+// retryBudget caps retries at a fraction of the upstream requests sent in
+// the current window. During a widespread outage nearly every request
+// fails, and retrying them all would multiply the load on upstreams that
+// are already struggling; once the budget is spent, failures are passed on
+// instead until the next window.
+type retryBudget struct {
+	ratio  float64
+	window time.Duration
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int64
+	retries  int64
+}
+
+func newRetryBudget(ratio float64, window time.Duration) *retryBudget {
+	return &retryBudget{ratio: ratio, window: window, start: time.Now()}
+}
+
+// roll starts a new window once the current one has passed. b.mu is held.
+func (b *retryBudget) roll(now time.Time) {
+	if now.Sub(b.start) >= b.window {
+		b.start = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// remaining returns how many retries the current window still allows.
+// b.mu is held.
+func (b *retryBudget) remaining() int64 {
+	n := retryBudgetMin + int64(b.ratio*float64(b.requests)) - b.retries
+	return max(n, 0)
+}
+
+// request counts an upstream request toward the window's budget.
+func (b *retryBudget) request() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	b.requests++
+	return b.remaining()
+}
+
+// retry spends one retry from the budget, reporting false, and spending
+// nothing, when none is left. It also returns what remains.
+func (b *retryBudget) retry() (bool, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(time.Now())
+	if b.remaining() == 0 {
+		return false, 0
+	}
+	b.retries++
+	return true, b.remaining()
+}
+
+// budgetedTransport counts every request it sends toward -retry-budget:
+// forwarded requests and each of their retries and redirects, health
+// probes and background revalidations alike. Fallbacks made below it are
+// retries and are charged by allowRetry instead.
+type budgetedTransport struct {
+	proxy *Proxy
+	next  http.RoundTripper
+}
+
+func (t budgetedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.proxy.countUpstreamRequest()
+	return t.next.RoundTrip(req)
+}
+
+// countUpstreamRequest counts a request or tunnel sent upstream toward
+// -retry-budget.
+func (p *Proxy) countUpstreamRequest() {
+	if p.retryBudget == nil {
+		return
+	}
+	p.metrics.SetGauge("proxy_retry_budget_remaining", float64(p.retryBudget.request()), nil)
+}
+
+// allowRetry reports whether -retry-budget has room for one more retry, of
+// the kind named by reason, and counts it if so.
+func (p *Proxy) allowRetry(reason string) bool {
+	if p.retryBudget == nil {
+		return true
+	}
+	ok, remaining := p.retryBudget.retry()
+	p.metrics.SetGauge("proxy_retry_budget_remaining", float64(remaining), nil)
+	if !ok {
+		p.metrics.IncCounter("proxy_retries_suppressed_total", map[string]string{"reason": reason})
+	}
+	return ok
+}
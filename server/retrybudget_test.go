@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetWindow(t *testing.T) {
+	b := newRetryBudget(0.5, time.Hour)
+	for i := 0; i < 4; i++ {
+		b.request()
+	}
+	// retryBudgetMin plus half of the 4 requests.
+	for i := 0; i < retryBudgetMin+2; i++ {
+		if ok, _ := b.retry(); !ok {
+			t.Fatalf("retry %d refused, want %d allowed", i, retryBudgetMin+2)
+		}
+	}
+	if ok, remaining := b.retry(); ok || remaining != 0 {
+		t.Errorf("retry past the budget: %v, %d remaining", ok, remaining)
+	}
+
+	// A new window starts the counts afresh.
+	b.mu.Lock()
+	b.start = b.start.Add(-time.Hour)
+	b.mu.Unlock()
+	if ok, remaining := b.retry(); !ok || remaining != retryBudgetMin-1 {
+		t.Errorf("retry in a new window: %v, %d remaining; want %d", ok, remaining, retryBudgetMin-1)
+	}
+}
+
+// budgetRequests returns how many upstream requests p's retry budget has
+// counted this window.
+func budgetRequests(p *Proxy) int64 {
+	p.retryBudget.mu.Lock()
+	defer p.retryBudget.mu.Unlock()
+	return p.retryBudget.requests
+}
+
+// TestRetryBudgetCountsEveryUpstreamRequest checks that forwarded requests,
+// health probes, revalidations and tunnels all add to the requests a retry
+// budget is a fraction of, since each of them can spend from it.
+func TestRetryBudgetCountsEveryUpstreamRequest(t *testing.T) {
+	upstream := newTestUpstream(t, (&countingHandler{body: "ok"}).ServeHTTP)
+	backends, err := parseBackends(upstream.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{
+		Backends:          backends,
+		HealthCheckPath:   "/healthz",
+		RetryBudget:       0.5,
+		RetryBudgetWindow: time.Hour,
+	})
+
+	steps := []struct {
+		name string
+		run  func()
+	}{
+		{"forwarded request", func() { serve(p, originGet("/page")) }},
+		{"health probe", func() { newHealthChecker(p, time.Hour).check(context.Background()) }},
+		{"revalidation", func() {
+			u, _ := url.Parse(upstream.String() + "/stale")
+			p.revalidate(testEntry("stale", "old"), u, u, http.Header{})
+		}},
+		{"tunnel", func() {
+			conn, err := p.dialTunnel(context.Background(), newEchoServer(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		}},
+	}
+	for i, step := range steps {
+		step.run()
+		if n := budgetRequests(p); n != int64(i+1) {
+			t.Errorf("after the %s: %d requests counted, want %d", step.name, n, i+1)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const revalidateTimeout = 30 * time.Second
+
+// revalidate refetches a stale entry in the background and replaces it in
+// the cache. Until it finishes, requests keep getting the stale copy; if it
+// fails, the next stale hit tries again. header is the header of the client
+// request that found the entry stale, as -script's on_request left it; the
+// request and its response go through the same header rules and on_response
+// as a forwarded one.
+func (p *Proxy) revalidate(entry *cacheEntry, u, target *url.URL, header http.Header) {
+	defer entry.revalidating.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Header = p.outboundHeader(header, 1, 1)
+	// The entry holds the whole response, whatever part the client wanted.
+	req.Header.Del("Range")
+
+	resp, err := p.upstreamClient.Do(req)
+	if err != nil {
+		p.logEvent("Failed to revalidate %s, error: %v", u, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		p.logEvent("Failed to revalidate %s, error: %v", u, err)
+		return
+	}
+
+	p.prepareResponseHeader(resp)
+	if p.cfg.Script != nil {
+		status, err := p.runResponseScript(req, u, resp)
+		if err != nil {
+			p.logEvent("Script error in on_response revalidating %s: %v", u, err)
+			return
+		}
+		if status != 0 {
+			// A client fetching it now would be answered with status, so
+			// stop serving the stale copy.
+			p.logEvent("Script answered response revalidating %s with %d", u, status)
+			p.cache.remove(entry.key)
+			return
+		}
+	}
+
+	body, ok := p.scanResponseBody(u, resp.Header, body)
+	if !ok {
+		// The stale copy may hold the same content, so stop serving it.
+		p.cache.remove(entry.key)
+		return
+	}
+	p.storeResponse(entry.key, entry.identity, u, req.Header, resp, body)
+	p.logEvent("Revalidated %s", u)
+}
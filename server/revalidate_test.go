@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var (
+		version atomic.Int32
+		hold    = make(chan struct{})
+	)
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		if n := version.Add(1); n > 1 {
+			<-hold
+		}
+		res.Write([]byte("v" + strconv.Itoa(int(version.Load()))))
+	}).String() + "/page"
+	p := newTestProxy(t, Config{CacheTTL: 20 * time.Millisecond, StaleWhileRevalidate: time.Minute, XCacheHeader: true})
+
+	get(p, target)
+	time.Sleep(30 * time.Millisecond)
+
+	// Both requests get the stale body at once while a single refresh waits
+	// on the upstream.
+	for i := 0; i < 2; i++ {
+		rec := get(p, target)
+		if rec.Body.String() != "v1" || rec.Header().Get("X-Cache") != "STALE" {
+			t.Errorf("request %d after expiry: %q, X-Cache %q; want the stale v1", i, rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	}
+	for deadline := time.Now().Add(2 * time.Second); version.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	get(p, target)
+	if n := version.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2 (the fill and one refresh)", n)
+	}
+	close(hold)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec := get(p, target)
+		if rec.Body.String() == "v2" {
+			if got := rec.Header().Get("X-Cache"); got != "HIT" {
+				t.Errorf("refreshed entry: X-Cache %q, want HIT", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still serving %q after the refresh", rec.Body.String())
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if n := version.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
+
+func TestStaleWindowEnds(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{CacheTTL: 10 * time.Millisecond, StaleWhileRevalidate: 10 * time.Millisecond, XCacheHeader: true})
+
+	get(p, target)
+	time.Sleep(30 * time.Millisecond)
+	if got := get(p, target).Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("past the stale window: X-Cache %q, want MISS", got)
+	}
+	if n := upstream.requests(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
+
+// TestRevalidationFollowsForwardingRules checks a background refresh sends
+// the headers a forwarded request would and passes the response through
+// on_response before storing it.
+func TestRevalidationFollowsForwardingRules(t *testing.T) {
+	var seen atomic.Value
+	upstream := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		seen.Store(req.Header.Clone())
+		res.Write([]byte("fresh"))
+	})
+	p := newTestProxy(t, Config{
+		CacheTTL:        time.Minute,
+		CachePOSTHeader: "X-Cache-Post",
+		XUpstreamHeader: true,
+		ViaName:         "proxy1",
+		Script: writeScript(t, `
+function on_response(resp)
+	if string.find(resp.url, "/gone", 1, true) then
+		return 403
+	end
+	resp.headers["X-Script"] = "on_response"
+end
+`),
+	})
+	revalidate := func(path string) *cacheEntry {
+		u, _ := url.Parse(upstream.String() + path)
+		entry := testEntry(path, "stale")
+		p.cache.add(entry)
+		p.revalidate(entry, u, u, http.Header{
+			"Accept":        {"*/*"},
+			"Connection":    {"close"},
+			"X-Cache-Post":  {"1"},
+			"X-Upstream":    {"backend-a"},
+			"X-Proxy-Debug": {"1"},
+			"Range":         {"bytes=0-1"},
+		})
+		e, _ := p.cache.get(path)
+		return e
+	}
+
+	e := revalidate("/page")
+	got := seen.Load().(http.Header)
+	for _, name := range []string{"Connection", "X-Cache-Post", "X-Upstream", "X-Proxy-Debug", "Range"} {
+		if v := got.Get(name); v != "" {
+			t.Errorf("revalidation sent %s: %q", name, v)
+		}
+	}
+	if got.Get("Accept") != "*/*" || got.Get("Via") != "1.1 proxy1" {
+		t.Errorf("revalidation sent Accept %q, Via %q", got.Get("Accept"), got.Get("Via"))
+	}
+	if e == nil || string(e.body) != "fresh" || e.header.Get("X-Script") != "on_response" {
+		t.Fatalf("refreshed entry %+v, want the fresh body with on_response's header", e)
+	}
+
+	// A response on_response blocks is no longer served stale.
+	if e := revalidate("/gone"); e != nil {
+		t.Errorf("entry on_response blocked still cached with body %q", e.body)
+	}
+}
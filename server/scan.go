@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ScanDecision is a ContentScanner's verdict on a body.
+type ScanDecision int
+
+const (
+	ScanAllow ScanDecision = iota
+	ScanRedact
+	ScanBlock
+)
+
+// ContentScanner inspects request and response bodies for data that must not
+// pass through the proxy. With ScanRedact it also returns the body to send
+// in place of the original.
+type ContentScanner interface {
+	Scan(body []byte) (ScanDecision, []byte)
+}
+
+// redactedText replaces each span matched by a redact rule.
+const redactedText = "[REDACTED]"
+
+type scanRule struct {
+	action ScanDecision
+	re     *regexp.Regexp
+}
+
+// regexScanner blocks a body matching any block rule, and otherwise replaces
+// the spans matching redact rules.
+type regexScanner []scanRule
+
+func (s regexScanner) Scan(body []byte) (ScanDecision, []byte) {
+	for _, rule := range s {
+		if rule.action == ScanBlock && rule.re.Match(body) {
+			return ScanBlock, nil
+		}
+	}
+	decision := ScanAllow
+	for _, rule := range s {
+		if rule.action == ScanRedact && rule.re.Match(body) {
+			body = rule.re.ReplaceAllLiteral(body, []byte(redactedText))
+			decision = ScanRedact
+		}
+	}
+	return decision, body
+}
+
+// loadScanRules reads a rules file with one "block <regexp>" or
+// "redact <regexp>" per line. Blank lines and lines starting with # are
+// ignored.
+func loadScanRules(path string) (regexScanner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules regexScanner
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action, pattern, _ := strings.Cut(line, " ")
+		rule := scanRule{}
+		switch action {
+		case "block":
+			rule.action = ScanBlock
+		case "redact":
+			rule.action = ScanRedact
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q, want block or redact", path, n, action)
+		}
+		if rule.re, err = regexp.Compile(strings.TrimSpace(pattern)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// errScanBodyTooLarge is returned for a request body over -scan-max-body.
+var errScanBodyTooLarge = errors.New("request body too large to scan")
+
+// scanRequestBody buffers and scans the request body, replacing it when
+// redacted. It returns false if the request must be blocked. A body over
+// -scan-max-body is not read past the limit and fails with
+// errScanBodyTooLarge; letting it through unscanned would be a way around
+// the rules.
+func (p *Proxy) scanRequestBody(req *http.Request) (bool, error) {
+	if p.cfg.Scanner == nil || req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	if req.ContentLength > p.cfg.ScanMaxBody {
+		return false, errScanBodyTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, p.cfg.ScanMaxBody+1))
+	req.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	if int64(len(body)) > p.cfg.ScanMaxBody {
+		return false, errScanBodyTooLarge
+	}
+	decision, scanned := p.cfg.Scanner.Scan(body)
+	switch decision {
+	case ScanBlock:
+		p.logEvent("CONTENT BLOCKED: request body for %s from %s", req.RequestURI, p.clientIP(req))
+		p.metrics.IncCounter("proxy_content_scan_total", map[string]string{"direction": "request", "decision": "block"})
+		return false, nil
+	case ScanRedact:
+		p.logEvent("CONTENT REDACTED: request body for %s from %s", req.RequestURI, p.clientIP(req))
+		p.metrics.IncCounter("proxy_content_scan_total", map[string]string{"direction": "request", "decision": "redact"})
+		body = scanned
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return true, nil
+}
+
+// scanResponseBody scans an upstream response body before it is cached or
+// sent. It returns the body to use, or false if the response must be
+// blocked. A redacted body's length changes, so Content-Length is dropped
+// from header; a no-transform response that would be redacted is blocked
+// instead.
+func (p *Proxy) scanResponseBody(u *url.URL, header http.Header, body []byte) ([]byte, bool) {
+	if p.cfg.Scanner == nil {
+		return body, true
+	}
+	decision, scanned := p.cfg.Scanner.Scan(body)
+	switch decision {
+	case ScanBlock:
+		p.logEvent("CONTENT BLOCKED: response body from %s", u)
+		p.metrics.IncCounter("proxy_content_scan_total", map[string]string{"direction": "response", "decision": "block"})
+		return nil, false
+	case ScanRedact:
+		// A body that may not be changed can't be redacted, and letting it
+		// through would let the upstream opt out of scanning.
+		if noTransform(header) {
+			p.logEvent("CONTENT BLOCKED: response body from %s needs redacting but is no-transform", u)
+			p.metrics.IncCounter("proxy_content_scan_total", map[string]string{"direction": "response", "decision": "block"})
+			return nil, false
+		}
+		p.logEvent("CONTENT REDACTED: response body from %s", u)
+		p.metrics.IncCounter("proxy_content_scan_total", map[string]string{"direction": "response", "decision": "redact"})
+		header.Del("Content-Length")
+		return scanned, true
+	}
+	return body, true
+}
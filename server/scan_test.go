@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// echoBody answers each request with its body.
+func echoBody(res http.ResponseWriter, req *http.Request) {
+	io.Copy(res, req.Body)
+}
+
+func testScanner() regexScanner {
+	return regexScanner{
+		{action: ScanBlock, re: regexp.MustCompile(`(?i)bluebird`)},
+		{action: ScanRedact, re: regexp.MustCompile(`\d{4}-\d{4}`)},
+	}
+}
+
+func TestScanRequestBody(t *testing.T) {
+	target := newTestUpstream(t, echoBody).String() + "/echo"
+	p := newTestProxy(t, Config{Scanner: testScanner(), ScanMaxBody: 64})
+
+	for _, tc := range []struct {
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"hello", http.StatusOK, "hello"},
+		{"card 1234-5678", http.StatusOK, "card " + redactedText},
+		{"about Bluebird", http.StatusForbidden, ""},
+		{strings.Repeat("x", 65), http.StatusRequestEntityTooLarge, ""},
+		{strings.Repeat("x", 64), http.StatusOK, strings.Repeat("x", 64)},
+	} {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(tc.body))
+		rec := serve(p, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("POST %.20q: status %d, want %d", tc.body, rec.Code, tc.wantCode)
+			continue
+		}
+		if tc.wantCode == http.StatusOK && rec.Body.String() != tc.wantBody {
+			t.Errorf("POST %.20q: upstream got %q, want %q", tc.body, rec.Body.String(), tc.wantBody)
+		}
+	}
+}
+
+// TestScanRefusesChunkedBodyOverLimit checks a body with no Content-Length
+// is refused once it passes -scan-max-body, rather than read in full.
+func TestScanRefusesChunkedBodyOverLimit(t *testing.T) {
+	upstream := &countingHandler{}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/echo"
+	p := newTestProxy(t, Config{Scanner: testScanner(), ScanMaxBody: 1024})
+
+	body := &countingReader{r: strings.NewReader(strings.Repeat("x", 1<<20))}
+	req := httptest.NewRequest(http.MethodPost, target, body)
+	req.ContentLength = -1
+	if rec := serve(p, req); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", rec.Code)
+	}
+	if body.n > 64<<10 {
+		t.Errorf("read %d bytes of the body, want about 1024", body.n)
+	}
+	if upstream.requests() != 0 {
+		t.Error("oversized body was forwarded")
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scheduleRule allows or blocks hosts matching pattern by time of day. A
+// "block" rule denies them from start until end; an "allow" rule denies
+// them at any other time. start and end are minutes after midnight, and a
+// window whose end is not after its start runs past midnight.
+type scheduleRule struct {
+	action  string
+	pattern string
+	start   int
+	end     int
+}
+
+// parseScheduleRules parses a comma-separated list of
+// action:pattern=HH:MM-HH:MM rules, such as
+// "block:*.facebook.com=09:00-17:00,allow:*.example.org=08:00-18:00".
+func parseScheduleRules(s string) ([]scheduleRule, error) {
+	var rules []scheduleRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		rule, window, ok := strings.Cut(item, "=")
+		action, pattern, ok2 := strings.Cut(rule, ":")
+		if !ok || !ok2 || pattern == "" || (action != "allow" && action != "block") {
+			return nil, fmt.Errorf("invalid schedule rule %q, want allow:pattern=HH:MM-HH:MM or block:pattern=HH:MM-HH:MM", item)
+		}
+		from, to, ok := strings.Cut(window, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule rule %q, want a HH:MM-HH:MM window", item)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule rule %q: %v", item, err)
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule rule %q: %v", item, err)
+		}
+		rules = append(rules, scheduleRule{action: action, pattern: strings.ToLower(pattern), start: start, end: end})
+	}
+	return rules, nil
+}
+
+// parseClock parses an HH:MM time of day into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether minute, after midnight, falls in the rule's
+// window.
+func (r scheduleRule) contains(minute int) bool {
+	if r.start < r.end {
+		return minute >= r.start && minute < r.end
+	}
+	return minute >= r.start || minute < r.end
+}
+
+// window formats the rule's window for log lines.
+func (r scheduleRule) window() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", r.start/60, r.start%60, r.end/60, r.end%60)
+}
+
+// scheduleDenied returns the first -schedule-rules entry that denies host
+// at now, read in the -schedule-timezone.
+func (p *Proxy) scheduleDenied(host string, now time.Time) (scheduleRule, bool) {
+	if len(p.cfg.ScheduleRules) == 0 {
+		return scheduleRule{}, false
+	}
+	if p.cfg.ScheduleLocation != nil {
+		now = now.In(p.cfg.ScheduleLocation)
+	}
+	minute := now.Hour()*60 + now.Minute()
+	host = strings.ToLower(host)
+	for _, rule := range p.cfg.ScheduleRules {
+		if !globMatch(rule.pattern, host) {
+			continue
+		}
+		if rule.contains(minute) == (rule.action == "block") {
+			return rule, true
+		}
+	}
+	return scheduleRule{}, false
+}
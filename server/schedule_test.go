@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestScheduleRules(t *testing.T) {
+	rules, err := parseScheduleRules("block:*.social.example=09:00-17:00, allow:reports.example=08:00-18:00, block:night.example=22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tz := time.FixedZone("UTC+2", 2*60*60)
+	p := newTestProxy(t, Config{ScheduleRules: rules, ScheduleLocation: tz})
+	at := func(clock string) time.Time {
+		when, _ := time.ParseInLocation("2006-01-02 15:04", "2026-03-02 "+clock, tz)
+		return when
+	}
+
+	cases := []struct {
+		host, clock string
+		denied      bool
+	}{
+		{"feed.social.example", "08:59", false},
+		{"feed.social.example", "09:00", true},
+		{"FEED.social.example", "16:59", true},
+		{"feed.social.example", "17:00", false},
+		{"reports.example", "12:00", false},
+		{"reports.example", "19:30", true},
+		{"night.example", "23:00", true},
+		{"night.example", "05:59", true},
+		{"night.example", "06:00", false},
+		{"other.example", "12:00", false},
+	}
+	for _, c := range cases {
+		if _, denied := p.scheduleDenied(c.host, at(c.clock)); denied != c.denied {
+			t.Errorf("%s at %s: denied %v, want %v", c.host, c.clock, denied, c.denied)
+		}
+	}
+
+	// The rules are read in the configured zone, whatever zone now is in.
+	if _, denied := p.scheduleDenied("feed.social.example", at("10:00").UTC()); !denied {
+		t.Error("10:00 UTC+2 given as 08:00 UTC was not denied")
+	}
+}
+
+func TestScheduleBlocksRequests(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/"
+	// A window from midnight to midnight covers the whole day.
+	rules, err := parseScheduleRules("block:127.0.0.1=00:00-00:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{ScheduleRules: rules})
+	if rec := get(p, target); rec.Code != http.StatusForbidden {
+		t.Errorf("blocked host: status %d, want 403", rec.Code)
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("upstream got %d requests, want 0", n)
+	}
+}
+
+func TestParseScheduleRulesRejectsBadRules(t *testing.T) {
+	for _, s := range []string{"deny:a.example=09:00-17:00", "block:a.example", "block:=09:00-17:00", "block:a.example=9-17", "block:a.example=09:00-25:00"} {
+		if _, err := parseScheduleRules(s); err == nil {
+			t.Errorf("parseScheduleRules(%q) succeeded", s)
+		}
+	}
+}
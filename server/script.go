@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// luaScript is a compiled -script. Lua states can't be shared between
+// goroutines, so each concurrent request takes its own from a pool, with the
+// script already run in it.
+type luaScript struct {
+	proto  *lua.FunctionProto
+	states sync.Pool
+}
+
+// loadScript compiles the script at path and runs it once to check that it
+// defines on_request or on_response.
+func loadScript(path string) (*luaScript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &luaScript{proto: proto}
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	if L.GetGlobal("on_request").Type() != lua.LTFunction && L.GetGlobal("on_response").Type() != lua.LTFunction {
+		L.Close()
+		return nil, errors.New("script defines neither on_request nor on_response")
+	}
+	s.states.Put(L)
+	return s, nil
+}
+
+// newState returns a state with the script loaded. Only the base, table,
+// string and math libraries are available, so scripts can't reach the file
+// system or run commands.
+func (s *luaScript) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// call runs the global function name, if the script defines it, on the
+// table built by arg. A status code returned by the function is passed back
+// for the caller to answer with; otherwise done applies the changes the
+// function made to the table.
+func (s *luaScript) call(req *http.Request, name string, arg func(*lua.LState) *lua.LTable, done func(*lua.LTable)) (int, error) {
+	L, ok := s.states.Get().(*lua.LState)
+	if !ok {
+		var err error
+		if L, err = s.newState(); err != nil {
+			return 0, err
+		}
+	}
+	fn := L.GetGlobal(name)
+	if fn.Type() != lua.LTFunction {
+		s.states.Put(L)
+		return 0, nil
+	}
+
+	t := arg(L)
+	L.SetContext(req.Context())
+	err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, t)
+	L.RemoveContext()
+	if err != nil {
+		// The state may be left mid-call, so it is not reused.
+		L.Close()
+		return 0, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	s.states.Put(L)
+
+	if n, ok := ret.(lua.LNumber); ok {
+		status := int(n)
+		if status < 100 || status > 599 {
+			return 0, fmt.Errorf("%s returned invalid status %v", name, n)
+		}
+		return status, nil
+	}
+	done(t)
+	return 0, nil
+}
+
+// runRequestScript passes the request to on_request as a table with method,
+// url, client_ip and headers fields. Changes the script makes to url and
+// headers are applied to req; a rewritten URL is returned. A number returned
+// by the script is a status to block the request with.
+func (p *Proxy) runRequestScript(req *http.Request, u *url.URL) (*url.URL, int, error) {
+	var rewritten *url.URL
+	var rewriteErr error
+	status, err := p.cfg.Script.call(req, "on_request", func(L *lua.LState) *lua.LTable {
+		t := L.NewTable()
+		t.RawSetString("method", lua.LString(req.Method))
+		t.RawSetString("url", lua.LString(u.String()))
+		t.RawSetString("client_ip", lua.LString(p.clientIP(req)))
+		t.RawSetString("headers", headerTable(L, req.Header))
+		return t
+	}, func(t *lua.LTable) {
+		if headers, ok := t.RawGetString("headers").(*lua.LTable); ok {
+			applyHeaderTable(headers, req.Header)
+		}
+		if s := t.RawGetString("url").String(); s != u.String() {
+			rewritten, rewriteErr = url.Parse(s)
+			if rewriteErr == nil && ((rewritten.Scheme != "http" && rewritten.Scheme != "https") || rewritten.Host == "") {
+				rewriteErr = fmt.Errorf("on_request set invalid url %q", s)
+			}
+		}
+	})
+	if err == nil {
+		err = rewriteErr
+	}
+	return rewritten, status, err
+}
+
+// runResponseScript passes the upstream response to on_response as a table
+// with url, status and headers fields. Header changes are applied to resp
+// before it is cached and sent. A number returned by the script is a status
+// to answer with instead.
+func (p *Proxy) runResponseScript(req *http.Request, u *url.URL, resp *http.Response) (int, error) {
+	return p.cfg.Script.call(req, "on_response", func(L *lua.LState) *lua.LTable {
+		t := L.NewTable()
+		t.RawSetString("url", lua.LString(u.String()))
+		t.RawSetString("status", lua.LNumber(resp.StatusCode))
+		t.RawSetString("headers", headerTable(L, resp.Header))
+		return t
+	}, func(t *lua.LTable) {
+		if headers, ok := t.RawGetString("headers").(*lua.LTable); ok {
+			applyHeaderTable(headers, resp.Header)
+		}
+	})
+}
+
+// headerTable converts h to a Lua table keyed by canonical header name, with
+// repeated values joined by ", ".
+func headerTable(L *lua.LState, h http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name, values := range h {
+		t.RawSetString(name, lua.LString(strings.Join(values, ", ")))
+	}
+	return t
+}
+
+// applyHeaderTable writes the changes a script made to t back to h. Headers
+// the script removed are deleted, and headers it left alone keep all of
+// their original values.
+func applyHeaderTable(t *lua.LTable, h http.Header) {
+	for name := range h {
+		if t.RawGetString(name) == lua.LNil {
+			h.Del(name)
+		}
+	}
+	t.ForEach(func(k, v lua.LValue) {
+		name := http.CanonicalHeaderKey(k.String())
+		if value := v.String(); strings.Join(h.Values(name), ", ") != value {
+			h.Set(name, value)
+		}
+	})
+}
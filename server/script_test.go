@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeScript(t *testing.T, source string) *luaScript {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.lua")
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadScript(path)
+	if err != nil {
+		t.Fatalf("loadScript: %v", err)
+	}
+	return s
+}
+
+const testScript = `
+function on_request(req)
+	if string.find(req.url, "/blocked", 1, true) then
+		return 403
+	end
+	req.headers["X-Injected"] = "from-lua"
+	req.headers["X-Remove-Me"] = nil
+	req.url = string.gsub(req.url, "/old/", "/new/")
+end
+
+function on_response(resp)
+	resp.headers["X-Script-Status"] = tostring(resp.status)
+end
+`
+
+func TestScriptHooks(t *testing.T) {
+	u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.URL.Path + " " + req.Header.Get("X-Injected") + " " + req.Header.Get("X-Remove-Me")))
+	})
+	p := newTestProxy(t, Config{Script: writeScript(t, testScript)})
+
+	req := freshGet(u.String() + "/old/page")
+	req.Header.Set("X-Remove-Me", "secret")
+	rec := serve(p, req)
+	if got := strings.TrimSpace(rec.Body.String()); got != "/new/page from-lua" {
+		t.Errorf("upstream saw %q, want the rewritten path and injected header only", got)
+	}
+	if got := rec.Header().Get("X-Script-Status"); got != "200" {
+		t.Errorf("X-Script-Status %q, want on_response's header", got)
+	}
+
+	if rec := get(p, u.String()+"/blocked"); rec.Code != http.StatusForbidden {
+		t.Errorf("blocked URL: status %d, want 403", rec.Code)
+	}
+}
+
+func TestLoadScriptRejectsScriptsWithoutHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.lua")
+	os.WriteFile(path, []byte("x = 1\n"), 0o644)
+	if _, err := loadScript(path); err == nil {
+		t.Error("loadScript accepted a script with no hooks")
+	}
+	os.WriteFile(path, []byte("function on_request(\n"), 0o644)
+	if _, err := loadScript(path); err == nil {
+		t.Error("loadScript accepted a syntax error")
+	}
+}
+
+func TestScriptCannotReachOS(t *testing.T) {
+	u := newTestUpstream(t, (&countingHandler{body: "ok"}).ServeHTTP)
+	p := newTestProxy(t, Config{Script: writeScript(t, `
+function on_request(req)
+	os.execute("true")
+end
+`)})
+	if rec := get(p, u.String()+"/"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("script calling os.execute: status %d, want 500", rec.Code)
+	}
+}
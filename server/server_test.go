@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoHeader answers with the value of the request header name.
+func echoHeader(name string) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.Header.Get(name)))
+	}
+}
+
+func TestCacheKeyHeadersSeparateEntries(t *testing.T) {
+	target := newTestUpstream(t, echoHeader("X-Tenant-Id")).String() + "/data"
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, CacheKeyHeaders: []string{"X-Tenant-Id"}, XCacheHeader: true})
+
+	getAs := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Tenant-Id", tenant)
+		return serve(p, req)
+	}
+	for i, tc := range []struct{ tenant, cache string }{
+		{"a", "MISS"},
+		{"b", "MISS"},
+		{"a", "HIT"},
+		{"b", "HIT"},
+	} {
+		rec := getAs(tc.tenant)
+		if rec.Body.String() != tc.tenant {
+			t.Errorf("request %d as %s: got tenant %q's response", i, tc.tenant, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Cache"); got != tc.cache {
+			t.Errorf("request %d as %s: X-Cache %q, want %q", i, tc.tenant, got, tc.cache)
+		}
+	}
+	if n := p.cache.len(); n != 2 {
+		t.Errorf("cache holds %d entries, want 2", n)
+	}
+}
+
+func TestSlowRequestLogged(t *testing.T) {
+	slow := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(60 * time.Millisecond)
+		}
+		res.Write([]byte("ok"))
+	}).String()
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs, SlowThreshold: 30 * time.Millisecond})
+
+	serve(p, freshGet(slow+"/fast"))
+	serve(p, freshGet(slow+"/slow"))
+	lines := logs.lines("WARN Slow request")
+	if len(lines) != 1 {
+		t.Fatalf("logged %d slow requests, want 1:\n%s", len(lines), logs)
+	}
+	if !strings.Contains(lines[0], "/slow status 200") {
+		t.Errorf("slow request line %q doesn't name the request and status", lines[0])
+	}
+}
+
+// TestCacheNamespacesDoNotShareEntries loads one proxy's cache snapshot into
+// others, as deployments sharing a snapshot or disk cache would, and checks
+// only the same namespace's entries are served.
+func TestCacheNamespacesDoNotShareEntries(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	a := newTestProxy(t, Config{CacheNamespace: "a"})
+	get(a, target)
+	if _, err := a.saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ namespace, want string }{
+		{"a", "HIT"},
+		{"b", "MISS"},
+		{"", "MISS"},
+	} {
+		p := newTestProxy(t, Config{CacheNamespace: tc.namespace, XCacheHeader: true})
+		if _, err := p.loadSnapshot(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got := get(p, target).Header().Get("X-Cache"); got != tc.want {
+			t.Errorf("namespace %q: X-Cache %q, want %q", tc.namespace, got, tc.want)
+		}
+	}
+	if a.cacheKey("x") == newTestProxy(t, Config{CacheNamespace: "b"}).cacheKey("x") {
+		t.Error("namespaces a and b build the same key")
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	cases := []struct {
+		target, host string
+		want         string
+		originForm   bool
+	}{
+		{"http://api.example.com:8443/v1?q=1", "", "http://api.example.com:8443/v1?q=1", false},
+		{"http://API.example.com:80/v1", "", "http://api.example.com/v1", false},
+		{"/v1/items?q=1", "api.example.com:8443", "http://api.example.com:8443/v1/items?q=1", true},
+		{"/v1", "api.example.com:80", "http://api.example.com/v1", true},
+		{"/v1", "[2001:db8::1]:8443", "http://[2001:db8::1]:8443/v1", true},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.target, nil)
+		if c.host != "" {
+			req.Host = c.host
+		}
+		u, originForm, err := requestURL(req)
+		if err != nil {
+			t.Errorf("%s (Host %s): %v", c.target, c.host, err)
+			continue
+		}
+		if u.String() != c.want || originForm != c.originForm {
+			t.Errorf("%s (Host %s) = %s, origin-form %v; want %s, %v", c.target, c.host, u, originForm, c.want, c.originForm)
+		}
+	}
+}
+
+func TestRequestURLRejectsBadTargets(t *testing.T) {
+	for _, c := range []struct{ target, host string }{
+		{"ftp://example.com/file", ""},
+		{"/v1", "user@example.com"},
+		{"/v1", "example.com/extra"},
+		{"http://example.com/v1", "other.example.com"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, c.target, nil)
+		if c.host != "" {
+			req.Host = c.host
+		}
+		if u, _, err := requestURL(req); err == nil {
+			t.Errorf("%s (Host %s) = %s, want an error", c.target, c.host, u)
+		}
+	}
+}
+
+func TestOriginFormRequestKeepsPort(t *testing.T) {
+	upstream := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(req.URL.RequestURI()))
+	})
+	p := newTestProxy(t, Config{})
+
+	req := httptest.NewRequest(http.MethodGet, "/items?page=2", nil)
+	req.Host = upstream.Host // 127.0.0.1:<port>
+	rec := serve(p, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "/items?page=2" {
+		t.Errorf("origin-form request: status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDefaultUpstream(t *testing.T) {
+	named := func(name string) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(res, "%s %s", name, req.URL.RequestURI())
+		}
+	}
+	backend := newTestUpstream(t, named("backend"))
+	other := newTestUpstream(t, named("other"))
+	p := newTestProxy(t, Config{DefaultUpstream: backend})
+
+	// An origin-form request for any Host goes to the default upstream...
+	rec := serve(p, originGet("/items?page=2"))
+	if rec.Code != http.StatusOK || rec.Body.String() != "backend /items?page=2" {
+		t.Errorf("origin-form request: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	// ...while an absolute-URI request is still forward-proxied.
+	rec = get(p, other.String()+"/items")
+	if rec.Code != http.StatusOK || rec.Body.String() != "other /items" {
+		t.Errorf("absolute-URI request: status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	// -backends takes precedence over -default-upstream.
+	backends, err := parseBackends(newNamedBackends(t, map[string]int{"pool": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = newTestProxy(t, Config{DefaultUpstream: backend, Backends: backends})
+	if rec := serve(p, originGet("/")); rec.Body.String() != "pool" {
+		t.Errorf("with -backends set: body %q, want pool", rec.Body.String())
+	}
+}
+
+func TestLogStdout(t *testing.T) {
+	var console logBuffer
+	log.SetOutput(&console)
+	defer log.SetOutput(os.Stderr)
+
+	for _, stdout := range []bool{true, false} {
+		console.mu.Lock()
+		console.buf.Reset()
+		console.mu.Unlock()
+		file := &logBuffer{}
+		p := newTestProxy(t, Config{LogFile: file, LogStdout: stdout})
+		p.logEvent("cache swept")
+
+		if got := len(file.lines("cache swept")); got != 1 {
+			t.Errorf("LogStdout %v: log file has %d events, want 1", stdout, got)
+		}
+		if got := len(console.lines("cache swept")); (got == 1) != stdout {
+			t.Errorf("LogStdout %v: console has %d events", stdout, got)
+		}
+	}
+}
+
+func TestMaxURLLength(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	base := newTestUpstream(t, upstream.ServeHTTP).String() + "/"
+	p := newTestProxy(t, Config{MaxURLLength: 64})
+
+	long := base + strings.Repeat("a", 64-len(base)+1)
+	if rec := get(p, long); rec.Code != http.StatusRequestURITooLong {
+		t.Errorf("%d-byte URL: status %d, want 414", len(long), rec.Code)
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("upstream got %d requests for an over-long URL", n)
+	}
+	fits := base + strings.Repeat("a", 64-len(base))
+	if rec := get(p, fits); rec.Code != http.StatusOK {
+		t.Errorf("%d-byte URL: status %d, want 200", len(fits), rec.Code)
+	}
+}
+
+func TestXCacheHeader(t *testing.T) {
+	upstream := &countingHandler{body: "hello", header: http.Header{"X-Cache": {"HIT from cdn"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+
+	p := newTestProxy(t, Config{XCacheHeader: true})
+	for i, want := range []string{"MISS", "HIT"} {
+		if got := get(p, target).Header().Values("X-Cache"); len(got) != 1 || got[0] != want {
+			t.Errorf("request %d: X-Cache %q, want %q", i, got, want)
+		}
+	}
+	if got := postThrough(p, target, "x").Header().Get("X-Cache"); got != "BYPASS" {
+		t.Errorf("POST: X-Cache %q, want BYPASS", got)
+	}
+
+	// Turned off, the proxy adds nothing and the upstream's header passes
+	// through.
+	p = newTestProxy(t, Config{})
+	get(p, target)
+	if got := get(p, target).Header().Get("X-Cache"); got != "HIT from cdn" {
+		t.Errorf("without -x-cache: X-Cache %q, want the upstream's", got)
+	}
+}
+
+func TestHTTP10ClientConnections(t *testing.T) {
+	upstream := &countingHandler{body: "hello", header: http.Header{"Keep-Alive": {"timeout=1"}}}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	srv := httptest.NewServer(newTestProxy(t, Config{}))
+	defer srv.Close()
+
+	send := func(conn net.Conn, r *bufio.Reader, connection string) *http.Response {
+		t.Helper()
+		fmt.Fprintf(conn, "GET %s HTTP/1.0\r\n", target)
+		if connection != "" {
+			fmt.Fprintf(conn, "Connection: %s\r\n", connection)
+		}
+		fmt.Fprint(conn, "\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "hello" {
+			t.Errorf("body %q", body)
+		}
+		if resp.Header.Get("Keep-Alive") != "" {
+			t.Error("upstream's Keep-Alive header passed to the client")
+		}
+		return resp
+	}
+
+	// Without asking for keep-alive, the connection closes after one response.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send(conn, r, "")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("HTTP/1.0 connection without keep-alive: read %v, want EOF", err)
+	}
+
+	// With it, the response says so and carries a length, and the connection
+	// serves another request.
+	conn, err = net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		resp := send(conn, r, "keep-alive")
+		if got := resp.Header.Get("Connection"); !strings.EqualFold(got, "keep-alive") {
+			t.Errorf("request %d: Connection %q, want keep-alive", i, got)
+		}
+		if resp.ContentLength != int64(len("hello")) {
+			t.Errorf("request %d: Content-Length %d", i, resp.ContentLength)
+		}
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	var seen http.Header
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		seen = req.Header.Clone()
+		res.Header().Set("X-Tracking-Id", "abc")
+		res.Header().Set("Server-Timing", "db;dur=53")
+		res.Header().Set("Content-Type", "text/plain")
+		res.Write([]byte("ok"))
+	}).String() + "/page"
+	p := newTestProxy(t, Config{
+		StripRequestHeaders:  []string{"referer", "Cookie", "X-Forwarded-For"},
+		StripResponseHeaders: []string{"X-Tracking-Id", "server-timing"},
+	})
+
+	req := freshGet(target)
+	req.Header.Set("Referer", "https://private.example/")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header.Set("Accept", "text/plain")
+	rec := serve(p, req)
+
+	for _, name := range []string{"Referer", "Cookie"} {
+		if v := seen.Get(name); v != "" {
+			t.Errorf("upstream got %s %q, want it stripped", name, v)
+		}
+	}
+	if strings.Contains(seen.Get("X-Forwarded-For"), "203.0.113.9") {
+		t.Errorf("upstream got the client's X-Forwarded-For %q", seen.Get("X-Forwarded-For"))
+	}
+	if seen.Get("Accept") != "text/plain" {
+		t.Error("unlisted request header not forwarded")
+	}
+	for _, name := range []string{"X-Tracking-Id", "Server-Timing"} {
+		if v := rec.Header().Get(name); v != "" {
+			t.Errorf("client got %s %q, want it stripped", name, v)
+		}
+	}
+	if rec.Header().Get("Content-Type") != "text/plain" {
+		t.Error("unlisted response header not passed through")
+	}
+
+	// A cached response went through the strip list before it was stored.
+	if got := get(p, target).Header().Get("X-Tracking-Id"); got != "" {
+		t.Errorf("cache hit: X-Tracking-Id %q, want it stripped", got)
+	}
+}
+
+func TestForwardHeadersAllowlist(t *testing.T) {
+	var seen http.Header
+	var length int64
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		seen = req.Header.Clone()
+		body, _ := io.ReadAll(req.Body)
+		length = int64(len(body))
+		res.Write([]byte("ok"))
+	}).String() + "/submit"
+	p := newTestProxy(t, Config{ForwardHeadersAllowlist: []string{"accept", "Content-Type"}})
+
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"a":1}`))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Internal-Trace", "abc")
+	req.Header.Set("User-Agent", "curl/8.0")
+	if rec := serve(p, req); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+
+	for _, name := range []string{"Accept", "Content-Type"} {
+		if seen.Get(name) == "" {
+			t.Errorf("listed header %s not forwarded", name)
+		}
+	}
+	for _, name := range []string{"Authorization", "X-Internal-Trace", "User-Agent"} {
+		if v := seen.Get(name); v != "" {
+			t.Errorf("unlisted header %s forwarded as %q", name, v)
+		}
+	}
+	// Framing comes from the request itself, not the allowlist.
+	if length != 7 || seen.Get("Content-Length") != "7" {
+		t.Errorf("upstream got a %d byte body with Content-Length %q, want 7", length, seen.Get("Content-Length"))
+	}
+}
+
+func TestHeadServedFromCachedGet(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		methods = append(methods, req.Method)
+		mu.Unlock()
+		res.Header().Set("ETag", `"v1"`)
+		res.Header().Set("Cache-Control", "max-age=60")
+		res.Write([]byte("hello, world"))
+	}).String()
+	upstreamMethods := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(methods, ",")
+	}
+	p := newTestProxy(t, Config{XCacheHeader: true})
+
+	// A HEAD with nothing cached goes upstream and caches nothing.
+	head := httptest.NewRequest(http.MethodHead, target+"/page", nil)
+	if rec := serve(p, head); rec.Header().Get("X-Cache") == "HIT" {
+		t.Error("HEAD with nothing cached was a HIT")
+	}
+	if got := get(p, target+"/page").Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("GET after an uncached HEAD: X-Cache %q, want MISS", got)
+	}
+
+	rec := serve(p, httptest.NewRequest(http.MethodHead, target+"/page", nil))
+	if got := rec.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("HEAD after a GET: X-Cache %q, want HIT", got)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("HEAD served %d body bytes", rec.Body.Len())
+	}
+	if got := rec.Header().Get("Content-Length"); got != "12" {
+		t.Errorf("HEAD Content-Length %q, want 12", got)
+	}
+	if got := rec.Header().Get("ETag"); got != `"v1"` {
+		t.Errorf("HEAD ETag %q, want the cached GET's", got)
+	}
+	if got := upstreamMethods(); got != "HEAD,GET" {
+		t.Errorf("upstream got %s, want HEAD,GET", got)
+	}
+
+	// A stale entry is left for a GET to revalidate.
+	for _, e := range p.cache.entries() {
+		e.expires = time.Now().Add(-time.Second)
+	}
+	serve(p, httptest.NewRequest(http.MethodHead, target+"/page", nil))
+	if got := upstreamMethods(); got != "HEAD,GET,HEAD" {
+		t.Errorf("upstream got %s, want the stale entry's HEAD forwarded", got)
+	}
+}
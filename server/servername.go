@@ -0,0 +1,22 @@
+package main
+
+import "net/http"
+
+// setServer gives a response the proxy is about to handle -server-name as
+// its Server header, so errors and the proxy's own endpoints identify it.
+// A relayed response that brings its own Server keeps that one instead;
+// -strip-response-headers Server removes it, leaving the proxy's.
+func (p *Proxy) setServer(res http.ResponseWriter) {
+	if p.cfg.ServerName != "" {
+		res.Header().Set("Server", p.cfg.ServerName)
+	}
+}
+
+// yieldServer drops the Server header set by setServer from dst when the
+// header about to be copied into it, src, carries one, so the response
+// doesn't name two servers.
+func yieldServer(dst, src http.Header) {
+	if _, ok := src["Server"]; ok {
+		dst.Del("Server")
+	}
+}
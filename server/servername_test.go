@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerNameOnProxyResponses(t *testing.T) {
+	const name = "edge-proxy/1.0"
+	target := newTestUpstream(t, (&countingHandler{body: "ok"}).ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{ServerName: name, RateLimit: 1})
+
+	badTarget := httptest.NewRequest(http.MethodGet, "/", nil)
+	badTarget.RequestURI = "ftp://example.com/file"
+	badTarget.URL.Scheme, badTarget.URL.Host = "ftp", "example.com"
+	badTarget.RemoteAddr = "198.51.100.8:1234"
+	// The upstream drops the connection without answering.
+	dropped := newTestUpstream(t, (&flakyUpstream{fails: 1}).ServeHTTP).String()
+	failed := httptest.NewRequest(http.MethodGet, dropped+"/page", nil)
+	failed.RemoteAddr = "198.51.100.9:1234"
+	get(p, target)
+	for what, c := range map[string]struct {
+		req  *http.Request
+		code int
+	}{
+		"bad request":     {badTarget, http.StatusBadRequest},
+		"rate limited":    {httptest.NewRequest(http.MethodGet, target, nil), http.StatusTooManyRequests},
+		"upstream failed": {failed, http.StatusInternalServerError},
+		"/stats":          {adminRequest(http.MethodGet, "/stats"), http.StatusOK},
+	} {
+		rec := serve(p, c.req)
+		if rec.Code != c.code || rec.Header().Get("Server") != name {
+			t.Errorf("%s: status %d, Server %q; want %d, %q", what, rec.Code, rec.Header().Get("Server"), c.code, name)
+		}
+	}
+}
+
+func TestServerNameOnRelayedResponses(t *testing.T) {
+	const name = "edge-proxy/1.0"
+	withServer := newTestUpstream(t, (&countingHandler{body: "ok", header: http.Header{"Server": {"nginx"}}}).ServeHTTP).String()
+	without := newTestUpstream(t, (&countingHandler{body: "ok"}).ServeHTTP).String()
+
+	p := newTestProxy(t, Config{ServerName: name})
+	if got := get(p, withServer+"/page").Header().Values("Server"); len(got) != 1 || got[0] != "nginx" {
+		t.Errorf("upstream with Server: got Server %q, want only nginx", got)
+	}
+	if got := get(p, without+"/page").Header().Get("Server"); got != name {
+		t.Errorf("upstream without Server: got Server %q, want %q", got, name)
+	}
+
+	p = newTestProxy(t, Config{ServerName: name, StripResponseHeaders: []string{"Server"}})
+	if got := get(p, withServer+"/other").Header().Values("Server"); len(got) != 1 || got[0] != name {
+		t.Errorf("with Server stripped: got Server %q, want only %q", got, name)
+	}
+
+	if got := get(newTestProxy(t, Config{}), without+"/page").Header().Get("Server"); got != "" {
+		t.Errorf("without -server-name: got Server %q", got)
+	}
+}
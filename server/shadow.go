@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// shadowMaxBody is the largest request body buffered for replay; larger
+// requests are not shadowed.
+const shadowMaxBody = 1 << 20
+
+const shadowTimeout = 30 * time.Second
+
+type primaryResult struct {
+	status int
+	size   int64
+}
+
+// shadowRequest is an in-flight copy of a request sent to -shadow-backend.
+// Its outcome is compared with the primary response once both are known.
+type shadowRequest struct {
+	primary chan primaryResult
+}
+
+// startShadow samples req at -shadow-rate and, if chosen, replays it
+// against the shadow backend in the background. It returns nil when the
+// request is not shadowed. The client's request body is buffered so both
+// copies can read it.
+func (p *Proxy) startShadow(req *http.Request, target *url.URL) *shadowRequest {
+	if p.cfg.ShadowBackend == nil || !p.cfg.ShadowMethods[req.Method] || rand.Float64() >= p.cfg.ShadowRate {
+		return nil
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(req.Body, shadowMaxBody+1))
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		if err != nil || len(buf) > shadowMaxBody {
+			return nil
+		}
+		body = buf
+	}
+
+	shadowURL := *target
+	shadowURL.Scheme = p.cfg.ShadowBackend.Scheme
+	shadowURL.Host = p.cfg.ShadowBackend.Host
+
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	shadowReq, err := http.NewRequestWithContext(ctx, req.Method, shadowURL.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil
+	}
+	shadowReq.Header = req.Header.Clone()
+	removeHopByHop(shadowReq.Header)
+	shadowReq.Header.Del("X-Proxy-Debug")
+
+	s := &shadowRequest{primary: make(chan primaryResult, 1)}
+	go func() {
+		defer cancel()
+		resp, err := p.upstreamClient.Do(shadowReq)
+		primary := <-s.primary
+		if err != nil {
+			p.logEvent("SHADOW %s %s: error %v (primary %d, %d bytes)", req.Method, shadowURL.String(), err, primary.status, primary.size)
+			p.metrics.IncCounter("proxy_shadow_requests_total", map[string]string{"result": "error"})
+			return
+		}
+		size, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		result := "match"
+		if resp.StatusCode != primary.status || size != primary.size {
+			result = "mismatch"
+		}
+		p.logEvent("SHADOW %s %s: %s, shadow %d, %d bytes, primary %d, %d bytes",
+			req.Method, shadowURL.String(), result, resp.StatusCode, size, primary.status, primary.size)
+		p.metrics.IncCounter("proxy_shadow_requests_total", map[string]string{"result": result})
+	}()
+	return s
+}
+
+// finish records the primary response so the shadow outcome can be compared
+// with it. It is safe to call on a nil shadowRequest.
+func (s *shadowRequest) finish(status int, size int64) {
+	if s != nil {
+		s.primary <- primaryResult{status: status, size: size}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// shadowResults waits until the proxy has recorded n shadow outcomes or a
+// half a second passes, and returns the number of matches and mismatches.
+func shadowResults(m *recordingMetrics, n int) (match, mismatch int) {
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		match = m.counter(`proxy_shadow_requests_total{result=match}`)
+		mismatch = m.counter(`proxy_shadow_requests_total{result=mismatch}`)
+		if match+mismatch >= n || time.Now().After(deadline) {
+			return match, mismatch
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newShadowProxy(t *testing.T, rate float64, shadow http.HandlerFunc) (*Proxy, *recordingMetrics) {
+	p := newTestProxy(t, Config{
+		ShadowBackend: newTestUpstream(t, shadow),
+		ShadowRate:    rate,
+		ShadowMethods: map[string]bool{http.MethodGet: true},
+	})
+	m := newRecordingMetrics()
+	p.metrics = m
+	return p, m
+}
+
+func TestShadowDoesNotAffectClient(t *testing.T) {
+	primary := &countingHandler{body: "primary"}
+	target := newTestUpstream(t, primary.ServeHTTP).String() + "/page"
+	var shadowed atomic.Int32
+	p, m := newShadowProxy(t, 1, func(res http.ResponseWriter, req *http.Request) {
+		shadowed.Add(1)
+		http.Error(res, "shadow broke", http.StatusInternalServerError)
+	})
+
+	for i := 0; i < 3; i++ {
+		rec := serve(p, freshGet(target))
+		if rec.Code != http.StatusOK || rec.Body.String() != "primary" {
+			t.Errorf("request %d: status %d, body %q; want the primary response", i, rec.Code, rec.Body.String())
+		}
+	}
+	if _, mismatch := shadowResults(m, 3); mismatch != 3 {
+		t.Errorf("recorded %d mismatches, want 3", mismatch)
+	}
+	if n := shadowed.Load(); n != 3 {
+		t.Errorf("shadow got %d requests, want 3", n)
+	}
+}
+
+func TestShadowRate(t *testing.T) {
+	target := newTestUpstream(t, (&countingHandler{body: "same"}).ServeHTTP).String() + "/page"
+	same := func(res http.ResponseWriter, req *http.Request) { res.Write([]byte("same")) }
+
+	p, m := newShadowProxy(t, 0, same)
+	for i := 0; i < 20; i++ {
+		serve(p, freshGet(target))
+	}
+	if match, mismatch := shadowResults(m, 1); match+mismatch != 0 {
+		t.Errorf("rate 0 shadowed %d requests", match+mismatch)
+	}
+
+	const requests = 400
+	p, m = newShadowProxy(t, 0.25, same)
+	for i := 0; i < requests; i++ {
+		serve(p, freshGet(target))
+	}
+	// Sampling is random; 100 is expected and this allows over 5 standard
+	// deviations either way.
+	match, mismatch := shadowResults(m, 50)
+	if match < 50 || match > 150 || mismatch != 0 {
+		t.Errorf("rate 0.25 of %d requests: %d matched, %d mismatched; want about 100 matches", requests, match, mismatch)
+	}
+}
+
+func TestShadowSkipsExcludedMethods(t *testing.T) {
+	target := newTestUpstream(t, (&countingHandler{body: "ok"}).ServeHTTP).String() + "/submit"
+	shadow := &countingHandler{}
+	p, m := newShadowProxy(t, 1, shadow.ServeHTTP)
+
+	rec := postThrough(p, target, "payload")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST: status %d", rec.Code)
+	}
+	if match, mismatch := shadowResults(m, 1); match+mismatch != 0 || shadow.requests() != 0 {
+		t.Error("POST was shadowed")
+	}
+}
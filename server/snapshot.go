@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotEntry is the on-disk form of a cacheEntry.
+type snapshotEntry struct {
+	Key        string
+	Identity   string
+	Status     int
+	Header     http.Header
+	Body       []byte
+	Stored     time.Time
+	Expires    time.Time
+	StaleUntil time.Time
+}
+
+// saveSnapshot writes every in-memory cache entry to path; entries whose
+// body is in the disk cache are left out. The file is written under a
+// temporary name and renamed into place, so a crash mid-write leaves the
+// previous snapshot intact. The cache is locked, a shard at a time, only
+// while the entries are listed; entries are not modified once stored, so
+// they are encoded unlocked.
+func (p *Proxy) saveSnapshot(path string) (int, error) {
+	entries := p.cache.entries()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := gob.NewEncoder(tmp)
+	saved := 0
+	for _, e := range entries {
+		if e.bodyPath != "" {
+			continue
+		}
+		saved++
+		err := enc.Encode(snapshotEntry{
+			Key:        e.key,
+			Identity:   e.identity,
+			Status:     e.status,
+			Header:     e.header,
+			Body:       e.body,
+			Stored:     e.stored,
+			Expires:    e.expires,
+			StaleUntil: e.staleUntil,
+		})
+		if err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return saved, os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot restores the cache from a snapshot at path written within
+// maxAge, skipping entries that have expired since. A missing or older file
+// is ignored.
+func (p *Proxy) loadSnapshot(path string, maxAge time.Duration) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return 0, err
+	} else if maxAge > 0 && time.Since(info.ModTime()) > maxAge {
+		p.logEvent("Ignoring cache snapshot %s written %v ago", path, time.Since(info.ModTime()).Round(time.Second))
+		return 0, nil
+	}
+
+	now := time.Now()
+	dec := gob.NewDecoder(f)
+	loaded := 0
+	for {
+		var s snapshotEntry
+		if err := dec.Decode(&s); err != nil {
+			if errors.Is(err, io.EOF) {
+				return loaded, nil
+			}
+			return loaded, err
+		}
+		e := &cacheEntry{
+			key:        s.Key,
+			identity:   s.Identity,
+			status:     s.Status,
+			header:     s.Header,
+			body:       s.Body,
+			stored:     s.Stored,
+			expires:    s.Expires,
+			staleUntil: s.StaleUntil,
+		}
+		// Snapshots from before entries kept their identity hold SHA-1
+		// keys, which no lookup would match.
+		if e.expired(now) || e.identity == "" {
+			continue
+		}
+		p.cache.add(e)
+		loaded++
+	}
+}
+
+// cacheSnapshotter saves the cache to a file once per interval.
+type cacheSnapshotter struct {
+	backgroundLoop
+	proxy    *Proxy
+	path     string
+	interval time.Duration
+}
+
+func newCacheSnapshotter(p *Proxy, path string, interval time.Duration) *cacheSnapshotter {
+	return &cacheSnapshotter{proxy: p, path: path, interval: interval}
+}
+
+// Start writes the cache to the snapshot file once per interval, in the
+// background, until ctx is cancelled or Stop is called. A failed write is
+// logged and tried again at the next interval.
+func (s *cacheSnapshotter) Start(ctx context.Context) {
+	s.start(ctx, func(ctx context.Context) {
+		runEvery(ctx, s.interval, s.save)
+	})
+}
+
+func (s *cacheSnapshotter) save() {
+	if _, err := s.proxy.saveSnapshot(s.path); err != nil {
+		s.proxy.logEvent("Failed to write cache snapshot %s: %v", s.path, err)
+	}
+}
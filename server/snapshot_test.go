@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestoresHits(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	p := newTestProxy(t, Config{CacheTTL: time.Minute})
+	get(p, target)
+	expired := testEntry("expired", "old")
+	expired.identity = "expired"
+	expired.expires = time.Now().Add(-time.Second)
+	p.cache.add(expired)
+	if n, err := p.saveSnapshot(path); err != nil || n != 2 {
+		t.Fatalf("saveSnapshot = %d, %v; want 2 entries", n, err)
+	}
+
+	restored := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true})
+	if n, err := restored.loadSnapshot(path, time.Hour); err != nil || n != 1 {
+		t.Fatalf("loadSnapshot = %d, %v; want only the unexpired entry", n, err)
+	}
+	rec := get(restored, target)
+	if rec.Body.String() != "hello" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("after restore: body %q, X-Cache %q; want a hit", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if n := upstream.requests(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func TestSnapshotTooOldIgnored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	p := newTestProxy(t, Config{})
+	p.cache.add(testEntry("k", "body"))
+	if _, err := p.saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path, old, old)
+
+	restored := newTestProxy(t, Config{})
+	if n, err := restored.loadSnapshot(path, time.Hour); err != nil || n != 0 {
+		t.Errorf("loadSnapshot of a 2h old file = %d, %v; want it ignored", n, err)
+	}
+	if n, err := restored.loadSnapshot(filepath.Join(t.TempDir(), "missing"), time.Hour); err != nil || n != 0 {
+		t.Errorf("loadSnapshot of a missing file = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestCacheSnapshotterWritesPeriodically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	p := newTestProxy(t, Config{})
+	p.cache.add(testEntry("k", "body"))
+
+	s := newCacheSnapshotter(p, path, 10*time.Millisecond)
+	s.Start(context.Background())
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no snapshot written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.Stop()
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
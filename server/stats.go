@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type cacheStats struct {
+	Entries    int   `json:"entries"`
+	MaxEntries int   `json:"max_entries"`
+	Bodies     int   `json:"bodies"`
+	Bytes      int64 `json:"bytes"`
+	MaxBytes   int64 `json:"max_bytes"`
+}
+
+type stats struct {
+	Cache    cacheStats      `json:"cache"`
+	Backends []backendStatus `json:"backends,omitempty"`
+	// Upstreams counts connections to each upstream host, dialed and
+	// reused, showing how well keep-alive works.
+	Upstreams []upstreamConnStats `json:"upstreams"`
+}
+
+func (p *Proxy) handleStats(res http.ResponseWriter, req *http.Request) {
+	s := stats{
+		Cache: cacheStats{
+			Entries:    p.cache.len(),
+			MaxEntries: p.cache.maxEntries,
+			Bodies:     p.cache.bodyCount(),
+			Bytes:      p.cache.size(),
+			MaxBytes:   p.cache.maxBytes,
+		},
+		Upstreams: p.upstreamConns.upstreamStats(),
+	}
+	if p.backends != nil {
+		s.Backends = p.backends.status()
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(s)
+}
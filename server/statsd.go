@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdMetrics sends each observation as a StatsD datagram, with labels
+// encoded as DogStatsD-style "#key:value" tags.
+type statsdMetrics struct {
+	conn net.Conn
+}
+
+func newStatsdMetrics(addr string) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdMetrics{conn: conn}, nil
+}
+
+func (m *statsdMetrics) IncCounter(name string, labels map[string]string) {
+	m.send(fmt.Sprintf("%s:1|c", name), labels)
+}
+
+func (m *statsdMetrics) ObserveDuration(name string, d time.Duration, labels map[string]string) {
+	m.send(fmt.Sprintf("%s:%d|ms", name, d.Milliseconds()), labels)
+}
+
+func (m *statsdMetrics) ObserveSize(name string, bytes int64, labels map[string]string) {
+	m.send(fmt.Sprintf("%s:%d|h", name, bytes), labels)
+}
+
+func (m *statsdMetrics) SetGauge(name string, value float64, labels map[string]string) {
+	m.send(fmt.Sprintf("%s:%s|g", name, formatFloat(value)), labels)
+}
+
+// send writes one datagram. Delivery is best effort, as is usual for StatsD,
+// so write errors are dropped.
+func (m *statsdMetrics) send(line string, labels map[string]string) {
+	if len(labels) > 0 {
+		tags := make([]string, 0, len(labels))
+		for _, k := range sortedKeys(labels) {
+			tags = append(tags, k+":"+labels[k])
+		}
+		line += "|#" + strings.Join(tags, ",")
+	}
+	m.conn.Write([]byte(line))
+}
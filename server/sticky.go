@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ringPointsPerWeight is how many points each unit of weight gives a
+// backend on the sticky-session hash ring; more points spread clients more
+// evenly.
+const ringPointsPerWeight = 100
+
+// ringPoint is one of a backend's positions on the hash ring.
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+func validStickySessions(mode string) bool {
+	return mode == "" || mode == "ip" || mode == "cookie"
+}
+
+// ringHash places s on the ring. FNV and the like cluster strings that
+// differ only at the end, as point names and many client keys do, so a
+// cryptographic hash is used to spread them evenly.
+func ringHash(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// buildRing places every backend on the hash ring -sticky-sessions uses,
+// in proportion to its weight. Points are hashed from the backend's URL, so
+// clients keep their backend across restarts, and adding or removing a
+// backend only moves the clients of its share of the ring.
+func (p *backendPool) buildRing() {
+	p.ring = nil
+	for _, b := range p.backends {
+		for i := 0; i < b.weight*ringPointsPerWeight; i++ {
+			p.ring = append(p.ring, ringPoint{hash: ringHash(b.url.String() + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+}
+
+// sticky returns the backend key maps to on the hash ring: the first one at
+// or after the key's hash that isn't down, or nil if every backend is down.
+func (p *backendPool) sticky(key string) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	h := ringHash(key)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := range p.ring {
+		b := p.ring[(start+i)%len(p.ring)].backend
+		if !b.unhealthy && !now.Before(b.downUntil) {
+			return b
+		}
+	}
+	return nil
+}
+
+// stickyBackend picks req's backend for -sticky-sessions, keyed by the
+// client IP or, in cookie mode, by the -sticky-cookie value. A client
+// without the cookie gets a new random one on this response, so it keeps
+// the backend its first request went to.
+func (p *Proxy) stickyBackend(res http.ResponseWriter, req *http.Request) *backend {
+	key := p.clientIP(req)
+	if p.cfg.StickySessions == "cookie" {
+		if c, err := req.Cookie(p.cfg.StickyCookie); err == nil && c.Value != "" {
+			key = c.Value
+		} else {
+			id := make([]byte, 16)
+			rand.Read(id)
+			key = hex.EncodeToString(id)
+			http.SetCookie(res, &http.Cookie{Name: p.cfg.StickyCookie, Value: key, Path: "/", HttpOnly: true})
+		}
+	}
+	return p.backends.sticky(key)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newStickyProxy balances over backends a, b and c, each answering with
+// its name, in the given -sticky-sessions mode. It returns the backends by
+// name too.
+func newStickyProxy(t *testing.T, mode string) (*Proxy, map[string]*backend) {
+	t.Helper()
+	var urls []string
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		urls = append(urls, newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+			res.Write([]byte(name))
+		}).String())
+	}
+	backends, err := parseBackends(strings.Join(urls, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*backend{"a": backends[0], "b": backends[1], "c": backends[2]}
+	return newTestProxy(t, Config{Backends: backends, StickySessions: mode, StickyCookie: "lb"}), byName
+}
+
+// stickyGet sends an origin-form GET from the client at ip, with cookies,
+// and returns the response.
+func stickyGet(p *Proxy, ip string, cookies ...*http.Cookie) *http.Response {
+	req := originGet("/")
+	req.RemoteAddr = ip + ":40000"
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return serve(p, req).Result()
+}
+
+// backendName returns which backend answered resp.
+func backendName(resp *http.Response) string {
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestStickySessionsByIP(t *testing.T) {
+	p, backends := newStickyProxy(t, "ip")
+
+	chosen := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		chosen[ip] = backendName(stickyGet(p, ip))
+		used[chosen[ip]] = true
+		for j := 0; j < 3; j++ {
+			if got := backendName(stickyGet(p, ip)); got != chosen[ip] {
+				t.Errorf("client %s: request %d went to %s, the first to %s", ip, j+2, got, chosen[ip])
+			}
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("30 clients used backends %v, want all three", used)
+	}
+
+	// Taking one backend down moves only its clients.
+	down := chosen["198.51.100.0"]
+	p.backends.markDown(backends[down])
+	for ip, was := range chosen {
+		got := backendName(stickyGet(p, ip))
+		switch {
+		case was == down && got == down:
+			t.Errorf("client %s still sent to %s while it is down", ip, down)
+		case was != down && got != was:
+			t.Errorf("client %s moved from %s to %s though %s is up", ip, was, got, was)
+		}
+	}
+}
+
+func TestStickySessionsByCookie(t *testing.T) {
+	p, _ := newStickyProxy(t, "cookie")
+
+	// One client IP, many cookies: each cookie keeps its own backend.
+	used := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		first := stickyGet(p, "198.51.100.1")
+		cookies := first.Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "lb" || cookies[0].Value == "" {
+			t.Fatalf("first response set cookies %v, want one lb cookie", cookies)
+		}
+		name := backendName(first)
+		used[name] = true
+		for j := 0; j < 3; j++ {
+			resp := stickyGet(p, "198.51.100.1", cookies[0])
+			if got := backendName(resp); got != name {
+				t.Errorf("cookie %s: request %d went to %s, the first to %s", cookies[0].Value, j+2, got, name)
+			}
+			if len(resp.Cookies()) != 0 {
+				t.Errorf("cookie %s: set again on request %d", cookies[0].Value, j+2)
+			}
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("30 cookies used backends %v, want all three", used)
+	}
+
+	if _, err := NewProxy(Config{StickySessions: "cookie"}); err == nil {
+		t.Error("NewProxy accepted cookie mode without -sticky-cookie")
+	}
+	if _, err := NewProxy(Config{StickySessions: "header"}); err == nil {
+		t.Error("NewProxy accepted an unknown sticky session mode")
+	}
+}
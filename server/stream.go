@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// isEventStream reports whether header describes a Server-Sent Events
+// response, which must be relayed as it arrives rather than buffered.
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// isMultipart reports whether header has a multipart/* Content-Type. Such
+// bodies, uploads with their boundaries or responses such as
+// multipart/x-mixed-replace camera feeds, are never cached and are relayed
+// without buffering.
+func isMultipart(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// streamResponse relays resp to res without buffering, flushing after every
+// read so each event reaches the client as soon as the upstream sends it,
+// then passes on any trailers. It returns the number of body bytes written.
+func streamResponse(res http.ResponseWriter, resp *http.Response) (int64, error) {
+	yieldServer(res.Header(), resp.Header)
+	for h, values := range resp.Header {
+		for _, value := range values {
+			res.Header().Add(h, value)
+		}
+	}
+	res.Header().Del("Content-Length")
+	res.WriteHeader(resp.StatusCode)
+
+	flusher, _ := res.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := res.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			for h, values := range resp.Trailer {
+				for _, value := range values {
+					res.Header().Add(http.TrailerPrefix+h, value)
+				}
+			}
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
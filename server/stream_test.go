@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxiedClient returns a client that sends its requests through p, served
+// by httptest until the test ends.
+func proxiedClient(t *testing.T, p *Proxy) *http.Client {
+	t.Helper()
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	proxyURL, _ := url.Parse(srv.URL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 10 * time.Second}
+}
+
+func TestEventStreamRelayedIncrementally(t *testing.T) {
+	next := make(chan struct{})
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.Write([]byte("data: first\n\n"))
+		res.(http.Flusher).Flush()
+		// The second event is only sent once the client has the first.
+		select {
+		case <-next:
+		case <-time.After(5 * time.Second):
+		}
+		res.Write([]byte("data: second\n\n"))
+	}).String() + "/events"
+	p := newTestProxy(t, Config{})
+
+	resp, err := proxiedClient(t, p).Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+
+	got := make(chan string, 1)
+	go func() {
+		line, _ := r.ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if strings.TrimSpace(line) != "data: first" {
+			t.Fatalf("first line %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first event not relayed before the upstream finished")
+	}
+	close(next)
+	r.ReadString('\n')
+	if line, _ := r.ReadString('\n'); strings.TrimSpace(line) != "data: second" {
+		t.Errorf("second event %q", line)
+	}
+	if n := p.cache.len(); n != 0 {
+		t.Errorf("event stream cached (%d entries)", n)
+	}
+}
+
+func TestMultipartNeverCached(t *testing.T) {
+	upstream := &countingHandler{
+		body:   "--b\r\nContent-Type: text/plain\r\n\r\npart\r\n--b--\r\n",
+		header: http.Header{"Content-Type": {"multipart/mixed; boundary=b"}, "Cache-Control": {"max-age=60"}},
+	}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/parts"
+	p := newTestProxy(t, Config{XCacheHeader: true})
+
+	for i := 0; i < 2; i++ {
+		rec := get(p, target)
+		if got := rec.Header().Get("X-Cache"); got != "BYPASS" || rec.Body.String() != upstream.body {
+			t.Errorf("GET %d: X-Cache %q, body %q", i, got, rec.Body.String())
+		}
+	}
+	if n := upstream.requests(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+	if n := p.cache.len(); n != 0 {
+		t.Errorf("multipart response cached (%d entries)", n)
+	}
+}
+
+func TestMultipartUploadNotBufferedForCaching(t *testing.T) {
+	upstream := &flakyUpstream{}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/upload"
+	p := newTestProxy(t, Config{CachePOSTHeader: "X-Cache-POST"})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	body := "--b\r\nContent-Disposition: form-data; name=\"f\"\r\n\r\n" + strings.Repeat("x", 1<<20) + "\r\n--b--\r\n"
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+		req.Header.Set("X-Cache-POST", "1")
+		if rec := serve(p, req); rec.Body.Len() != len(body) {
+			t.Errorf("upload %d: echoed %d bytes, want %d", i, rec.Body.Len(), len(body))
+		}
+	}
+	if n := len(upstream.received()); n != 2 {
+		t.Errorf("upstream got %d uploads, want 2", n)
+	}
+	if n := m.counter("proxy_cache_bypass_total{reason=multipart}"); n != 2 {
+		t.Errorf("proxy_cache_bypass_total{reason=multipart} = %d, want 2", n)
+	}
+}
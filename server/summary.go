@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// summaryTopClients is how many of the busiest clients a session summary
+// lists.
+const summaryTopClients = 10
+
+// summaryTrackedClients is how many clients a session keeps counts for,
+// well above summaryTopClients so the busiest are counted closely. A proxy
+// open to many addresses, or spoofed ones, would otherwise keep a count for
+// every address it ever saw.
+const summaryTrackedClients = 100
+
+// sessionStats counts what the proxy has served since it was built, for the
+// summary written on shutdown.
+type sessionStats struct {
+	started     time.Time
+	requests    atomic.Int64
+	tunnels     atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+	bytesServed atomic.Int64
+
+	clientsMu sync.Mutex
+	clients   *topCounter // client IPs' requests and tunnels
+}
+
+func newSessionStats() *sessionStats {
+	return &sessionStats{started: time.Now(), clients: newTopCounter(summaryTrackedClients)}
+}
+
+// record counts one request or tunnel from ip that sent it bytes.
+func (s *sessionStats) record(ip string, bytes int64) {
+	s.bytesServed.Add(bytes)
+	s.clientsMu.Lock()
+	s.clients.add(ip)
+	s.clientsMu.Unlock()
+}
+
+// topCounter counts occurrences of the most frequent keys in at most
+// capacity counters, with the space-saving algorithm: once every counter is
+// taken, a new key replaces the key with the lowest count and carries that
+// count on, plus one. A count may so be over by what it inherited, but a key
+// seen more than total/capacity times is always among those counted.
+type topCounter struct {
+	capacity int
+	counts   map[string]int64
+}
+
+func newTopCounter(capacity int) *topCounter {
+	return &topCounter{capacity: capacity, counts: make(map[string]int64, capacity)}
+}
+
+func (c *topCounter) add(key string) {
+	if _, ok := c.counts[key]; ok || len(c.counts) < c.capacity {
+		c.counts[key]++
+		return
+	}
+	var minKey string
+	minCount := int64(-1)
+	for k, n := range c.counts {
+		if minCount < 0 || n < minCount {
+			minKey, minCount = k, n
+		}
+	}
+	delete(c.counts, minKey)
+	c.counts[key] = minCount + 1
+}
+
+type clientSummary struct {
+	IP       string `json:"ip"`
+	Requests int64  `json:"requests"`
+}
+
+type sessionSummary struct {
+	Started       time.Time       `json:"started"`
+	UptimeSeconds float64         `json:"uptime_seconds"`
+	Requests      int64           `json:"requests"`
+	Tunnels       int64           `json:"tunnels"`
+	CacheHits     int64           `json:"cache_hits"`
+	CacheMisses   int64           `json:"cache_misses"`
+	CacheHitRatio float64         `json:"cache_hit_ratio"`
+	BytesServed   int64           `json:"bytes_served"`
+	TopClients    []clientSummary `json:"top_clients"`
+}
+
+// summary reports the session so far. The hit ratio is over requests that
+// looked in the cache, so bypassed ones don't count against it.
+func (s *sessionStats) summary(now time.Time) sessionSummary {
+	sum := sessionSummary{
+		Started:       s.started,
+		UptimeSeconds: now.Sub(s.started).Seconds(),
+		Requests:      s.requests.Load(),
+		Tunnels:       s.tunnels.Load(),
+		CacheHits:     s.cacheHits.Load(),
+		CacheMisses:   s.cacheMisses.Load(),
+		BytesServed:   s.bytesServed.Load(),
+		TopClients:    []clientSummary{},
+	}
+	if lookups := sum.CacheHits + sum.CacheMisses; lookups > 0 {
+		sum.CacheHitRatio = float64(sum.CacheHits) / float64(lookups)
+	}
+
+	s.clientsMu.Lock()
+	for ip, n := range s.clients.counts {
+		sum.TopClients = append(sum.TopClients, clientSummary{IP: ip, Requests: n})
+	}
+	s.clientsMu.Unlock()
+	sort.Slice(sum.TopClients, func(i, j int) bool {
+		a, b := sum.TopClients[i], sum.TopClients[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.IP < b.IP
+	})
+	if len(sum.TopClients) > summaryTopClients {
+		sum.TopClients = sum.TopClients[:summaryTopClients]
+	}
+	return sum
+}
+
+// writeSummary logs the session summary as JSON and, when path is set, also
+// writes it to that file.
+func (p *Proxy) writeSummary(path string) error {
+	data, err := json.Marshal(p.session.summary(time.Now()))
+	if err != nil {
+		return err
+	}
+	p.logEvent("Session summary: %s", data)
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionSummary(t *testing.T) {
+	upstream := &countingHandler{body: "hello"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, LogFile: logs})
+
+	for i := 0; i < 3; i++ {
+		get(p, target)
+	}
+	other := httptest.NewRequest(http.MethodGet, target, nil)
+	other.RemoteAddr = "198.51.100.7:1234"
+	serve(p, other)
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	if err := p.writeSummary(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum sessionSummary
+	if err := json.Unmarshal(data, &sum); err != nil {
+		t.Fatalf("summary file is not JSON: %v\n%s", err, data)
+	}
+	if sum.Requests != 4 || sum.CacheHits != 3 || sum.CacheMisses != 1 || sum.CacheHitRatio != 0.75 {
+		t.Errorf("summary %+v, want 4 requests, 3 hits of 4 lookups", sum)
+	}
+	if sum.BytesServed != 4*int64(len("hello")) {
+		t.Errorf("bytes_served %d, want %d", sum.BytesServed, 4*len("hello"))
+	}
+	if sum.UptimeSeconds <= 0 || sum.Started.IsZero() {
+		t.Errorf("uptime %v from %v", sum.UptimeSeconds, sum.Started)
+	}
+	want := []clientSummary{{IP: "192.0.2.1", Requests: 3}, {IP: "198.51.100.7", Requests: 1}}
+	if len(sum.TopClients) != 2 || sum.TopClients[0] != want[0] || sum.TopClients[1] != want[1] {
+		t.Errorf("top_clients %+v, want %+v", sum.TopClients, want)
+	}
+
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	for _, name := range []string{"started", "uptime_seconds", "requests", "tunnels", "cache_hit_ratio", "bytes_served", "top_clients"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("summary lacks %q", name)
+		}
+	}
+	if lines := logs.lines("Session summary: "); len(lines) != 1 || !strings.Contains(lines[0], `"requests":4`) {
+		t.Errorf("summary not logged:\n%s", logs)
+	}
+}
+
+func TestSessionSummaryTopClientsBounded(t *testing.T) {
+	s := newSessionStats()
+	for i := 0; i < 2*summaryTopClients; i++ {
+		for j := 0; j <= i; j++ {
+			s.record("10.0.0."+strconv.Itoa(i), 0)
+		}
+	}
+	top := s.summary(time.Now()).TopClients
+	if len(top) != summaryTopClients {
+		t.Fatalf("%d top clients, want %d", len(top), summaryTopClients)
+	}
+	if top[0].Requests != 2*summaryTopClients {
+		t.Errorf("busiest client listed with %d requests, want %d", top[0].Requests, 2*summaryTopClients)
+	}
+}
+
+// TestSessionSummaryClientsTrackedBounded checks a stream of one-off
+// client addresses keeps at most summaryTrackedClients counts while the
+// busy clients among them are still counted.
+func TestSessionSummaryClientsTrackedBounded(t *testing.T) {
+	s := newSessionStats()
+	for i := 0; i < 10000; i++ {
+		s.record(fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff), 0)
+		if i%10 == 0 {
+			s.record("192.0.2.1", 0)
+		}
+		if i%20 == 0 {
+			s.record("192.0.2.2", 0)
+		}
+	}
+	if n := len(s.clients.counts); n > summaryTrackedClients {
+		t.Errorf("tracking %d clients, want at most %d", n, summaryTrackedClients)
+	}
+	top := s.summary(time.Now()).TopClients
+	if len(top) < 2 || top[0].IP != "192.0.2.1" || top[1].IP != "192.0.2.2" {
+		t.Fatalf("top clients %+v, want 192.0.2.1 then 192.0.2.2", top)
+	}
+	// Counts are never under, and over by at most total/capacity.
+	total := int64(10000 + 1000 + 500)
+	for _, c := range []struct {
+		client clientSummary
+		want   int64
+	}{{top[0], 1000}, {top[1], 500}} {
+		if c.client.Requests < c.want || c.client.Requests > c.want+total/summaryTrackedClients {
+			t.Errorf("%s counted %d requests, want %d to %d", c.client.IP, c.client.Requests, c.want, c.want+total/summaryTrackedClients)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// cacheSweeper periodically drops cache entries past their stale window,
+// which would otherwise only be removed when requested again or evicted.
+type cacheSweeper struct {
+	backgroundLoop
+	proxy    *Proxy
+	interval time.Duration
+}
+
+func newCacheSweeper(p *Proxy, interval time.Duration) *cacheSweeper {
+	return &cacheSweeper{proxy: p, interval: interval}
+}
+
+// Start sweeps the cache of entries past their stale window once per
+// interval, in the background, until ctx is cancelled or Stop is called.
+func (s *cacheSweeper) Start(ctx context.Context) {
+	s.start(ctx, func(ctx context.Context) {
+		runEvery(ctx, s.interval, s.sweep)
+	})
+}
+
+// sweep collects the keys to drop in one pass and removes them one at a time
+// in a second, so no cache shard is locked for a whole sweep and requests
+// aren't stalled behind a large cache.
+func (s *cacheSweeper) sweep() {
+	p := s.proxy
+	now := time.Now()
+	keys := p.cache.unusableKeys(now)
+
+	removed := 0
+	for _, key := range keys {
+		if p.cache.removeUnusable(key, now) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		p.logEvent("Swept %d expired cache entries", removed)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// traceAllow is the Allow header sent when TRACE is rejected.
+const traceAllow = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+func validTraceMode(mode string) bool {
+	return mode == "" || mode == "reject" || mode == "echo"
+}
+
+// handleTrace answers a TRACE request itself; TRACE is never forwarded or
+// cached. By default it is rejected with 405, since reflecting headers lets
+// a script read cookies it otherwise couldn't (cross-site tracing). With
+// -trace=echo the request is sent back as message/http, leaving out the
+// headers redactedHeaders masks in dumps.
+func (p *Proxy) handleTrace(res http.ResponseWriter, req *http.Request) {
+	if p.cfg.TraceMode != "echo" {
+		res.Header().Set("Allow", traceAllow)
+		http.Error(res, "Method Not Allowed", http.StatusMethodNotAllowed)
+		p.logEvent("Rejected TRACE %s from %s", req.RequestURI, p.clientIP(req))
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\r\n", req.Method, req.RequestURI, req.Proto)
+	fmt.Fprintf(&b, "Host: %s\r\n", req.Host)
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if redactedHeaders[name] {
+			continue
+		}
+		for _, value := range req.Header[name] {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+		}
+	}
+	b.WriteString("\r\n")
+
+	res.Header().Set("Content-Type", "message/http")
+	res.Write([]byte(b.String()))
+	p.logEvent("Echoed TRACE %s from %s", req.RequestURI, p.clientIP(req))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func traceRequest(target string) *http.Request {
+	req := httptest.NewRequest(http.MethodTrace, target, nil)
+	req.Header.Set("X-Probe", "1")
+	req.Header.Set("Cookie", "session=secret")
+	return req
+}
+
+func TestTraceRejectedByDefault(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{})
+
+	rec := serve(p, traceRequest(target))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("TRACE: status %d, want 405", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); strings.Contains(allow, "TRACE") || !strings.Contains(allow, "GET") {
+		t.Errorf("Allow %q", allow)
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("upstream got %d requests, want TRACE never forwarded", n)
+	}
+}
+
+func TestTraceEcho(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{TraceMode: "echo"})
+
+	for i := 0; i < 2; i++ {
+		rec := serve(p, traceRequest(target))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "message/http" {
+			t.Fatalf("TRACE: status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		body := rec.Body.String()
+		if !strings.HasPrefix(body, "TRACE "+target+" HTTP/1.1\r\n") || !strings.Contains(body, "X-Probe: 1\r\n") {
+			t.Errorf("echo doesn't reflect the request:\n%s", body)
+		}
+		if strings.Contains(body, "secret") {
+			t.Errorf("echo reflects the cookie:\n%s", body)
+		}
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("upstream got %d requests, want TRACE never forwarded", n)
+	}
+	if n := p.cache.len(); n != 0 {
+		t.Errorf("cache holds %d entries after TRACE, want 0", n)
+	}
+	if _, err := NewProxy(Config{TraceMode: "forward"}); err == nil {
+		t.Error("NewProxy accepted an unknown trace mode")
+	}
+}
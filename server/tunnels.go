@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnel is an active CONNECT tunnel between a client and a destination.
+type tunnel struct {
+	id        uint64
+	clientIP  string
+	host      string
+	start     time.Time
+	bytesSent atomic.Int64 // client to destination
+	bytesRecv atomic.Int64 // destination to client
+	// lastActive is when bytes last flowed either way, in Unix nanoseconds.
+	lastActive atomic.Int64
+
+	clientConn net.Conn
+	destConn   net.Conn
+
+	// expired holds why the tunnel was closed for a timeout, if it was.
+	expired atomic.Value
+}
+
+func (p *Proxy) registerTunnel(clientIP, host string, clientConn, destConn net.Conn) *tunnel {
+	t := &tunnel{
+		id:         p.nextTunnelID.Add(1),
+		clientIP:   clientIP,
+		host:       host,
+		start:      time.Now(),
+		clientConn: clientConn,
+		destConn:   destConn,
+	}
+	t.lastActive.Store(t.start.UnixNano())
+	p.tunnelsMux.Lock()
+	p.tunnels[t.id] = t
+	p.tunnelsMux.Unlock()
+	return t
+}
+
+func (p *Proxy) unregisterTunnel(t *tunnel) {
+	p.tunnelsMux.Lock()
+	delete(p.tunnels, t.id)
+	p.tunnelsMux.Unlock()
+}
+
+// close tears down both sides of the tunnel, which ends its copy loops.
+func (t *tunnel) close() {
+	t.clientConn.Close()
+	t.destConn.Close()
+}
+
+// expire closes the tunnel for the given reason. Only the first reason is
+// kept.
+func (t *tunnel) expire(reason string) {
+	t.expired.CompareAndSwap(nil, reason)
+	t.close()
+}
+
+// expiredReason returns why the tunnel was closed for a timeout, or "".
+func (t *tunnel) expiredReason() string {
+	reason, _ := t.expired.Load().(string)
+	return reason
+}
+
+// pipe copies src to dst for t, counting the bytes in n, until either side
+// fails or t reaches -tunnel-idle-timeout or -tunnel-max-lifetime. The limits
+// are enforced with read deadlines; on each timeout the deadline is pushed
+// out again if bytes have flowed in the other direction since. It works like
+// io.CopyBuffer with a buffer of -tunnel-buffer-size from a pool shared by
+// all tunnels.
+func (p *Proxy) pipe(t *tunnel, dst, src net.Conn, n *atomic.Int64) {
+	bufp := p.tunnelBuffers.Get().(*[]byte)
+	defer p.tunnelBuffers.Put(bufp)
+	buf := *bufp
+	for {
+		if deadline, ok := p.tunnelDeadline(t); ok {
+			src.SetReadDeadline(deadline)
+		}
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			t.lastActive.Store(time.Now().UnixNano())
+			nw, werr := dst.Write(buf[:nr])
+			n.Add(int64(nw))
+			if werr != nil {
+				return
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if reason := p.tunnelExpiry(t, time.Now()); reason != "" {
+				t.expire(reason)
+				return
+			}
+			continue
+		}
+		return
+	}
+}
+
+// defaultTunnelBufferSize is the tunnel copy buffer size when
+// -tunnel-buffer-size isn't positive, the same as io.Copy's.
+const defaultTunnelBufferSize = 32 * 1024
+
+// newTunnelBuffers returns the pool pipe takes its copy buffers from.
+func newTunnelBuffers(size int) *sync.Pool {
+	if size <= 0 {
+		size = defaultTunnelBufferSize
+	}
+	return &sync.Pool{New: func() any {
+		buf := make([]byte, size)
+		return &buf
+	}}
+}
+
+// tunnelDeadline returns when t would next reach one of its limits, if any
+// are set.
+func (p *Proxy) tunnelDeadline(t *tunnel) (time.Time, bool) {
+	var deadline time.Time
+	if idle := p.cfg.TunnelIdleTimeout; idle > 0 {
+		deadline = time.Unix(0, t.lastActive.Load()).Add(idle)
+	}
+	if max := p.cfg.TunnelMaxLifetime; max > 0 {
+		if end := t.start.Add(max); deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// tunnelExpiry returns why t must be closed at now, or "" if it is within
+// its limits.
+func (p *Proxy) tunnelExpiry(t *tunnel, now time.Time) string {
+	if max := p.cfg.TunnelMaxLifetime; max > 0 && !now.Before(t.start.Add(max)) {
+		return "reached maximum lifetime " + max.String()
+	}
+	if idle := p.cfg.TunnelIdleTimeout; idle > 0 && now.Sub(time.Unix(0, t.lastActive.Load())) >= idle {
+		return "idle for " + idle.String()
+	}
+	return ""
+}
+
+type tunnelInfo struct {
+	ID            uint64    `json:"id"`
+	ClientIP      string    `json:"client_ip"`
+	Host          string    `json:"host"`
+	Started       time.Time `json:"started"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+func (p *Proxy) handleListTunnels(res http.ResponseWriter, req *http.Request) {
+	p.tunnelsMux.Lock()
+	list := make([]tunnelInfo, 0, len(p.tunnels))
+	for _, t := range p.tunnels {
+		list = append(list, tunnelInfo{
+			ID:            t.id,
+			ClientIP:      t.clientIP,
+			Host:          t.host,
+			Started:       t.start,
+			BytesSent:     t.bytesSent.Load(),
+			BytesReceived: t.bytesRecv.Load(),
+		})
+	}
+	p.tunnelsMux.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(list)
+}
+
+func (p *Proxy) handleCloseTunnel(res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(res, "Invalid tunnel id", http.StatusBadRequest)
+		return
+	}
+
+	p.tunnelsMux.Lock()
+	t, ok := p.tunnels[id]
+	p.tunnelsMux.Unlock()
+	if !ok {
+		http.Error(res, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	t.close()
+	p.logEvent("Closed tunnel %d from %s to %s by admin request", t.id, t.clientIP, t.host)
+	res.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newEchoServer accepts TCP connections until the test ends and echoes
+// whatever each one sends. It returns the listener's host:port.
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// openTunnel sends CONNECT dest to the proxy at proxyAddr and returns the
+// tunnelled connection once the proxy has answered 200.
+func openTunnel(t *testing.T, proxyAddr, dest string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("CONNECT %s: %v", dest, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: status %d", dest, resp.StatusCode)
+	}
+	return conn
+}
+
+func listTunnels(t *testing.T, p *Proxy) []tunnelInfo {
+	t.Helper()
+	rec := serve(p, adminRequest(http.MethodGet, "/admin/tunnels"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/tunnels: status %d", rec.Code)
+	}
+	var list []tunnelInfo
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("GET /admin/tunnels: %v", err)
+	}
+	return list
+}
+
+func TestAdminListsAndClosesTunnels(t *testing.T) {
+	dest := newEchoServer(t)
+	p := newTestProxy(t, Config{})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	conn := openTunnel(t, srv.Listener.Addr().String(), dest)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through tunnel: %q, %v", buf, err)
+	}
+
+	list := listTunnels(t, p)
+	if len(list) != 1 {
+		t.Fatalf("listed %d tunnels, want 1", len(list))
+	}
+	if list[0].Host != dest || list[0].BytesSent != 4 {
+		t.Errorf("tunnel %+v, want host %s and 4 bytes sent", list[0], dest)
+	}
+
+	rec := serve(p, adminRequest(http.MethodDelete, fmt.Sprintf("/admin/tunnels/%d", list[0].ID)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE tunnel: status %d", rec.Code)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("tunnel still open after DELETE")
+	}
+	if rec := serve(p, adminRequest(http.MethodDelete, "/admin/tunnels/999")); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE unknown tunnel: status %d, want 404", rec.Code)
+	}
+}
+
+func TestTunnelAdminRefusesNonAdminClients(t *testing.T) {
+	p := newTestProxy(t, Config{})
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/admin/tunnels", nil),
+		httptest.NewRequest(http.MethodDelete, "/admin/tunnels/1", nil),
+	} {
+		rec := serve(p, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s from %s: status %d, want 403", req.Method, req.URL.Path, req.RemoteAddr, rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "client_ip") {
+			t.Errorf("%s %s leaked tunnel details", req.Method, req.URL.Path)
+		}
+	}
+}
+
+// readUntilClosed reads from conn until it is closed, giving up after
+// within, and reports how long that took.
+func readUntilClosed(t *testing.T, conn net.Conn, within time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(within))
+	// A reset, when the proxy closes with unread data, counts as closed.
+	var netErr net.Error
+	if _, err := io.Copy(io.Discard, conn); errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("tunnel not closed within %v: %v", within, err)
+	}
+	return time.Since(start)
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	dest := newEchoServer(t)
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{TunnelIdleTimeout: 100 * time.Millisecond, LogFile: logs})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	conn := openTunnel(t, srv.Listener.Addr().String(), dest)
+	// Traffic keeps the tunnel open past the idle timeout.
+	buf := make([]byte, 4)
+	for i := 0; i < 4; i++ {
+		time.Sleep(40 * time.Millisecond)
+		conn.Write([]byte("ping"))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("tunnel closed while active: %v", err)
+		}
+	}
+	readUntilClosed(t, conn, 2*time.Second)
+	waitFor(t, func() bool { return len(logs.lines("idle for 100ms")) == 1 })
+}
+
+func TestTunnelMaxLifetime(t *testing.T) {
+	dest := newEchoServer(t)
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{TunnelMaxLifetime: 150 * time.Millisecond, LogFile: logs})
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	conn := openTunnel(t, srv.Listener.Addr().String(), dest)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if took := readUntilClosed(t, conn, 2*time.Second); took < 100*time.Millisecond {
+		t.Errorf("busy tunnel closed after %v, want the 150ms lifetime", took)
+	}
+	conn.Close()
+	<-done
+	waitFor(t, func() bool { return len(logs.lines("reached maximum lifetime 150ms")) == 1 })
+}
+
+// waitFor polls cond until it holds, failing the test after two seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTunnelBufferSize(t *testing.T) {
+	for size, want := range map[int]int{0: defaultTunnelBufferSize, -1: defaultTunnelBufferSize, 256 << 10: 256 << 10} {
+		p := newTestProxy(t, Config{TunnelBufferSize: size})
+		if got := len(*p.tunnelBuffers.Get().(*[]byte)); got != want {
+			t.Errorf("-tunnel-buffer-size %d: buffer is %d bytes, want %d", size, got, want)
+		}
+	}
+}
+
+// tunnelPayload is how much each benchmarked tunnel carries.
+const tunnelPayload = 4 << 20
+
+// benchmarkTunnels runs b.N tunnels of tunnelPayload bytes over in-memory
+// connections, copying each with relay.
+func benchmarkTunnels(b *testing.B, relay func(dst, src net.Conn)) {
+	chunk := make([]byte, 256<<10)
+	b.SetBytes(tunnelPayload)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src, client := net.Pipe()
+		dst, dest := net.Pipe()
+		go func() {
+			for sent := 0; sent < tunnelPayload; sent += len(chunk) {
+				client.Write(chunk)
+			}
+			client.Close()
+		}()
+		done := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, dest)
+			close(done)
+		}()
+		relay(dst, src)
+		dst.Close()
+		<-done
+	}
+}
+
+func BenchmarkTunnelPipe(b *testing.B) {
+	for _, size := range []int{32 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			p := newTestProxy(b, Config{TunnelBufferSize: size})
+			benchmarkTunnels(b, func(dst, src net.Conn) {
+				p.pipe(&tunnel{}, dst, src, &atomic.Int64{})
+			})
+		})
+	}
+}
+
+// BenchmarkTunnelIOCopy is the baseline: io.Copy, as tunnels used before
+// -tunnel-buffer-size, allocating a 32KiB buffer for every tunnel.
+func BenchmarkTunnelIOCopy(b *testing.B) {
+	benchmarkTunnels(b, func(dst, src net.Conn) {
+		io.Copy(dst, src)
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math"
+	"net/http"
+)
+
+// newUpstreamClient returns the client used for all forwarded requests.
+// With an upstream proxy configured every request goes through it, falling
+// back to a direct connection when -upstream-fallback-direct is set.
+func (p *Proxy) newUpstreamClient() *http.Client {
+	transport := p.newUpstreamTransport()
+	var rt http.RoundTripper = transport
+	if p.cfg.UpstreamProxy != nil {
+		proxied := transport.Clone()
+		proxied.Proxy = http.ProxyURL(p.cfg.UpstreamProxy)
+		rt = proxied
+		if p.cfg.UpstreamFallbackDirect {
+			transport.Proxy = nil
+			rt = &fallbackTransport{proxy: p, proxied: proxied, direct: transport}
+		}
+	}
+	rt = budgetedTransport{proxy: p, next: rt}
+	return &http.Client{Transport: p.upstreamConns.transport(rt), CheckRedirect: p.checkRedirect}
+}
+
+// checkRedirect hands 3xx responses back to the client unchanged unless
+// -follow-redirects is set, in which case at most maxRedirects are followed
+// and the redirect after that is passed through.
+func (p *Proxy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if !p.cfg.FollowRedirects || len(via) > p.cfg.MaxRedirects {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// newUpstreamTransport builds the transport shared by all forwarded
+// requests. HTTP/2 is negotiated over TLS unless disabled with
+// -upstream-http2=false. Idle connections are kept up to
+// -upstream-max-idle-conns, in total and per host, for -upstream-idle-timeout.
+func (p *Proxy) newUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = p.upstreamConns.dial(p.upstreamDial())
+	transport.IdleConnTimeout = p.cfg.UpstreamIdleTimeout
+	transport.MaxIdleConns = p.cfg.UpstreamMaxIdleConns
+	transport.MaxIdleConnsPerHost = p.cfg.UpstreamMaxIdleConns
+	if p.cfg.UpstreamMaxIdleConns == 0 {
+		transport.MaxIdleConnsPerHost = math.MaxInt
+	}
+	transport.ForceAttemptHTTP2 = p.cfg.UpstreamHTTP2
+	if p.cfg.InsecureUpstream {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if !p.cfg.UpstreamHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+// isTLSError reports whether err came from the TLS handshake with the
+// upstream, such as an untrusted or mismatched certificate.
+func isTLSError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &verifyErr) ||
+		errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
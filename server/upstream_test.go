@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTLSUpstream serves h over TLS, offering HTTP/2, until the test ends and
+// returns its base URL.
+func newTLSUpstream(t *testing.T, h http.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(h)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func echoProto(res http.ResponseWriter, req *http.Request) {
+	res.Write([]byte(req.Proto))
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	target := newTLSUpstream(t, echoProto) + "/proto"
+	for _, tc := range []struct {
+		http2 bool
+		want  string
+	}{
+		{true, "HTTP/2.0"},
+		{false, "HTTP/1.1"},
+	} {
+		p := newTestProxy(t, Config{UpstreamHTTP2: tc.http2, InsecureUpstream: true})
+		rec := serve(p, freshGet(target))
+		if rec.Code != http.StatusOK || rec.Body.String() != tc.want {
+			t.Errorf("-upstream-http2=%v: status %d, upstream saw %q, want %q", tc.http2, rec.Code, rec.Body.String(), tc.want)
+		}
+	}
+}
+
+// freshGet returns a proxied GET for target that always goes upstream,
+// as a client sending Cache-Control: no-cache gets.
+func freshGet(target string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	return req
+}
+
+// redirectChain redirects /hop/N to /hop/N-1 until /hop/0, which answers
+// "done".
+func redirectChain(res http.ResponseWriter, req *http.Request) {
+	var n int
+	fmt.Sscanf(req.URL.Path, "/hop/%d", &n)
+	if n == 0 {
+		res.Write([]byte("done"))
+		return
+	}
+	http.Redirect(res, req, fmt.Sprintf("/hop/%d", n-1), http.StatusFound)
+}
+
+func TestRedirectsPassedThroughByDefault(t *testing.T) {
+	target := newTestUpstream(t, redirectChain).String()
+	p := newTestProxy(t, Config{})
+
+	rec := serve(p, freshGet(target+"/hop/2"))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/hop/1" {
+		t.Errorf("status %d, Location %q; want 302 to /hop/1", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestFollowRedirectsUpToMax(t *testing.T) {
+	target := newTestUpstream(t, redirectChain).String()
+	p := newTestProxy(t, Config{FollowRedirects: true, MaxRedirects: 3})
+
+	if rec := serve(p, freshGet(target+"/hop/3")); rec.Code != http.StatusOK || rec.Body.String() != "done" {
+		t.Errorf("3 redirects with -max-redirects 3: status %d, body %q", rec.Code, rec.Body.String())
+	}
+	rec := serve(p, freshGet(target+"/hop/5"))
+	if rec.Code != http.StatusFound {
+		t.Errorf("5 redirects with -max-redirects 3: status %d, want the 302 passed through", rec.Code)
+	}
+	if got := rec.Header().Get("Location"); got != "/hop/1" {
+		t.Errorf("passed-through redirect points at %q, want /hop/1", got)
+	}
+}
+
+func TestSelfSignedUpstream(t *testing.T) {
+	target := newTLSUpstream(t, echoProto) + "/proto"
+
+	p := newTestProxy(t, Config{})
+	m := newRecordingMetrics()
+	p.metrics = m
+	if rec := serve(p, freshGet(target)); rec.Code != http.StatusBadGateway {
+		t.Errorf("verifying certificates: status %d, want 502", rec.Code)
+	}
+	if n := m.counter("proxy_upstream_errors_total{reason=tls}"); n != 1 {
+		t.Errorf("proxy_upstream_errors_total{reason=tls} = %d, want 1", n)
+	}
+
+	p = newTestProxy(t, Config{InsecureUpstream: true})
+	if rec := serve(p, freshGet(target)); rec.Code != http.StatusOK {
+		t.Errorf("-insecure-upstream: status %d, want 200", rec.Code)
+	}
+}
+
+func TestUpstreamIdleConnSettings(t *testing.T) {
+	p := newTestProxy(t, Config{UpstreamIdleTimeout: 42 * time.Second, UpstreamMaxIdleConns: 7})
+	transport := p.newUpstreamTransport()
+	if transport.IdleConnTimeout != 42*time.Second || transport.MaxIdleConns != 7 || transport.MaxIdleConnsPerHost != 7 {
+		t.Errorf("transport idle timeout %v, max idle %d, per host %d; want 42s, 7, 7",
+			transport.IdleConnTimeout, transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+}
+
+func TestUpstreamIdleConnGauge(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{UpstreamIdleTimeout: 50 * time.Millisecond, UpstreamMaxIdleConns: 4})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	for i := 0; i < 2; i++ {
+		serve(p, freshGet(target))
+	}
+	if got := m.gauge("proxy_upstream_idle_connections"); got != 1 {
+		t.Errorf("after two requests: %v idle connections, want 1", got)
+	}
+	if stats := p.upstreamConns.upstreamStats(); len(stats) != 1 || stats[0].Dialed != 1 || stats[0].Reused != 1 {
+		t.Errorf("upstream stats %+v, want one connection dialed and reused once", stats)
+	}
+
+	// The idle connection is closed once -upstream-idle-timeout passes.
+	deadline := time.Now().Add(2 * time.Second)
+	for m.gauge("proxy_upstream_idle_connections") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection not closed after the idle timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// maxUpstreamStatsHosts bounds how many upstream hosts get their own
+// connection counts in /stats when -metrics-host-limit doesn't.
+const maxUpstreamStatsHosts = 100
+
+// connTracker counts the upstream connections the shared transport has open
+// and how many are serving a request, and reports the difference as the
+// proxy_upstream_idle_connections gauge. An HTTP/2 connection carrying
+// several requests counts as busy, never as negative idle. It also counts,
+// per upstream host, how many connections requests got were newly dialed
+// and how many were reused from the idle pool.
+type connTracker struct {
+	proxy *Proxy
+	open  atomic.Int64
+	inUse atomic.Int64
+
+	labels  *hostLabeler
+	hostsMu sync.Mutex
+	hosts   map[string]*upstreamConnCounts
+}
+
+type upstreamConnCounts struct {
+	dialed atomic.Int64
+	reused atomic.Int64
+}
+
+// upstreamConnStats reports one upstream host's connection reuse in /stats.
+type upstreamConnStats struct {
+	Host   string `json:"host"`
+	Dialed int64  `json:"dialed"`
+	Reused int64  `json:"reused"`
+}
+
+// newConnTracker returns p's tracker. Its per-host counts share
+// -metrics-host-limit's hosts when that is set, so /stats and the metrics
+// agree on which upstreams are "other".
+func newConnTracker(p *Proxy) *connTracker {
+	t := &connTracker{proxy: p, labels: p.hostLabeler, hosts: make(map[string]*upstreamConnCounts)}
+	if t.labels == nil {
+		t.labels = newHostLabeler(maxUpstreamStatsHosts)
+	}
+	return t
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dial wraps a transport's DialContext so each connection counts as open
+// until it is closed.
+func (t *connTracker) dial(next dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		t.open.Add(1)
+		t.report()
+		return &trackedConn{Conn: conn, tracker: t}, nil
+	}
+}
+
+// transport wraps next so a connection counts as in use from when a request
+// gets it until the response body is closed.
+func (t *connTracker) transport(next http.RoundTripper) http.RoundTripper {
+	return trackedTransport{tracker: t, next: next}
+}
+
+func (t *connTracker) report() {
+	idle := t.open.Load() - t.inUse.Load()
+	if idle < 0 {
+		idle = 0
+	}
+	t.proxy.metrics.SetGauge("proxy_upstream_idle_connections", float64(idle), nil)
+}
+
+// gotConn counts a connection a request to host was given.
+func (t *connTracker) gotConn(host string, reused bool) {
+	label := t.labels.label(host)
+	t.hostsMu.Lock()
+	counts, ok := t.hosts[label]
+	if !ok {
+		counts = &upstreamConnCounts{}
+		t.hosts[label] = counts
+	}
+	t.hostsMu.Unlock()
+	if reused {
+		counts.reused.Add(1)
+	} else {
+		counts.dialed.Add(1)
+	}
+	t.proxy.metrics.IncCounter("proxy_upstream_connections_total",
+		t.proxy.hostLabels(map[string]string{"reused": strconv.FormatBool(reused)}, host))
+}
+
+// upstreamStats returns the per-host connection counts, sorted by host.
+func (t *connTracker) upstreamStats() []upstreamConnStats {
+	t.hostsMu.Lock()
+	defer t.hostsMu.Unlock()
+	stats := make([]upstreamConnStats, 0, len(t.hosts))
+	for host, counts := range t.hosts {
+		stats = append(stats, upstreamConnStats{Host: host, Dialed: counts.dialed.Load(), Reused: counts.reused.Load()})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Host < stats[j].Host })
+	return stats
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.open.Add(-1)
+		c.tracker.report()
+	})
+	return c.Conn.Close()
+}
+
+type trackedTransport struct {
+	tracker *connTracker
+	next    http.RoundTripper
+}
+
+func (t trackedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The transport may retry on a fresh connection, so count every
+	// connection the request was given.
+	var got atomic.Int64
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			got.Add(1)
+			t.tracker.gotConn(req.URL.Host, info.Reused)
+			t.tracker.inUse.Add(1)
+			t.tracker.report()
+		},
+	}
+	release := func() {
+		t.tracker.inUse.Add(-got.Load())
+		t.tracker.report()
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamConnReuseStats(t *testing.T) {
+	first := newTestUpstream(t, (&countingHandler{body: "ok"}).ServeHTTP)
+	second := newTestUpstream(t, (&countingHandler{body: "ok"}).ServeHTTP)
+	p := newTestProxy(t, Config{})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	for i := 1; i <= 5; i++ {
+		serve(p, freshGet(first.String()+"/page"))
+		stats := p.upstreamConns.upstreamStats()
+		if len(stats) != 1 || stats[0].Host != first.Host || stats[0].Dialed != 1 || stats[0].Reused != int64(i-1) {
+			t.Fatalf("after %d requests: stats %+v, want one dial and %d reuses of %s", i, stats, i-1, first.Host)
+		}
+	}
+	serve(p, freshGet(second.String()+"/page"))
+
+	// /stats reports each upstream separately...
+	rec := serve(p, adminRequest(http.MethodGet, "/stats"))
+	var s stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatalf("GET /stats: %v", err)
+	}
+	got := make(map[string]upstreamConnStats)
+	for _, u := range s.Upstreams {
+		got[u.Host] = u
+	}
+	if u := got[first.Host]; u.Dialed != 1 || u.Reused != 4 {
+		t.Errorf("/stats for %s: %+v, want 1 dialed, 4 reused", first.Host, u)
+	}
+	if u := got[second.Host]; u.Dialed != 1 || u.Reused != 0 {
+		t.Errorf("/stats for %s: %+v, want 1 dialed, 0 reused", second.Host, u)
+	}
+	// ...and the metric counts every connection handed out.
+	if n := m.counter("proxy_upstream_connections_total{reused=true}"); n != 4 {
+		t.Errorf("proxy_upstream_connections_total{reused=true} = %d, want 4", n)
+	}
+	if n := m.counter("proxy_upstream_connections_total{reused=false}"); n != 2 {
+		t.Errorf("proxy_upstream_connections_total{reused=false} = %d, want 2", n)
+	}
+
+	// The hosts other clients visit are for admins only.
+	if rec := serve(p, httptest.NewRequest(http.MethodGet, "/stats", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("GET /stats from a proxy client: status %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// parseUpstreamProxy parses the -upstream-proxy URL. Only plain HTTP
+// proxies are supported.
+func parseUpstreamProxy(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream proxy %q, want http://host:port", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	return u, nil
+}
+
+// isProxyDialError reports whether err means no connection to the upstream
+// proxy could be made. With a proxy configured nothing else is dialed; the
+// transport wraps such errors as "proxyconnect" along with other failures,
+// such as the proxy refusing a CONNECT, which are not fallen back from.
+func isProxyDialError(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	if opErr.Op == "proxyconnect" && !errors.As(opErr.Err, &opErr) {
+		return false
+	}
+	return opErr.Op == "dial"
+}
+
+// fallbackTransport sends requests through the upstream proxy and, when the
+// proxy can't be reached, once more directly to the origin. Requests whose
+// body can't be replayed are not retried.
+type fallbackTransport struct {
+	proxy   *Proxy
+	proxied http.RoundTripper
+	direct  http.RoundTripper
+}
+
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.proxied.RoundTrip(req)
+	if err == nil || !isProxyDialError(err) {
+		return resp, err
+	}
+
+	if !t.proxy.allowRetry("fallback") {
+		t.proxy.logEvent("Upstream proxy unreachable for %s, not retrying direct: retry budget spent", req.URL)
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+	case req.GetBody != nil:
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	default:
+		t.proxy.logEvent("Upstream proxy unreachable for %s, not retrying direct: request body can't be replayed", req.URL)
+		return nil, err
+	}
+	t.proxy.logEvent("Upstream proxy unreachable for %s, falling back to direct: %v", req.URL, err)
+	t.proxy.metrics.IncCounter("proxy_upstream_fallback_total", nil)
+	return t.direct.RoundTrip(retry)
+}
+
+// dialTunnel connects a CONNECT tunnel to hostport, through the upstream
+// proxy when one is configured. Each tunnel counts toward -retry-budget and
+// falling back to a direct dial spends from it, as forwarded requests do.
+func (p *Proxy) dialTunnel(ctx context.Context, hostport string) (net.Conn, error) {
+	p.countUpstreamRequest()
+	if p.cfg.UpstreamProxy == nil {
+		return p.dialDirect(ctx, hostport)
+	}
+	conn, err := p.dialViaUpstreamProxy(ctx, hostport)
+	if err != nil && p.cfg.UpstreamFallbackDirect && isProxyDialError(err) {
+		if !p.allowRetry("fallback") {
+			p.logEvent("Upstream proxy unreachable for CONNECT %s, not retrying direct: retry budget spent", hostport)
+			return nil, err
+		}
+		p.logEvent("Upstream proxy unreachable for CONNECT %s, falling back to direct: %v", hostport, err)
+		p.metrics.IncCounter("proxy_upstream_fallback_total", nil)
+		return p.dialDirect(ctx, hostport)
+	}
+	return conn, err
+}
+
+// dialViaUpstreamProxy opens a tunnel to hostport with a CONNECT request to
+// the upstream proxy.
+func (p *Proxy) dialViaUpstreamProxy(ctx context.Context, hostport string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectDialTimeout)
+	defer cancel()
+	conn, err := p.newDialer().DialContext(ctx, "tcp", p.cfg.UpstreamProxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostport},
+		Host:   hostport,
+		Header: make(http.Header),
+	}
+	if user := p.cfg.UpstreamProxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The body of a successful CONNECT response is the tunnel itself, so it
+	// is left unread.
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT %s: %s", hostport, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads first from r, which holds bytes the upstream proxy sent
+// right after its CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// unreachableProxyURL returns the URL of a port nothing listens on.
+func unreachableProxyURL(t *testing.T) *url.URL {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return &url.URL{Scheme: "http", Host: addr}
+}
+
+func TestTunnelFallbackSpendsRetryBudget(t *testing.T) {
+	dest := newEchoServer(t)
+	p := newTestProxy(t, Config{
+		UpstreamProxy:          unreachableProxyURL(t),
+		UpstreamFallbackDirect: true,
+		RetryBudget:            0.5,
+		RetryBudgetWindow:      time.Hour,
+	})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	// Each tunnel counts as a request, so n tunnels may fall back while
+	// n <= retryBudgetMin + n/2.
+	allowed := 2 * retryBudgetMin
+	for i := 0; i < allowed; i++ {
+		conn, err := p.dialTunnel(context.Background(), dest)
+		if err != nil {
+			t.Fatalf("dial %d: %v, want a direct fallback", i, err)
+		}
+		conn.Close()
+	}
+	if _, err := p.dialTunnel(context.Background(), dest); err == nil {
+		t.Fatal("dial fell back direct with the retry budget spent")
+	}
+	if n := m.counter("proxy_upstream_fallback_total"); n != allowed {
+		t.Errorf("proxy_upstream_fallback_total = %d, want %d", n, allowed)
+	}
+	if n := m.counter("proxy_retries_suppressed_total{reason=fallback}"); n != 1 {
+		t.Errorf("proxy_retries_suppressed_total{reason=fallback} = %d, want 1", n)
+	}
+}
+
+func TestTunnelFallbackWithoutBudget(t *testing.T) {
+	dest := newEchoServer(t)
+	p := newTestProxy(t, Config{UpstreamProxy: unreachableProxyURL(t), UpstreamFallbackDirect: true})
+	for i := 0; i < 2*retryBudgetMin; i++ {
+		conn, err := p.dialTunnel(context.Background(), dest)
+		if err != nil {
+			t.Fatalf("dial %d: %v, want a direct fallback", i, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestForwardFallsBackDirect(t *testing.T) {
+	upstream := &countingHandler{body: "origin"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{LogFile: logs, UpstreamProxy: unreachableProxyURL(t), UpstreamFallbackDirect: true})
+	m := newRecordingMetrics()
+	p.metrics = m
+
+	rec := get(p, target)
+	if rec.Code != http.StatusOK || rec.Body.String() != "origin" {
+		t.Errorf("GET: status %d, body %q; want the origin's response", rec.Code, rec.Body.String())
+	}
+	// A streamed POST body can't be sent twice, so it isn't retried direct.
+	if rec := postThrough(p, target, "payload"); rec.Code < 500 {
+		t.Errorf("POST: status %d, want an error", rec.Code)
+	}
+	if len(logs.lines("request body can't be replayed")) != 1 {
+		t.Errorf("skipped POST fallback not logged:\n%s", logs)
+	}
+	if n := m.counter("proxy_upstream_fallback_total"); n != 1 {
+		t.Errorf("proxy_upstream_fallback_total = %d, want 1", n)
+	}
+	if len(logs.lines("falling back to direct")) != 1 {
+		t.Errorf("fallback not logged:\n%s", logs)
+	}
+
+	// Buffered for -post-retries, the body can be replayed.
+	p = newTestProxy(t, Config{UpstreamProxy: unreachableProxyURL(t), UpstreamFallbackDirect: true, POSTRetries: 1, POSTRetryMaxBody: 1 << 10})
+	if rec := postThrough(p, target, "payload"); rec.Code != http.StatusOK {
+		t.Errorf("buffered POST: status %d, want it replayed direct", rec.Code)
+	}
+}
+
+func TestForwardWithoutFallbackFails(t *testing.T) {
+	upstream := &countingHandler{body: "origin"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	p := newTestProxy(t, Config{UpstreamProxy: unreachableProxyURL(t)})
+
+	if rec := get(p, target); rec.Code < 500 {
+		t.Errorf("GET with the upstream proxy down: status %d, want an error", rec.Code)
+	}
+	if n := upstream.requests(); n != 0 {
+		t.Errorf("origin got %d requests without -upstream-fallback-direct", n)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserinfoMovedToAuthorization(t *testing.T) {
+	u := newTestUpstream(t, echoHeader("Authorization"))
+	target := "http://alice:s3cret@" + u.Host + "/page"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true, AccessLogFormat: "combined", AccessLogSample: 1, LogFile: logs})
+
+	rec := get(p, target)
+	want := httptest.NewRequest(http.MethodGet, "/", nil)
+	want.SetBasicAuth("alice", "s3cret")
+	if got := rec.Body.String(); got != want.Header.Get("Authorization") {
+		t.Errorf("upstream got Authorization %q, want %q", got, want.Header.Get("Authorization"))
+	}
+	// With the credentials gone from the URL the cache key can't tell
+	// users apart, so the response isn't cached for a later plain request.
+	if got := rec.Header().Get("X-Cache"); got != "BYPASS" {
+		t.Errorf("X-Cache %q, want BYPASS", got)
+	}
+	if got := get(p, "http://"+u.Host+"/page").Body.String(); got != "" {
+		t.Errorf("request without credentials got Authorization %q", got)
+	}
+	if strings.Contains(logs.String(), "s3cret") || strings.Contains(logs.String(), "alice") {
+		t.Errorf("log holds the credentials:\n%s", logs)
+	}
+	if len(logs.lines(`"GET http://`+u.Host+`/page HTTP/1.1" 200`)) != 2 {
+		t.Errorf("access log doesn't show the URL without userinfo:\n%s", logs)
+	}
+
+	// An Authorization header the client sent wins over the userinfo.
+	req := httptest.NewRequest(http.MethodGet, target+"?own", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	if got := serve(p, req).Body.String(); got != "Bearer abc" {
+		t.Errorf("with the client's own header: upstream got Authorization %q, want Bearer abc", got)
+	}
+}
+
+func TestMoveUserinfo(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://bob@api.example.com/v1?q=1", nil)
+	if !moveUserinfo(req) {
+		t.Fatal("moveUserinfo found no userinfo")
+	}
+	if req.URL.User != nil || req.RequestURI != "http://api.example.com/v1?q=1" {
+		t.Errorf("URL %s, RequestURI %s, want the userinfo removed", req.URL, req.RequestURI)
+	}
+	if user, password, _ := req.BasicAuth(); user != "bob" || password != "" {
+		t.Errorf("Basic auth %q:%q, want bob with no password", user, password)
+	}
+	if moveUserinfo(httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)) {
+		t.Error("moveUserinfo found userinfo in a plain URL")
+	}
+}
+
+// TestAuthorizationResponsesNotShared checks a response to a request with
+// Authorization is only stored, and a request with Authorization only
+// answered from the cache, when the response is marked public or has an
+// s-maxage.
+func TestAuthorizationResponsesNotShared(t *testing.T) {
+	u := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		if cc := req.URL.Query().Get("cc"); cc != "" {
+			res.Header().Set("Cache-Control", cc)
+		}
+		res.Write([]byte(req.Header.Get("Authorization")))
+	})
+	p := newTestProxy(t, Config{CacheTTL: time.Minute, XCacheHeader: true})
+	getAs := func(path, credentials string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, u.String()+path, nil)
+		if credentials != "" {
+			req.Header.Set("Authorization", credentials)
+		}
+		return serve(p, req)
+	}
+
+	// Neither Alice's response nor an anonymous one is shared with Bob.
+	for i, c := range []struct{ credentials, body, cache string }{
+		{"Bearer alice", "Bearer alice", "MISS"},
+		{"", "", "MISS"},
+		{"", "", "HIT"},
+		{"Bearer bob", "Bearer bob", "MISS"},
+		{"Bearer alice", "Bearer alice", "MISS"},
+	} {
+		rec := getAs("/private", c.credentials)
+		if rec.Body.String() != c.body || rec.Header().Get("X-Cache") != c.cache {
+			t.Errorf("request %d as %q: body %q, X-Cache %q; want %q, %s",
+				i, c.credentials, rec.Body.String(), rec.Header().Get("X-Cache"), c.body, c.cache)
+		}
+	}
+
+	// A response the upstream marks as shared is cached for everyone.
+	for _, cc := range []string{"public", "s-maxage=60"} {
+		path := "/shared?cc=" + cc
+		getAs(path, "Bearer alice")
+		for _, credentials := range []string{"Bearer bob", ""} {
+			rec := getAs(path, credentials)
+			if rec.Body.String() != "Bearer alice" || rec.Header().Get("X-Cache") != "HIT" {
+				t.Errorf("Cache-Control %s, request as %q: body %q, X-Cache %q; want Alice's cached response",
+					cc, credentials, rec.Body.String(), rec.Header().Get("X-Cache"))
+			}
+		}
+	}
+}
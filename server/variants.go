@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// acceptedEncodings normalizes the request's Accept-Encoding to the sorted
+// list of codings it accepts, so clients that accept the same codings,
+// however they spell and order them, share a cached variant.
+func acceptedEncodings(reqHeader http.Header) string {
+	var codings []string
+	for _, part := range strings.Split(strings.Join(reqHeader.Values("Accept-Encoding"), ","), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" && qValue(params) > 0 {
+			codings = append(codings, coding)
+		}
+	}
+	sort.Strings(codings)
+	return strings.Join(codings, ",")
+}
+
+// variesByEncoding reports whether a response's body depends on the
+// request's Accept-Encoding: it says so in Vary, or it is content-coded,
+// which only clients accepting that coding can read.
+func variesByEncoding(header http.Header) bool {
+	if ce := header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return true
+	}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Accept-Encoding") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodingVariant returns the identity a response that varies by
+// Accept-Encoding is cached under: identity plus the codings the client
+// accepts.
+func encodingVariant(identity string, reqHeader http.Header) string {
+	return identity + "\nAccept-Encoding: " + acceptedEncodings(reqHeader)
+}
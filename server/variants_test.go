@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCachesEncodingVariantsSeparately(t *testing.T) {
+	const text = "the same resource, gzipped or not"
+	var fetches atomic.Int32
+	target := newTestUpstream(t, func(res http.ResponseWriter, req *http.Request) {
+		fetches.Add(1)
+		res.Header().Set("Vary", "Accept-Encoding")
+		if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			res.Write([]byte(text))
+			return
+		}
+		res.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(res)
+		zw.Write([]byte(text))
+		zw.Close()
+	}).String() + "/page"
+	p := newTestProxy(t, Config{XCacheHeader: true})
+
+	for i, c := range []struct {
+		acceptEncoding string
+		cache          string
+		gzipped        bool
+	}{
+		{"gzip", "MISS", true},
+		{"", "MISS", false},
+		{"gzip", "HIT", true},
+		{"", "HIT", false},
+		// Spelled differently, but accepting the same codings.
+		{"GZIP, br;q=0", "HIT", true},
+		{"identity", "MISS", false},
+	} {
+		rec := getEncoded(p, target, c.acceptEncoding)
+		if got := rec.Header().Get("X-Cache"); got != c.cache {
+			t.Errorf("request %d (Accept-Encoding %q): X-Cache %q, want %q", i, c.acceptEncoding, got, c.cache)
+		}
+		if gzipped := rec.Header().Get("Content-Encoding") == "gzip"; gzipped != c.gzipped {
+			t.Errorf("request %d (Accept-Encoding %q): gzipped %v, want %v", i, c.acceptEncoding, gzipped, c.gzipped)
+			continue
+		}
+		body := rec.Body.String()
+		if c.gzipped {
+			body = decode(t, "gzip", rec.Body)
+		}
+		if body != text {
+			t.Errorf("request %d (Accept-Encoding %q): body %q", i, c.acceptEncoding, body)
+		}
+	}
+	if n := fetches.Load(); n != 3 {
+		t.Errorf("upstream got %d requests, want one per variant, 3", n)
+	}
+}
+
+func TestAcceptedEncodings(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                         "",
+		"gzip":                     "gzip",
+		"br, GZIP":                 "br,gzip",
+		"gzip;q=0.5, br;q=0, zstd": "gzip,zstd",
+		" deflate ; q=1 , gzip ":   "deflate,gzip",
+	} {
+		if got := acceptedEncodings(http.Header{"Accept-Encoding": {header}}); got != want {
+			t.Errorf("acceptedEncodings(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// addVia appends this proxy's entry, such as "1.1 proxy1", to the Via
+// header of a message received over proto version major.minor.
+func (p *Proxy) addVia(header http.Header, major, minor int) {
+	if p.cfg.ViaName == "" {
+		return
+	}
+	header.Add("Via", fmt.Sprintf("%d.%d %s", major, minor, p.cfg.ViaName))
+}
+
+// viaLoop reports whether header's Via already names this proxy, meaning
+// the request has come back around to it.
+func (p *Proxy) viaLoop(header http.Header) bool {
+	if p.cfg.ViaName == "" {
+		return false
+	}
+	for _, value := range header.Values("Via") {
+		for _, entry := range strings.Split(value, ",") {
+			// Each entry is "protocol received-by [comment]".
+			if fields := strings.Fields(entry); len(fields) >= 2 && strings.EqualFold(fields[1], p.cfg.ViaName) {
+				return true
+			}
+		}
+	}
+	return false
+}
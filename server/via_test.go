@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestViaLoopRejected(t *testing.T) {
+	upstream := &countingHandler{body: "ok"}
+	target := newTestUpstream(t, upstream.ServeHTTP).String() + "/page"
+	logs := &logBuffer{}
+	p := newTestProxy(t, Config{ViaName: "proxy1", LogFile: logs})
+
+	for _, via := range []string{"1.1 proxy1", "1.0 edge, 1.1 PROXY1 (v2)"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Via", via)
+		if rec := serve(p, req); rec.Code != http.StatusLoopDetected {
+			t.Errorf("Via %q: status %d, want 508", via, rec.Code)
+		}
+	}
+	if n := len(logs.lines("already passed through this proxy")); n != 2 {
+		t.Errorf("%d loops logged, want 2", n)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Via", "1.1 proxy10, 1.1 proxy")
+	if rec := serve(p, req); rec.Code != http.StatusOK {
+		t.Errorf("Via naming other proxies: status %d, want 200", rec.Code)
+	}
+	if n := upstream.requests(); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+// TestViaLoopThroughItself points a proxy's upstream proxy at itself, so
+// the forwarded request comes straight back.
+func TestViaLoopThroughItself(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, Config{ViaName: "proxy1", UpstreamProxy: &url.URL{Scheme: "http", Host: ln.Addr().String()}})
+	srv := httptest.NewUnstartedServer(p)
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	target := newTestUpstream(t, (&countingHandler{body: "ok"}).ServeHTTP).String() + "/page"
+	if rec := get(p, target); rec.Code != http.StatusLoopDetected {
+		t.Errorf("request looping through the proxy: status %d, want 508", rec.Code)
+	}
+}